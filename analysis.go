@@ -0,0 +1,160 @@
+// Registry of the NLP analyses that can be dispatched to Celery workers.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Name of the analysis run when a request does not specify one
+const DEFAULT_ANALYSIS = "lda_topics"
+
+// AnalysisParam describes a single parameter accepted by an analysis type.
+// Type is one of "int", "float", "string" or "[]string".
+type AnalysisParam struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+// AnalysisType maps a named analysis to the Celery task that runs it and
+// the parameters that task accepts.
+type AnalysisType struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Task        string          `json:"task"`
+	Params      []AnalysisParam `json:"params"`
+	// Map-style analyses produce one result per feedback, so their payloads
+	// can be split across several tasks and the results merged
+	Chunked bool `json:"chunked"`
+
+	// Parses and validates typed params from a request form. nil for
+	// analyses that do not yet accept typed params.
+	parseParams func(url.Values) (JobParams, error)
+	// Decodes and validates a raw worker result into a typed result. nil
+	// for analyses whose results are passed through as-is.
+	decodeResult func(interface{}, []Feedback) (interface{}, error)
+}
+
+// ParseParams reads this analysis type's parameters from form. Analyses
+// without typed parameters return nil params.
+func (at AnalysisType) ParseParams(form url.Values) (JobParams, error) {
+	if at.parseParams == nil {
+		return nil, nil
+	}
+	return at.parseParams(form)
+}
+
+// DecodeResult converts the raw body of a finished job into this analysis
+// type's result schema. fb is the feedback the job was run on.
+func (at AnalysisType) DecodeResult(body interface{}, fb []Feedback) (interface{}, error) {
+	if at.decodeResult == nil {
+		return body, nil
+	}
+	return at.decodeResult(body, fb)
+}
+
+// Registered analysis types, keyed by name. Add new analyses here once the
+// corresponding task exists in sift-nlp.
+var analysisRegistry = map[string]AnalysisType{
+	"lda_topics": {
+		Name:        "lda_topics",
+		Description: "Topic modeling with Latent Dirichlet Allocation",
+		Task:        "sift.jobrunner.jobs.lda_nlp.run",
+		Params: []AnalysisParam{
+			{"num_topics", "int", false, "Number of topics to extract (1-200)"},
+			{"iterations", "int", false, "Number of training passes over the corpus (1-5000)"},
+			{"stopwords", "[]string", false, "Comma-separated words to exclude from topics"},
+			{"min_doc_freq", "int", false, "Minimum number of documents a term must appear in"},
+			{"random_seed", "int", false, "Seed for reproducible runs"},
+		},
+		parseParams:  ParseLDAParams,
+		decodeResult: decodeLDAResult,
+	},
+	"sentiment": {
+		Name:        "sentiment",
+		Description: "Per-feedback sentiment polarity scoring",
+		Task:        "sift.jobrunner.jobs.sentiment.run",
+		Params:      []AnalysisParam{},
+		Chunked:     true,
+		decodeResult: func(body interface{}, fb []Feedback) (interface{}, error) {
+			return DecodeFeedbackResults("sentiment", body, fb)
+		},
+	},
+	"keywords": {
+		Name:        "keywords",
+		Description: "Keyword extraction for each piece of feedback",
+		Task:        "sift.jobrunner.jobs.keywords.run",
+		Params: []AnalysisParam{
+			{"max_keywords", "int", false, "Maximum number of keywords per feedback (1-50)"},
+		},
+		Chunked:     true,
+		parseParams: ParseKeywordsParams,
+		decodeResult: func(body interface{}, fb []Feedback) (interface{}, error) {
+			return DecodeFeedbackResults("keywords", body, fb)
+		},
+	},
+	"clustering": {
+		Name:        "clustering",
+		Description: "Groups similar feedback into clusters",
+		Task:        "sift.jobrunner.jobs.clustering.run",
+		Params: []AnalysisParam{
+			{"num_clusters", "int", false, "Number of clusters to form (2-100)"},
+		},
+		parseParams: ParseClusteringParams,
+	},
+	"summarization": {
+		Name:        "summarization",
+		Description: "Extractive summary of the feedback set",
+		Task:        "sift.jobrunner.jobs.summarization.run",
+		Params: []AnalysisParam{
+			{"max_sentences", "int", false, "Maximum number of sentences in the summary (1-50)"},
+		},
+		parseParams: ParseSummarizationParams,
+	},
+}
+
+// GetAnalysisType looks up a registered analysis type by name. An empty name
+// resolves to DEFAULT_ANALYSIS.
+func GetAnalysisType(name string) (AnalysisType, error) {
+	if name == "" {
+		name = DEFAULT_ANALYSIS
+	}
+	at, ok := analysisRegistry[name]
+	if !ok {
+		return AnalysisType{}, errors.New(fmt.Sprintf("Unknown analysis type %q", name))
+	}
+	return at, nil
+}
+
+// AnalysisTypes returns all registered analysis types sorted by name
+func AnalysisTypes() []AnalysisType {
+	names := make([]string, 0, len(analysisRegistry))
+	for name := range analysisRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	types := make([]AnalysisType, 0, len(names))
+	for _, name := range names {
+		types = append(types, analysisRegistry[name])
+	}
+	return types
+}
+
+// AnalysisTypesHandler writes the list of registered analysis types to w
+func AnalysisTypesHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(AnalysisTypes())
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAnalysisTypeDefault(t *testing.T) {
+	at, err := GetAnalysisType("")
+	if err != nil {
+		t.Error("GetAnalysisType: ", err)
+	}
+	assert.Equal(t, DEFAULT_ANALYSIS, at.Name)
+	assert.Equal(t, "sift.jobrunner.jobs.lda_nlp.run", at.Task)
+}
+
+func TestGetAnalysisTypeUnknown(t *testing.T) {
+	if _, err := GetAnalysisType("tea_leaves"); err == nil {
+		t.Error("Expected error for unregistered analysis type")
+	}
+}
+
+func TestAnalysisTypesHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/analyses/types", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(AnalysisTypesHandler)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var types []AnalysisType
+	if err := json.Unmarshal(rr.Body.Bytes(), &types); err != nil {
+		t.Error("json.Unmarshal", err)
+	}
+	assert.Equal(t, len(analysisRegistry), len(types))
+	for i := 1; i < len(types); i++ {
+		assert.True(t, types[i-1].Name < types[i].Name)
+	}
+}
@@ -0,0 +1,168 @@
+// Extraction of the session a request is made under, shared by every
+// handler and middleware that authenticates requests
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Reasons AuthenticateRequest fails. ErrNoSession means the request is
+// anonymous; writeSessionError answers the others with 401, except ErrCSRF
+// which is a 403. ErrSessionExpired, ErrInvalidAccessToken and
+// ErrAccessTokenExpired are also among them.
+var (
+	ErrNoSession        = errors.New("request carries no session")
+	ErrMalformedSession = errors.New("session could not be decoded")
+	ErrUnknownSession   = errors.New("session does not exist")
+	ErrInvalidAPIKey    = errors.New("API key is invalid or has been revoked")
+	ErrCSRF             = errors.New("missing or invalid CSRF token")
+)
+
+// apiKeyFromRequest returns the API key in r's `Authorization: Bearer`
+// header, if it carries one rather than a session
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return key, strings.HasPrefix(key, API_KEY_PREFIX)
+}
+
+// authenticateAPIKey returns the stand-in profile of requests made with key
+// at now, which belongs to the key's company and holds only its scopes
+func (dm *DataManager) authenticateAPIKey(key string, now time.Time) (Profile, error) {
+	k, err := dm.GetAPIKeyHelper(key)
+	if err == gorm.ErrRecordNotFound || (err == nil && k.RevokedAt != nil) {
+		return Profile{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	if err := dm.TouchAPIKeyHelper(k, now); err != nil {
+		fmt.Println("dm.TouchAPIKeyHelper: ", err)
+	}
+	return Profile{CompanyID: k.CompanyID, Scopes: append([]Permission{}, k.Scopes...)}, nil
+}
+
+// accessTokenFromRequest returns the access token in r's
+// `Authorization: Bearer` header, if it carries one rather than a session
+func accessTokenFromRequest(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, looksLikeAccessToken(token)
+}
+
+// authenticateAccessToken returns the profile of the user token was issued
+// to, if it is valid at now
+func (dm *DataManager) authenticateAccessToken(token string, now time.Time) (Profile, error) {
+	claims, err := ParseAccessToken(token, now, accessTokenKeys...)
+	if err != nil {
+		return Profile{}, err
+	}
+	profile, err := dm.requestProfile(claims.Subject)
+	if err == gorm.ErrRecordNotFound || (err == nil && profile.CompanyID != claims.Company) {
+		return Profile{}, ErrInvalidAccessToken
+	}
+	return profile, err
+}
+
+// requestProfile returns the profile of the user with id for handlers to act
+// as, with the password hash stripped and two-factor enforcement applied
+func (dm *DataManager) requestProfile(id uint) (Profile, error) {
+	profile, err := dm.GetProfileByIdHelper(id)
+	if err != nil {
+		return profile, err
+	}
+	profile.PwHash = nil
+	if !profile.TwoFactorEnabled {
+		profile.MustEnrollTwoFactor, err = dm.TwoFactorRequiredHelper(profile)
+	}
+	return profile, err
+}
+
+// sessionToken extracts the session token from the session cookie or, for
+// clients other than browsers, from an `Authorization: Bearer` header
+// carrying the session cookie's value. Reports whether the token came from
+// the cookie, which browsers send on requests forged by other sites.
+func (dm *DataManager) sessionToken(r *http.Request) (token string, fromCookie bool, err error) {
+	var encoded http.Cookie
+	if c, err := r.Cookie(SESSION_COOKIE_NAME); err == nil {
+		encoded, fromCookie = *c, true
+	} else if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return "", false, ErrMalformedSession
+		}
+		encoded.Value = strings.TrimPrefix(auth, "Bearer ")
+	} else {
+		return "", false, ErrNoSession
+	}
+	if token, err = dm.DecodeCookieHelper(encoded); err != nil || token == "" {
+		return "", fromCookie, ErrMalformedSession
+	}
+	return token, fromCookie, nil
+}
+
+// AuthenticateRequest resolves the session r is made under and its user's
+// profile (see requestProfile), recording the activity at now.
+// Requests that change state under a session cookie must carry its CSRF
+// token (see csrfSafe). Requests made with an API key have no session, and a
+// profile standing in for the key (see authenticateAPIKey). Requests made
+// with an access token have no session either.
+func (dm *DataManager) AuthenticateRequest(r *http.Request, now time.Time) (Session, Profile, error) {
+	if key, ok := apiKeyFromRequest(r); ok {
+		profile, err := dm.authenticateAPIKey(key, now)
+		return Session{}, profile, err
+	}
+	if token, ok := accessTokenFromRequest(r); ok {
+		profile, err := dm.authenticateAccessToken(token, now)
+		return Session{}, profile, err
+	}
+	token, fromCookie, err := dm.sessionToken(r)
+	if err != nil {
+		return Session{}, Profile{}, err
+	}
+	if fromCookie && !csrfSafe(r, token) {
+		return Session{}, Profile{}, ErrCSRF
+	}
+	sesh, err := dm.ResumeSessionHelper(token, now)
+	if err == gorm.ErrRecordNotFound {
+		err = ErrUnknownSession
+	}
+	if err != nil {
+		return sesh, Profile{}, err
+	}
+	profile, err := dm.requestProfile(sesh.UserID)
+	if err == gorm.ErrRecordNotFound {
+		err = ErrUnknownSession
+	}
+	return sesh, profile, err
+}
+
+// writeSessionError answers a request whose session could not be resolved by
+// AuthenticateRequest. Clients are told to drop session cookies that no
+// longer work.
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNoSession:
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+	case ErrInvalidAPIKey:
+		http.Error(w, "API key is invalid or has been revoked", http.StatusUnauthorized)
+	case ErrInvalidAccessToken:
+		http.Error(w, "Access token is invalid", http.StatusUnauthorized)
+	case ErrAccessTokenExpired:
+		http.Error(w, "Access token has expired", http.StatusUnauthorized)
+	case ErrMalformedSession, ErrUnknownSession:
+		clearSessionCookie(w)
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+	case ErrSessionExpired:
+		clearSessionCookie(w)
+		http.Error(w, "Session has expired", http.StatusUnauthorized)
+	case ErrCSRF:
+		http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+	default:
+		fmt.Println("dm.AuthenticateRequest: ", err)
+		http.Error(w, "Database error on session lookup", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionToken(t *testing.T) {
+	cookie, _ := dm.CreateCookieHelper("token")
+	request := func(cookies []*http.Cookie, auth string) (string, bool, error) {
+		req, _ := http.NewRequest("POST", "/feedback", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return dm.sessionToken(req)
+	}
+
+	// The session cookie is found among any others the browser sends
+	token, fromCookie, err := request([]*http.Cookie{
+		{Name: "_ga", Value: "GA1.2.3"},
+		&cookie,
+		{Name: "AWSALB", Value: "lb"},
+	}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "token", token)
+	assert.True(t, fromCookie)
+
+	token, fromCookie, err = request(nil, "Bearer "+cookie.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", token)
+	assert.False(t, fromCookie)
+
+	_, _, err = request([]*http.Cookie{{Name: "_ga", Value: "GA1.2.3"}}, "")
+	assert.Equal(t, ErrNoSession, err)
+	_, _, err = request([]*http.Cookie{{Name: SESSION_COOKIE_NAME, Value: "forged"}}, "")
+	assert.Equal(t, ErrMalformedSession, err)
+	_, _, err = request(nil, "Basic dXNlcjpwYXNz")
+	assert.Equal(t, ErrMalformedSession, err)
+}
+
+func TestWriteSessionError(t *testing.T) {
+	for err, code := range map[error]int{
+		ErrNoSession:          http.StatusUnauthorized,
+		ErrMalformedSession:   http.StatusUnauthorized,
+		ErrUnknownSession:     http.StatusUnauthorized,
+		ErrSessionExpired:     http.StatusUnauthorized,
+		ErrInvalidAPIKey:      http.StatusUnauthorized,
+		ErrInvalidAccessToken: http.StatusUnauthorized,
+		ErrAccessTokenExpired: http.StatusUnauthorized,
+		ErrCSRF:               http.StatusForbidden,
+	} {
+		rr := httptest.NewRecorder()
+		writeSessionError(rr, err)
+		assert.Equal(t, code, rr.Code, err.Error())
+	}
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	prof := Profile{UserName: "bearer_user", CompanyID: testCompany(t, "Sift Technologies, Inc.").ID, PwHash: []byte("hash")}
+	if err := dm.Create(&prof).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+	defer dm.Unscoped().Delete(&prof)
+	defer dm.DeleteSessionsByUserHelper(prof.ID)
+	cookies, id := loginFrom(t, prof.ID, "CLI")
+
+	// Clients that are not browsers send the session in a header, which
+	// other sites cannot forge, so they need no CSRF token
+	req, _ := http.NewRequest("DELETE", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+cookies[0].Value)
+	sesh, profile, err := dm.AuthenticateRequest(req, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, id, sesh.ID)
+	assert.Equal(t, prof.ID, profile.ID)
+	assert.Equal(t, 0, len(profile.PwHash))
+
+	// Sessions that have been signed out are unknown
+	dm.DeleteSessionByIdHelper(id)
+	_, _, err = dm.AuthenticateRequest(req, time.Now())
+	assert.Equal(t, ErrUnknownSession, err)
+
+	rr := httptest.NewRecorder()
+	dm.Authenticated(http.HandlerFunc(dm.ListSessions)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
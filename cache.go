@@ -0,0 +1,90 @@
+// Caching of analysis results by the content of the job that produced them.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// ResultCache stores decoded job results by company and content hash, so
+// that a company is only ever answered with results of its own jobs.
+// PGResultCache is the production implementation.
+type ResultCache interface {
+	// Get returns the result the company stored for hash, and false if there
+	// is none
+	Get(companyID uint, hash string) (json.RawMessage, bool, error)
+	Put(companyID uint, hash, analysis string, result interface{}) error
+}
+
+// normalizeBody collapses whitespace so that formatting differences between
+// uploads of the same feedback do not change its hash
+func normalizeBody(body string) string {
+	return strings.Join(strings.Fields(body), " ")
+}
+
+// ContentHash returns a hex SHA-256 identifying the submitting company, and
+// the analysis, parameters and normalized feedback of env. Jobs with the same
+// hash produce the same result.
+func ContentHash(companyID uint, env JobEnvelope) (string, error) {
+	fb := make([]Feedback, len(env.Feedback))
+	for i, f := range env.Feedback {
+		fb[i] = Feedback{ID: f.ID, FBody: normalizeBody(f.FBody)}
+	}
+	key := struct {
+		CompanyID uint        `json:"company_id"`
+		Version   int         `json:"version"`
+		Analysis  string      `json:"analysis"`
+		Params    interface{} `json:"params"`
+		Feedback  []Feedback  `json:"feedback"`
+	}{companyID, env.Version, env.Analysis, env.Params, fb}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// PGResultCache stores results in Postgres
+type PGResultCache struct {
+	dm *DataManager
+}
+
+func NewPGResultCache(dm *DataManager) *PGResultCache {
+	return &PGResultCache{dm}
+}
+
+func (c *PGResultCache) Get(companyID uint, hash string) (json.RawMessage, bool, error) {
+	var cr CachedResult
+	res := c.dm.ForCompany(companyID).Query(&CachedResult{}).Where("hash = ?", hash).First(&cr)
+	if res.RecordNotFound() {
+		return nil, false, nil
+	} else if res.Error != nil {
+		return nil, false, res.Error
+	}
+	return json.RawMessage(cr.Result), true, nil
+}
+
+// Put stores result for the company and hash, replacing any result already
+// stored
+func (c *PGResultCache) Put(companyID uint, hash, analysis string, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	tx := c.dm.ForCompany(companyID).Begin()
+	if err := tx.Query(&CachedResult{}).Unscoped().Where("hash = ?", hash).Delete(CachedResult{}).Error; err != nil {
+		tx.DB().Rollback()
+		return err
+	}
+	if err := tx.Create(&CachedResult{Hash: hash, Analysis: analysis, Result: string(data)}); err != nil {
+		tx.DB().Rollback()
+		return err
+	}
+	return tx.DB().Commit().Error
+}
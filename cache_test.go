@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memResultCache is an in-memory ResultCache
+type memResultCache struct {
+	mu      sync.Mutex
+	results map[string]json.RawMessage
+}
+
+func (c *memResultCache) Get(companyID uint, hash string) (json.RawMessage, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, ok := c.results[fmt.Sprint(companyID, "/", hash)]
+	return res, ok, nil
+}
+
+func (c *memResultCache) Put(companyID uint, hash, analysis string, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[fmt.Sprint(companyID, "/", hash)] = data
+	return nil
+}
+
+func TestContentHashNormalizesFeedback(t *testing.T) {
+	a := NewJobEnvelope("lda_topics", DefaultLDAParams(), []Feedback{{0, "Loud  blender\n"}})
+	b := NewJobEnvelope("lda_topics", DefaultLDAParams(), []Feedback{{0, " Loud blender"}})
+	ha, err := ContentHash(1, a)
+	if err != nil {
+		t.Fatal("ContentHash: ", err)
+	}
+	hb, _ := ContentHash(1, b)
+	assert.Equal(t, ha, hb)
+
+	// Chunking does not change what is being analysed
+	b.Chunk = &ChunkInfo{Index: 0, Count: 1}
+	hb, _ = ContentHash(1, b)
+	assert.Equal(t, ha, hb)
+}
+
+func TestContentHashDiffers(t *testing.T) {
+	fb := []Feedback{{0, "Loud blender"}}
+	base, _ := ContentHash(1, NewJobEnvelope("lda_topics", DefaultLDAParams(), fb))
+
+	params := DefaultLDAParams()
+	params.NumTopics = 3
+	others := []JobEnvelope{
+		NewJobEnvelope("lda_topics", params, fb),
+		NewJobEnvelope("keywords", nil, fb),
+		NewJobEnvelope("lda_topics", DefaultLDAParams(), []Feedback{{1, "Loud blender"}}),
+		NewJobEnvelope("lda_topics", DefaultLDAParams(), []Feedback{{0, "Quiet blender"}}),
+	}
+	for _, env := range others {
+		h, _ := ContentHash(1, env)
+		assert.NotEqual(t, base, h)
+	}
+
+	// Identical uploads by different companies are never shared
+	h, _ := ContentHash(2, NewJobEnvelope("lda_topics", DefaultLDAParams(), fb))
+	assert.NotEqual(t, base, h)
+}
+
+func TestJobRunnerCachesResults(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{ldaSuccess}}
+	jr := newFakeRunner(q)
+	jr.UseCache(&memResultCache{results: make(map[string]json.RawMessage)})
+	at, _ := GetAnalysisType("lda_topics")
+	env := NewJobEnvelope(at.Name, DefaultLDAParams(), jobFeedback)
+
+	first, err := jr.Submit(0, at, env, false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	waitForJob(t, first)
+	assert.False(t, first.Status().Cached)
+
+	second, err := jr.Submit(0, at, env, false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	status := second.Status()
+	assert.True(t, status.Cached)
+	assert.Equal(t, JOB_COMPLETED, status.Status)
+	assert.Equal(t, 1, len(q.dispatched))
+
+	firstResult, _ := first.Result()
+	secondResult, _ := second.Result()
+	a, _ := json.Marshal(firstResult)
+	b, _ := json.Marshal(secondResult)
+	assert.JSONEq(t, string(a), string(b))
+
+	forced, err := jr.Submit(0, at, env, true)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	waitForJob(t, forced)
+	assert.False(t, forced.Status().Cached)
+	assert.Equal(t, 2, len(q.dispatched))
+}
+
+func TestJobRunnerCacheScopedToCompany(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{ldaSuccess}}
+	jr := newFakeRunner(q)
+	jr.UseCache(&memResultCache{results: make(map[string]json.RawMessage)})
+	store := &memJobQueue{quotas: map[uint]JobQuota{}}
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+	at, _ := GetAnalysisType("lda_topics")
+	env := NewJobEnvelope(at.Name, DefaultLDAParams(), jobFeedback)
+
+	first, err := jr.Submit(1, at, env, false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	waitForJob(t, first)
+
+	// Another company uploading the same feedback is not told of the first
+	other, err := jr.Submit(2, at, env, false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	assert.False(t, other.Status().Cached)
+	waitForJob(t, other)
+
+	// Cache hits never enter the queue
+	cached, err := jr.Submit(1, at, env, false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	assert.True(t, cached.Status().Cached)
+	time.Sleep(3 * QUERY_PERIOD)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	assert.Equal(t, 2, len(store.jobs))
+	assert.Equal(t, 0, len(store.unknown))
+}
@@ -4,21 +4,26 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"time"
 
 	celery "github.com/shicky/gocelery"
 )
 
 const (
-	// How frequently we ask Celery if it's done processing the task.
+	// How frequently we first ask Celery if it's done processing a task. The
+	// period doubles each time a poll finds nothing new, up to
+	// MAX_QUERY_PERIOD.
 	QUERY_PERIOD = time.Millisecond * 50
-	// How much time we allow for receiving a task's result, once we know it's completed.
-	RETRIEVAL_TIMEOUT = time.Second
-	// How much time we will spend querying Celery for completion status after dispatching a task.
-	TIMEOUT = time.Second * 10
+	// Longest period between two queries for a task's status
+	MAX_QUERY_PERIOD = time.Second * 5
+	// How long each task of a job may run before the job fails, unless
+	// configured otherwise
+	DEFAULT_JOB_TIMEOUT = time.Minute * 30
 )
 
+// Error returned by the Redis backend for tasks it has no record of
+const celeryResultNotAvailable = "result not available"
+
 // CeleryAPI contains references to the Celery backend, broker, and client.
 // It exposes a number of methods for running Celery jobs.
 type CeleryAPI struct {
@@ -27,11 +32,20 @@ type CeleryAPI struct {
 	Client  *celery.CeleryClient
 }
 
-// CeleryResult is the type returned from job running functions.
-// It contains the result object or an error, if one occurred.
-type CeleryResult struct {
-	Error error
-	Body  interface{}
+// TaskState is a snapshot of a dispatched task's state in the result backend.
+// Status is one of the Celery states (PENDING, STARTED, PROGRESS, SUCCESS,
+// FAILURE, ...). Result holds the task's return value on SUCCESS, its
+// progress metadata on PROGRESS, and the exception on FAILURE.
+type TaskState struct {
+	Status string
+	Result interface{}
+}
+
+// TaskQueue dispatches named tasks and reports on their state. CeleryAPI is
+// the production implementation.
+type TaskQueue interface {
+	Dispatch(name string, payload interface{}) (string, error)
+	State(taskID string) (*TaskState, error)
 }
 
 // Returns a new Celery API, connected to Celery at the given URL.
@@ -47,34 +61,25 @@ func NewCeleryAPI(amqpURL, redisURL string) (*CeleryAPI, error) {
 	return &CeleryAPI{backend, broker, client}, nil
 }
 
-// Runs a Celery job asynchronously and returns the result through the `result` channel.
-// This function should be run as a goroutine.
-func (api *CeleryAPI) RunJob(name string, payload interface{}, result chan *CeleryResult) {
-	// Send the job to Celery to be run.
+// Dispatch sends a job to Celery to be run and returns its task ID
+func (api *CeleryAPI) Dispatch(name string, payload interface{}) (string, error) {
 	job, err := api.Client.Delay(name, payload)
 	if err != nil {
-		result <- &CeleryResult{err, nil}
-		return
+		return "", err
 	}
+	return job.TaskID, nil
+}
 
-	beganPollingAt := time.Now()
-	for {
-		// Check for timeout
-		if time.Now().Sub(beganPollingAt) > TIMEOUT {
-			err := errors.New(fmt.Sprintf("Request timed out to retrieve job %s with timeout %s.",
-				name, time.Duration(TIMEOUT).String()))
-			result <- &CeleryResult{err, nil}
-			return
-		}
-
-		// Check for job completion
-		ready, _ := job.Ready()
-		// Retrieve result
-		if ready {
-			res, err := job.Get(RETRIEVAL_TIMEOUT)
-			result <- &CeleryResult{err, res}
-			return
-		}
-		time.Sleep(QUERY_PERIOD)
+// State retrieves the current state of a task from the result backend. The
+// backend has no record of a task until a worker picks it up, so a missing
+// result is reported as PENDING. Any other backend error is returned.
+func (api *CeleryAPI) State(taskID string) (*TaskState, error) {
+	res, err := api.Backend.GetResult(taskID)
+	if err != nil && err.Error() != celeryResultNotAvailable {
+		return nil, errors.New("result backend: " + err.Error())
+	}
+	if err != nil || res == nil {
+		return &TaskState{Status: "PENDING"}, nil
 	}
+	return &TaskState{Status: res.Status, Result: res.Result}, nil
 }
@@ -0,0 +1,117 @@
+// Loading of the keys session cookies and access tokens are signed with
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// Shortest hash key accepted for signing cookies
+	MIN_COOKIE_HASH_KEY_LENGTH = 32
+	// Shortest key accepted for signing access tokens
+	MIN_TOKEN_KEY_LENGTH = 32
+)
+
+// scanKeys calls parse with the line number and fields of each line of r,
+// skipping blank lines and lines starting with '#'
+func scanKeys(r io.Reader, parse func(n int, fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(n, strings.Fields(line)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadCookieKeys reads cookie key pairs from r, one pair per line: a hex
+// hash key that signs cookies, optionally followed by a hex block key of 16,
+// 24 or 32 bytes that encrypts them. Blank lines and lines starting with '#'
+// are skipped. The first pair encodes new cookies. To rotate keys, add a new
+// pair at the top and keep the old ones below it until the cookies they
+// encoded have expired (see SESSION_LIFETIME).
+func LoadCookieKeys(r io.Reader) ([]securecookie.Codec, error) {
+	var pairs [][]byte
+	err := scanKeys(r, func(n int, fields []string) error {
+		if len(fields) > 2 {
+			return errors.New(fmt.Sprintf("line %d: expected a hash key and an optional block key", n))
+		}
+		hashKey, err := hex.DecodeString(fields[0])
+		if err != nil || len(hashKey) < MIN_COOKIE_HASH_KEY_LENGTH {
+			return errors.New(fmt.Sprintf("line %d: hash key must be at least %d hex encoded bytes", n, MIN_COOKIE_HASH_KEY_LENGTH))
+		}
+		var blockKey []byte
+		if len(fields) == 2 {
+			blockKey, err = hex.DecodeString(fields[1])
+			if l := len(blockKey); err != nil || (l != 16 && l != 24 && l != 32) {
+				return errors.New(fmt.Sprintf("line %d: block key must be 16, 24 or 32 hex encoded bytes", n))
+			}
+		}
+		pairs = append(pairs, hashKey, blockKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no cookie keys found")
+	}
+	return securecookie.CodecsFromPairs(pairs...), nil
+}
+
+// LoadCookieKeysFile reads cookie key pairs from the file at path, as
+// LoadCookieKeys does
+func LoadCookieKeysFile(path string) ([]securecookie.Codec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadCookieKeys(f)
+}
+
+// LoadTokenKeys reads access token signing keys from r, one hex key per line,
+// skipping blank lines and lines starting with '#'. The first key signs new
+// tokens. Keys are rotated as with LoadCookieKeys, keeping old keys until the
+// tokens they signed have expired (see ACCESS_TOKEN_TTL).
+func LoadTokenKeys(r io.Reader) ([][]byte, error) {
+	var keys [][]byte
+	err := scanKeys(r, func(n int, fields []string) error {
+		key, err := hex.DecodeString(fields[0])
+		if len(fields) != 1 || err != nil || len(key) < MIN_TOKEN_KEY_LENGTH {
+			return errors.New(fmt.Sprintf("line %d: expected a key of at least %d hex encoded bytes", n, MIN_TOKEN_KEY_LENGTH))
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no token keys found")
+	}
+	return keys, nil
+}
+
+// LoadTokenKeysFile reads access token signing keys from the file at path,
+// as LoadTokenKeys does
+func LoadTokenKeysFile(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadTokenKeys(f)
+}
@@ -0,0 +1,154 @@
+// Parsing and evaluation of standard 5-field cron expressions.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression of the form
+// "minute hour day-of-month month day-of-week". Each field is a bitset of
+// the values it matches.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Whether day-of-month and day-of-week were "*", which changes how the
+	// two are combined (see matchesDay)
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	name     string
+	min, max uint
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+// How far ahead Next searches before deciding an expression never matches,
+// e.g. "0 0 30 2 *"
+const CRON_MAX_SEARCH = 5 * 366 * 24 * time.Hour
+
+// ParseCron parses a standard 5-field cron expression. Fields may be "*", a
+// number, a range "a-b", a list "a,b", or any of those with a step "/n".
+// Day of week 7 is accepted as Sunday.
+func ParseCron(expr string) (*CronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, errors.New(fmt.Sprintf("cron expression must have %d fields, had %d",
+			len(cronFields), len(parts)))
+	}
+	bits := make([]uint64, len(parts))
+	for i, part := range parts {
+		f := cronFields[i]
+		max := f.max
+		if i == 4 {
+			// Allow 7 for Sunday, folded into 0 below
+			max = 7
+		}
+		b, err := parseCronField(part, f.min, max)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s %q: %s", f.name, part, err.Error()))
+		}
+		bits[i] = b
+	}
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = (bits[4] | 1) &^ (1 << 7)
+	}
+	return &CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: parts[2] == "*",
+		dowStar: parts[4] == "*",
+	}, nil
+}
+
+// parseCronField returns the bitset of values in [min, max] matched by field
+func parseCronField(field string, min, max uint) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, uint(1)
+		if i := strings.Index(item, "/"); i >= 0 {
+			s, err := strconv.ParseUint(item[i+1:], 10, 8)
+			if err != nil || s == 0 {
+				return 0, errors.New("step must be a positive integer")
+			}
+			rng, step = item[:i], uint(s)
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			l, err := strconv.ParseUint(bounds[0], 10, 8)
+			if err != nil {
+				return 0, errors.New("expected a number")
+			}
+			lo, hi = uint(l), uint(l)
+			if len(bounds) == 2 {
+				h, err := strconv.ParseUint(bounds[1], 10, 8)
+				if err != nil {
+					return 0, errors.New("expected a number")
+				}
+				hi = uint(h)
+			} else if step > 1 {
+				// "a/n" means every n starting at a
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New(fmt.Sprintf("values must be between %d and %d", min, max))
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay reports whether t's day matches. As in Vixie cron, when both
+// day of month and day of week are restricted a day matching either counts.
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// Next returns the first time strictly after t matched by the schedule, in
+// t's location, or the zero time if there is none within CRON_MAX_SEARCH
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(CRON_MAX_SEARCH)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
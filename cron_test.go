@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCron(t *testing.T, expr string) *CronSchedule {
+	c, err := ParseCron(expr)
+	if err != nil {
+		t.Fatalf("ParseCron(%q): %v", expr, err)
+	}
+	return c
+}
+
+func TestCronNext(t *testing.T) {
+	// Wednesday
+	from := time.Date(2017, 3, 15, 10, 30, 0, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2017, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"*/15 9-17 * * *", time.Date(2017, 3, 15, 10, 45, 0, 0, time.UTC)},
+		// Weekly on Monday at 9am
+		{"0 9 * * 1", time.Date(2017, 3, 20, 9, 0, 0, 0, time.UTC)},
+		// Sunday as 7
+		{"0 0 * * 7", time.Date(2017, 3, 19, 0, 0, 0, 0, time.UTC)},
+		{"30 6 1 * *", time.Date(2017, 4, 1, 6, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week when both are restricted
+		{"0 0 1 * 5", time.Date(2017, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * 6,9 *", time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.next, mustParseCron(t, c.expr).Next(from), c.expr)
+	}
+}
+
+func TestCronNeverMatches(t *testing.T) {
+	c := mustParseCron(t, "0 0 30 2 *")
+	assert.True(t, c.Next(time.Now()).IsZero())
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	bad := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	}
+	for _, expr := range bad {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("Expected error parsing %q", expr)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Protection of cookie-authenticated requests against cross-site request
+// forgery, and the cookie and cross-origin settings it relies on
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// Cookie holding the CSRF token of the session, which the web app reads
+	// and echoes back in CSRF_HEADER. Web apps served from another origin
+	// cannot read it, and get the token from CSRFToken instead.
+	CSRF_COOKIE_NAME = "csrf_token"
+	// Header that requests changing state under a session cookie must carry
+	// the session's CSRF token in
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
+// Whether cookies are only sent over HTTPS. main turns this off with
+// -insecurecookies for local development over plain HTTP.
+var secureCookies = true
+
+// setCookie adds c to the response with SameSite=Lax, so that browsers do
+// not send it on cross-site subrequests or form posts. Written by hand as
+// http.Cookie has no SameSite field in the Go version we build with.
+func setCookie(w http.ResponseWriter, c *http.Cookie) {
+	if v := c.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; SameSite=Lax")
+	}
+}
+
+// csrfTokenFor returns the CSRF token of the session with sessionToken. It
+// is bound to the session, so a token planted by another site or taken from
+// another session is useless, and reveals nothing about the session token.
+func csrfTokenFor(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFCookieHelper returns the cookie that hands the CSRF token of the
+// session with sessionToken to the web app. Unlike the session cookie it is
+// readable by scripts.
+func CSRFCookieHelper(sessionToken string) http.Cookie {
+	return http.Cookie{
+		Name:   CSRF_COOKIE_NAME,
+		Value:  csrfTokenFor(sessionToken),
+		Path:   "/",
+		MaxAge: int(SESSION_LIFETIME / time.Second),
+		Secure: secureCookies,
+	}
+}
+
+// csrfSafe reports whether r, made under the session with sessionToken, may
+// proceed. Requests that only read are always allowed; all others must
+// carry the session's CSRF token in CSRF_HEADER, which other sites cannot
+// read or set.
+func csrfSafe(r *http.Request, sessionToken string) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	sent := r.Header.Get(CSRF_HEADER)
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(csrfTokenFor(sessionToken))) == 1
+}
+
+// csrfTokenResponse is the body of CSRFToken responses
+type csrfTokenResponse struct {
+	Token string `json:"csrf_token"`
+}
+
+// CSRFToken returns the CSRF token of the session cookie the request is made
+// under, for web apps that cannot read CSRF_COOKIE_NAME because they are
+// served from another origin. Other sites cannot read the response, as
+// AllowOrigin only shares it with the web app.
+func (dm *DataManager) CSRFToken(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie, err := dm.sessionToken(r)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	if !fromCookie {
+		http.Error(w, "Only requests with a session cookie need a CSRF token", http.StatusBadRequest)
+		return
+	}
+
+	body, err := json.Marshal(csrfTokenResponse{csrfTokenFor(token)})
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// AllowOrigin lets the web app at origin call next from the browser with its
+// cookies, answering preflight requests itself. Requests from other origins
+// get no CORS headers, so browsers withhold the responses from them.
+func AllowOrigin(origin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || r.Header.Get("Origin") != origin {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+CSRF_HEADER)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
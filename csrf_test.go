@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFTokenBoundToSession(t *testing.T) {
+	token := csrfTokenFor("session-a")
+	assert.Equal(t, token, csrfTokenFor("session-a"))
+	assert.NotEqual(t, token, csrfTokenFor("session-b"))
+	assert.False(t, strings.Contains(token, "session-a"))
+
+	req, _ := http.NewRequest("GET", "/sessions", nil)
+	assert.True(t, csrfSafe(req, "session-a"))
+	for _, sent := range []string{"", csrfTokenFor("session-b"), token + "0"} {
+		req, _ = http.NewRequest("POST", "/logout", nil)
+		req.Header.Set(CSRF_HEADER, sent)
+		assert.False(t, csrfSafe(req, "session-a"), sent)
+	}
+	req.Header.Set(CSRF_HEADER, token)
+	assert.True(t, csrfSafe(req, "session-a"))
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	cookie, err := dm.CreateCookieHelper("token")
+	assert.Nil(t, err)
+	csrf := CSRFCookieHelper("token")
+	rr := httptest.NewRecorder()
+	setCookie(rr, &cookie)
+	setCookie(rr, &csrf)
+
+	headers := rr.HeaderMap["Set-Cookie"]
+	if assert.Equal(t, 2, len(headers)) {
+		assert.True(t, strings.Contains(headers[0], "HttpOnly"))
+		// The web app must be able to read the CSRF token
+		assert.False(t, strings.Contains(headers[1], "HttpOnly"))
+		for _, h := range headers {
+			assert.True(t, strings.Contains(h, "Secure"))
+			assert.True(t, strings.HasSuffix(h, "; SameSite=Lax"))
+		}
+	}
+}
+
+func TestCSRFTokenHandler(t *testing.T) {
+	cookie, err := dm.CreateCookieHelper("token")
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", "/csrf", nil)
+	req.AddCookie(&cookie)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.CSRFToken).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var got csrfTokenResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, csrfTokenFor("token"), got.Token)
+
+	// Clients sending the session in a header are not exposed to CSRF
+	req, _ = http.NewRequest("GET", "/csrf", nil)
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(dm.CSRFToken).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAllowOrigin(t *testing.T) {
+	called := false
+	handler := AllowOrigin("https://app.sift.io", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/feedback", nil)
+		req.Header.Set("Origin", origin)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := request("POST", "https://evil.example.com")
+	assert.True(t, called)
+	assert.Equal(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
+
+	called = false
+	rr = request("POST", "https://app.sift.io")
+	assert.True(t, called)
+	assert.Equal(t, "https://app.sift.io", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+
+	// Preflight requests are answered without reaching the handler
+	called = false
+	rr = request("OPTIONS", "https://app.sift.io")
+	assert.False(t, called)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.True(t, strings.Contains(rr.Header().Get("Access-Control-Allow-Headers"), CSRF_HEADER))
+}
+
+func TestForgedRequestsRejected(t *testing.T) {
+	prof := Profile{UserName: "csrf_target", CompanyID: testCompany(t, "Sift Technologies, Inc.").ID}
+	if err := dm.Create(&prof).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+	defer dm.Unscoped().Delete(&prof)
+	defer dm.DeleteSessionsByUserHelper(prof.ID)
+	cookies, id := loginFrom(t, prof.ID, "Victim Browser")
+	_, otherID := loginFrom(t, prof.ID, "Victim Phone")
+
+	// A cross-site form post carries the cookies but not the CSRF header
+	forge := func(method, path string, handler http.Handler) int {
+		req, _ := http.NewRequest(method, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusForbidden, forge("DELETE", "/sessions", dm.Authenticated(http.HandlerFunc(dm.DeleteOtherSessions))))
+	assert.Equal(t, http.StatusForbidden, forge("POST", "/logout", http.HandlerFunc(dm.Logout)))
+	_, err := dm.GetSessionByIdHelper(id)
+	assert.Nil(t, err)
+	_, err = dm.GetSessionByIdHelper(otherID)
+	assert.Nil(t, err)
+
+	// The web app echoing the token is let through
+	assert.Equal(t, http.StatusNoContent, sessionRequest("DELETE", "/sessions", cookies).Code)
+	_, err = dm.GetSessionByIdHelper(otherID)
+	assert.NotNil(t, err)
+}
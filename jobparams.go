@@ -0,0 +1,260 @@
+// Typed parameters for analysis jobs and the envelope they are sent to
+// Celery workers in.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Version of the JobEnvelope schema. Bump this whenever the envelope or any
+// params struct changes in a way workers need to know about.
+const JOB_ENVELOPE_VERSION = 1
+
+// Bounds on LDA parameters accepted from clients
+const (
+	LDA_MIN_TOPICS     = 1
+	LDA_MAX_TOPICS     = 200
+	LDA_MIN_ITERATIONS = 1
+	LDA_MAX_ITERATIONS = 5000
+	LDA_MAX_STOPWORDS  = 1000
+)
+
+// Bounds on parameters of the other analyses accepted from clients
+const (
+	KEYWORDS_MAX_KEYWORDS       = 50
+	CLUSTERING_MAX_CLUSTERS     = 100
+	SUMMARIZATION_MAX_SENTENCES = 50
+)
+
+// JobParams is implemented by the typed parameter set of each analysis type
+type JobParams interface {
+	Validate() error
+}
+
+// JobEnvelope is the payload sent to a Celery task. Workers should reject
+// envelopes whose Version they do not understand.
+type JobEnvelope struct {
+	Version  int        `json:"version"`
+	Analysis string     `json:"analysis"`
+	Params   JobParams  `json:"params"`
+	Feedback []Feedback `json:"feedback"`
+	// Set when the job has been split across several tasks
+	Chunk *ChunkInfo `json:"chunk,omitempty"`
+}
+
+// ChunkInfo identifies which part of a split job an envelope carries
+type ChunkInfo struct {
+	Index int `json:"index"`
+	Count int `json:"count"`
+}
+
+// NewJobEnvelope wraps feedback and params for the given analysis type in an
+// envelope tagged with the current JOB_ENVELOPE_VERSION
+func NewJobEnvelope(analysis string, params JobParams, fb []Feedback) JobEnvelope {
+	return JobEnvelope{
+		Version:  JOB_ENVELOPE_VERSION,
+		Analysis: analysis,
+		Params:   params,
+		Feedback: fb,
+	}
+}
+
+// LDAParams tunes topic modeling runs
+type LDAParams struct {
+	NumTopics  int      `json:"num_topics"`
+	Iterations int      `json:"iterations"`
+	Stopwords  []string `json:"stopwords"`
+	MinDocFreq int      `json:"min_doc_freq"`
+	RandomSeed int64    `json:"random_seed"`
+}
+
+// DefaultLDAParams returns the parameters used for any field a client omits
+func DefaultLDAParams() LDAParams {
+	return LDAParams{
+		NumTopics:  10,
+		Iterations: 50,
+		Stopwords:  []string{},
+		MinDocFreq: 1,
+		RandomSeed: 0,
+	}
+}
+
+// Validate checks that every field is within its accepted range
+func (p LDAParams) Validate() error {
+	if p.NumTopics < LDA_MIN_TOPICS || p.NumTopics > LDA_MAX_TOPICS {
+		return errors.New(fmt.Sprintf("num_topics must be between %d and %d, was %d",
+			LDA_MIN_TOPICS, LDA_MAX_TOPICS, p.NumTopics))
+	}
+	if p.Iterations < LDA_MIN_ITERATIONS || p.Iterations > LDA_MAX_ITERATIONS {
+		return errors.New(fmt.Sprintf("iterations must be between %d and %d, was %d",
+			LDA_MIN_ITERATIONS, LDA_MAX_ITERATIONS, p.Iterations))
+	}
+	if p.MinDocFreq < 1 {
+		return errors.New(fmt.Sprintf("min_doc_freq must be at least 1, was %d", p.MinDocFreq))
+	}
+	if len(p.Stopwords) > LDA_MAX_STOPWORDS {
+		return errors.New(fmt.Sprintf("stopwords may contain at most %d words, had %d",
+			LDA_MAX_STOPWORDS, len(p.Stopwords)))
+	}
+	for _, w := range p.Stopwords {
+		if w == "" || strings.ContainsAny(w, " \t\n") {
+			return errors.New(fmt.Sprintf("stopwords must be single non-empty words, got %q", w))
+		}
+	}
+	return nil
+}
+
+// ParseLDAParams reads LDA parameters from form values, falling back to
+// DefaultLDAParams for omitted fields. Stopwords are comma-separated. The
+// returned params have already been validated.
+func ParseLDAParams(form url.Values) (JobParams, error) {
+	p := DefaultLDAParams()
+	var err error
+	if v := form.Get("num_topics"); v != "" {
+		if p.NumTopics, err = strconv.Atoi(v); err != nil {
+			return nil, errors.New(fmt.Sprintf("num_topics must be an integer, was %q", v))
+		}
+	}
+	if v := form.Get("iterations"); v != "" {
+		if p.Iterations, err = strconv.Atoi(v); err != nil {
+			return nil, errors.New(fmt.Sprintf("iterations must be an integer, was %q", v))
+		}
+	}
+	if v := form.Get("min_doc_freq"); v != "" {
+		if p.MinDocFreq, err = strconv.Atoi(v); err != nil {
+			return nil, errors.New(fmt.Sprintf("min_doc_freq must be an integer, was %q", v))
+		}
+	}
+	if v := form.Get("random_seed"); v != "" {
+		if p.RandomSeed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("random_seed must be an integer, was %q", v))
+		}
+	}
+	if v := form.Get("stopwords"); v != "" {
+		for _, w := range strings.Split(v, ",") {
+			p.Stopwords = append(p.Stopwords, strings.ToLower(strings.TrimSpace(w)))
+		}
+	}
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseIntParam reads an integer form value into dst, leaving dst unchanged
+// if the value is omitted
+func parseIntParam(form url.Values, name string, dst *int) error {
+	v := form.Get(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s must be an integer, was %q", name, v))
+	}
+	*dst = n
+	return nil
+}
+
+// checkIntRange returns an error if n is outside [min, max]
+func checkIntRange(name string, n, min, max int) error {
+	if n < min || n > max {
+		return errors.New(fmt.Sprintf("%s must be between %d and %d, was %d", name, min, max, n))
+	}
+	return nil
+}
+
+// KeywordsParams tunes keyword extraction runs
+type KeywordsParams struct {
+	MaxKeywords int `json:"max_keywords"`
+}
+
+// DefaultKeywordsParams returns the parameters used for any field a client
+// omits
+func DefaultKeywordsParams() KeywordsParams {
+	return KeywordsParams{MaxKeywords: 5}
+}
+
+// Validate checks that every field is within its accepted range
+func (p KeywordsParams) Validate() error {
+	return checkIntRange("max_keywords", p.MaxKeywords, 1, KEYWORDS_MAX_KEYWORDS)
+}
+
+// ParseKeywordsParams reads keyword extraction parameters from form values,
+// falling back to DefaultKeywordsParams for omitted fields. The returned
+// params have already been validated.
+func ParseKeywordsParams(form url.Values) (JobParams, error) {
+	p := DefaultKeywordsParams()
+	if err := parseIntParam(form, "max_keywords", &p.MaxKeywords); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ClusteringParams tunes clustering runs
+type ClusteringParams struct {
+	NumClusters int `json:"num_clusters"`
+}
+
+// DefaultClusteringParams returns the parameters used for any field a client
+// omits
+func DefaultClusteringParams() ClusteringParams {
+	return ClusteringParams{NumClusters: 8}
+}
+
+// Validate checks that every field is within its accepted range
+func (p ClusteringParams) Validate() error {
+	return checkIntRange("num_clusters", p.NumClusters, 2, CLUSTERING_MAX_CLUSTERS)
+}
+
+// ParseClusteringParams reads clustering parameters from form values, falling
+// back to DefaultClusteringParams for omitted fields. The returned params
+// have already been validated.
+func ParseClusteringParams(form url.Values) (JobParams, error) {
+	p := DefaultClusteringParams()
+	if err := parseIntParam(form, "num_clusters", &p.NumClusters); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SummarizationParams tunes summarization runs
+type SummarizationParams struct {
+	MaxSentences int `json:"max_sentences"`
+}
+
+// DefaultSummarizationParams returns the parameters used for any field a
+// client omits
+func DefaultSummarizationParams() SummarizationParams {
+	return SummarizationParams{MaxSentences: 5}
+}
+
+// Validate checks that every field is within its accepted range
+func (p SummarizationParams) Validate() error {
+	return checkIntRange("max_sentences", p.MaxSentences, 1, SUMMARIZATION_MAX_SENTENCES)
+}
+
+// ParseSummarizationParams reads summarization parameters from form values,
+// falling back to DefaultSummarizationParams for omitted fields. The
+// returned params have already been validated.
+func ParseSummarizationParams(form url.Values) (JobParams, error) {
+	p := DefaultSummarizationParams()
+	if err := parseIntParam(form, "max_sentences", &p.MaxSentences); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLDAParamsDefaults(t *testing.T) {
+	p, err := ParseLDAParams(url.Values{})
+	if err != nil {
+		t.Error("ParseLDAParams: ", err)
+	}
+	assert.Equal(t, DefaultLDAParams(), p)
+}
+
+func TestParseLDAParamsGood(t *testing.T) {
+	form := url.Values{
+		"num_topics":   {"25"},
+		"iterations":   {"100"},
+		"stopwords":    {"Kitchen, blender,toaster"},
+		"min_doc_freq": {"3"},
+		"random_seed":  {"42"},
+	}
+	p, err := ParseLDAParams(form)
+	if err != nil {
+		t.Fatal("ParseLDAParams: ", err)
+	}
+	lda := p.(LDAParams)
+	assert.Equal(t, 25, lda.NumTopics)
+	assert.Equal(t, 100, lda.Iterations)
+	assert.Equal(t, []string{"kitchen", "blender", "toaster"}, lda.Stopwords)
+	assert.Equal(t, 3, lda.MinDocFreq)
+	assert.Equal(t, int64(42), lda.RandomSeed)
+}
+
+func TestParseLDAParamsBad(t *testing.T) {
+	bad := []url.Values{
+		{"num_topics": {"ten"}},
+		{"num_topics": {"0"}},
+		{"num_topics": {"201"}},
+		{"iterations": {"-1"}},
+		{"min_doc_freq": {"0"}},
+		{"random_seed": {"1.5"}},
+		{"stopwords": {"the,,a"}},
+		{"stopwords": {"two words"}},
+	}
+	for _, form := range bad {
+		if _, err := ParseLDAParams(form); err == nil {
+			t.Errorf("Expected error for form %v", form)
+		}
+	}
+}
+
+func TestJobEnvelopeJSON(t *testing.T) {
+	fb := []Feedback{{ID: 0, FBody: "Great blender"}}
+	env := NewJobEnvelope("lda_topics", DefaultLDAParams(), fb)
+	body, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal("json.Marshal: ", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		t.Fatal("json.Unmarshal: ", err)
+	}
+	assert.Equal(t, float64(JOB_ENVELOPE_VERSION), decoded["version"])
+	assert.Equal(t, "lda_topics", decoded["analysis"])
+	assert.Equal(t, float64(10), decoded["params"].(map[string]interface{})["num_topics"])
+	assert.Equal(t, "Great blender", decoded["feedback"].([]interface{})[0].(map[string]interface{})["fb_body"])
+}
+
+func TestParseOtherAnalysisParams(t *testing.T) {
+	p, err := ParseKeywordsParams(url.Values{"max_keywords": {"12"}})
+	if err != nil {
+		t.Fatal("ParseKeywordsParams: ", err)
+	}
+	assert.Equal(t, KeywordsParams{MaxKeywords: 12}, p)
+
+	p, err = ParseClusteringParams(url.Values{})
+	if err != nil {
+		t.Fatal("ParseClusteringParams: ", err)
+	}
+	assert.Equal(t, DefaultClusteringParams(), p)
+
+	p, err = ParseSummarizationParams(url.Values{"max_sentences": {"3"}})
+	if err != nil {
+		t.Fatal("ParseSummarizationParams: ", err)
+	}
+	assert.Equal(t, SummarizationParams{MaxSentences: 3}, p)
+
+	if _, err := ParseKeywordsParams(url.Values{"max_keywords": {"many"}}); err == nil {
+		t.Error("Expected error for non-integer max_keywords")
+	}
+	if _, err := ParseClusteringParams(url.Values{"num_clusters": {"1"}}); err == nil {
+		t.Error("Expected error for a single cluster")
+	}
+	if _, err := ParseSummarizationParams(url.Values{"max_sentences": {"0"}}); err == nil {
+		t.Error("Expected error for zero sentences")
+	}
+}
+
+func TestRegisteredParamsAreParsed(t *testing.T) {
+	// Every analysis that advertises params must pass them on to workers
+	for _, at := range AnalysisTypes() {
+		if len(at.Params) > 0 && at.parseParams == nil {
+			t.Errorf("%s advertises params but does not parse them", at.Name)
+		}
+	}
+}
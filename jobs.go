@@ -0,0 +1,770 @@
+// Tracks analysis jobs dispatched to Celery and streams their progress to
+// clients as Server-Sent Events.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job event types, which double as job statuses
+const (
+	JOB_QUEUED    = "queued"
+	JOB_STARTED   = "started"
+	JOB_PROGRESS  = "progress"
+	JOB_COMPLETED = "completed"
+	JOB_FAILED    = "failed"
+)
+
+const (
+	// How long finished jobs are kept in memory for clients to fetch results
+	JOB_RETENTION = time.Hour
+	// How often a comment is written to idle event streams so that proxies
+	// do not close them
+	SSE_HEARTBEAT = 15 * time.Second
+	// Number of events buffered per event stream before it is disconnected.
+	// Disconnected clients resume using Last-Event-ID.
+	SUBSCRIBER_BUFFER = 16
+	// Default maximum number of feedback sent in each task of a chunked job
+	DEFAULT_CHUNK_SIZE = 500
+)
+
+// JobEvent is a single change in a job's state. IDs increase by one per event
+// within a job, starting at 1.
+type JobEvent struct {
+	ID        int       `json:"id"`
+	Type      string    `json:"type"`
+	JobID     string    `json:"job_id"`
+	Progress  float64   `json:"progress,omitempty"`
+	ResultURL string    `json:"result_url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// JobStatus is the JSON representation of a job returned to clients
+type JobStatus struct {
+	ID         string  `json:"job_id"`
+	Analysis   string  `json:"analysis"`
+	Status     string  `json:"status"`
+	Progress   float64 `json:"progress"`
+	Error      string  `json:"error,omitempty"`
+	Cached     bool    `json:"cached"`
+	Chunks     int     `json:"chunks,omitempty"`
+	ChunksDone int     `json:"chunks_done,omitempty"`
+	EventsURL  string  `json:"events_url"`
+	ResultURL  string  `json:"result_url,omitempty"`
+}
+
+// Job is an analysis dispatched through the JobRunner. All fields below mu
+// are guarded by it.
+type Job struct {
+	ID string
+	// ID of the Company that submitted the job, or 0 for anonymous uploads
+	CompanyID uint
+	Analysis  AnalysisType
+	Envelope  JobEnvelope
+	// ContentHash of Envelope, set when the runner has a ResultCache
+	Hash string
+
+	mu         sync.Mutex
+	status     string
+	progress   float64
+	errMsg     string
+	cached     bool
+	chunks     int
+	chunksDone int
+	result     interface{}
+	events     []JobEvent
+	subs       map[chan JobEvent]bool
+	finishedAt time.Time
+}
+
+func jobEventsURL(id string) string { return "/jobs/" + id + "/events" }
+func jobResultURL(id string) string { return "/jobs/" + id + "/result" }
+
+func terminalStatus(status string) bool {
+	return status == JOB_COMPLETED || status == JOB_FAILED
+}
+
+// publish records an event and fans it out to subscribers. Subscribers that
+// cannot keep up are disconnected rather than blocking the job. Must be
+// called with j.mu held.
+func (j *Job) publish(ev JobEvent) {
+	ev.ID = len(j.events) + 1
+	ev.JobID = j.ID
+	ev.Time = time.Now()
+	j.events = append(j.events, ev)
+	for ch := range j.subs {
+		select {
+		case ch <- ev:
+		default:
+			close(ch)
+			delete(j.subs, ch)
+		}
+	}
+	if terminalStatus(ev.Type) {
+		for ch := range j.subs {
+			close(ch)
+		}
+		j.subs = nil
+		j.finishedAt = ev.Time
+	}
+}
+
+// start marks a queued job as picked up by a worker
+func (j *Job) start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status != JOB_QUEUED {
+		return
+	}
+	j.status = JOB_STARTED
+	j.publish(JobEvent{Type: JOB_STARTED})
+}
+
+// setProgress records a progress percentage reported by the worker
+func (j *Job) setProgress(pct float64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if terminalStatus(j.status) || pct == j.progress {
+		return
+	}
+	j.status = JOB_PROGRESS
+	j.progress = pct
+	j.publish(JobEvent{Type: JOB_PROGRESS, Progress: pct})
+}
+
+// setChunks records the number of tasks the job was split into
+func (j *Job) setChunks(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.chunks = n
+}
+
+// chunkDone records the completion of one of a job's tasks. For jobs split
+// into several chunks this is reported as progress.
+func (j *Job) chunkDone() {
+	j.mu.Lock()
+	j.chunksDone++
+	chunks, done := j.chunks, j.chunksDone
+	j.mu.Unlock()
+	if chunks > 1 && done < chunks {
+		j.setProgress(100 * float64(done) / float64(chunks))
+	}
+}
+
+func (j *Job) complete(result interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if terminalStatus(j.status) {
+		return
+	}
+	j.status = JOB_COMPLETED
+	j.progress = 100
+	j.result = result
+	j.publish(JobEvent{Type: JOB_COMPLETED, Progress: 100, ResultURL: jobResultURL(j.ID)})
+}
+
+// completeFromCache completes a job with a result stored by an earlier job
+func (j *Job) completeFromCache(result interface{}) {
+	j.mu.Lock()
+	j.cached = true
+	j.mu.Unlock()
+	j.complete(result)
+}
+
+func (j *Job) fail(msg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if terminalStatus(j.status) {
+		return
+	}
+	fmt.Println("Job", j.ID, "failed:", msg)
+	j.status = JOB_FAILED
+	j.errMsg = msg
+	j.publish(JobEvent{Type: JOB_FAILED, Error: msg})
+}
+
+// Status returns a snapshot of the job for clients
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := JobStatus{
+		ID:         j.ID,
+		Analysis:   j.Analysis.Name,
+		Status:     j.status,
+		Progress:   j.progress,
+		Error:      j.errMsg,
+		Cached:     j.cached,
+		Chunks:     j.chunks,
+		ChunksDone: j.chunksDone,
+		EventsURL:  jobEventsURL(j.ID),
+	}
+	if j.status == JOB_COMPLETED {
+		s.ResultURL = jobResultURL(j.ID)
+	}
+	return s
+}
+
+// Result returns the decoded result of a completed job, and false if the job
+// has not completed successfully
+func (j *Job) Result() (interface{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.result, j.status == JOB_COMPLETED
+}
+
+// Subscribe returns all events after the event with ID `after`, and a
+// channel on which subsequent events are delivered. The channel is closed
+// once the job finishes or the subscriber falls behind. The returned func
+// must be called to unsubscribe.
+func (j *Job) Subscribe(after int) ([]JobEvent, <-chan JobEvent, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if after < 0 {
+		after = 0
+	}
+	var backlog []JobEvent
+	if after < len(j.events) {
+		backlog = append(backlog, j.events[after:]...)
+	}
+	ch := make(chan JobEvent, SUBSCRIBER_BUFFER)
+	if terminalStatus(j.status) {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	j.subs[ch] = true
+	unsubscribe := func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.subs[ch] {
+			delete(j.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, unsubscribe
+}
+
+// JobRunner dispatches jobs to a TaskQueue and tracks them until they finish
+type JobRunner struct {
+	// Maximum feedback per task for map-style analyses. Larger payloads are
+	// split across several tasks whose results are merged. 0 disables
+	// splitting.
+	ChunkSize int
+	// Maximum time each task of a job may run. Tasks waiting for a worker
+	// behind other tasks of the same job are given this long again each
+	// time one of those tasks finishes.
+	JobTimeout time.Duration
+
+	// Creates the queue a job is dispatched on. A new queue is made for each
+	// job so the API can start before Celery is reachable.
+	newQueue func() (TaskQueue, error)
+
+	// Maximum jobs running at once across all companies when scheduling
+	MaxRunning int
+	// Persistent queue used for fair scheduling across companies. nil if
+	// jobs are dispatched as soon as they are submitted (see scheduler.go).
+	store  JobQueueStore
+	wakeup chan bool
+	stop   chan bool
+	// Identifies this instance as the owner of the jobs it queues in store
+	instance string
+	// Limits anonymous uploads per client, in place of a daily quota
+	anonymous *RateLimiter
+	// Stores results so identical jobs are not re-run. nil disables caching.
+	cache ResultCache
+	// Stores feedback uploaded by companies for scheduled analyses. nil if
+	// uploads are not kept.
+	archive func(companyID uint, fb []Feedback) error
+
+	mu          sync.Mutex
+	jobs        map[string]*Job
+	onFinish    []func(*Job)
+	lastCompany uint
+}
+
+// NewJobRunner constructs a JobRunner that dispatches on queues from newQueue
+func NewJobRunner(newQueue func() (TaskQueue, error)) *JobRunner {
+	return &JobRunner{
+		ChunkSize:  DEFAULT_CHUNK_SIZE,
+		JobTimeout: DEFAULT_JOB_TIMEOUT,
+		MaxRunning: DEFAULT_MAX_RUNNING_JOBS,
+		newQueue:   newQueue,
+		anonymous:  NewRateLimiter(ANONYMOUS_JOBS_PER_CLIENT, 24*time.Hour),
+		jobs:       make(map[string]*Job),
+	}
+}
+
+// NewCeleryJobRunner constructs a JobRunner that dispatches jobs to Celery
+func NewCeleryJobRunner(amqpURL, redisURL string) *JobRunner {
+	return NewJobRunner(func() (TaskQueue, error) {
+		return NewCeleryAPI(amqpURL, redisURL)
+	})
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// OnFinish registers fn to be called once each job completes or fails
+func (jr *JobRunner) OnFinish(fn func(*Job)) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	jr.onFinish = append(jr.onFinish, fn)
+}
+
+// newJob constructs a job with a single `queued` event
+func newJob(id string, companyID uint, at AnalysisType, env JobEnvelope) *Job {
+	job := &Job{
+		ID:        id,
+		CompanyID: companyID,
+		Analysis:  at,
+		Envelope:  env,
+		status:    JOB_QUEUED,
+		subs:      make(map[chan JobEvent]bool),
+	}
+	job.mu.Lock()
+	job.publish(JobEvent{Type: JOB_QUEUED})
+	job.mu.Unlock()
+	return job
+}
+
+// UseCache makes jr store the results of completed jobs in cache, and answer
+// jobs identical to a previous one from it
+func (jr *JobRunner) UseCache(cache ResultCache) {
+	jr.cache = cache
+}
+
+// UseArchive makes jr keep feedback uploaded by companies through
+// FeedbackFormHandler using archive
+func (jr *JobRunner) UseArchive(archive func(companyID uint, fb []Feedback) error) {
+	jr.archive = archive
+}
+
+// Submit creates a job for the given analysis on behalf of a company, whose
+// ID is 0 for anonymous uploads. If the runner has a cache holding the
+// result of an identical job, and force is false, the job completes
+// immediately with that result. Otherwise, if the runner has a scheduler the
+// job waits in its queue until the company has capacity, or else it starts
+// running in the background immediately. Uncached jobs have a single
+// `queued` event when returned.
+func (jr *JobRunner) Submit(companyID uint, at AnalysisType, env JobEnvelope, force bool) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job := newJob(id, companyID, at, env)
+
+	if jr.cache != nil {
+		if job.Hash, err = ContentHash(companyID, env); err != nil {
+			return nil, err
+		}
+		if !force {
+			result, ok, err := jr.cache.Get(companyID, job.Hash)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				job.completeFromCache(result)
+				jr.mu.Lock()
+				jr.purgeExpired()
+				jr.jobs[id] = job
+				jr.mu.Unlock()
+				// The job never entered the scheduler's queue, so only the
+				// OnFinish callbacks are run
+				go jr.notifyFinished(job)
+				return job, nil
+			}
+		}
+	}
+
+	// The job is retained before it is queued, so the scheduler can find it
+	// as soon as its row is written
+	jr.mu.Lock()
+	jr.purgeExpired()
+	jr.jobs[id] = job
+	jr.mu.Unlock()
+
+	if jr.store != nil {
+		if err := jr.enqueue(job); err != nil {
+			jr.mu.Lock()
+			delete(jr.jobs, id)
+			jr.mu.Unlock()
+			return nil, err
+		}
+		jr.wake()
+	} else {
+		go jr.run(job)
+	}
+	return job, nil
+}
+
+// GetJob returns the job with the given ID, if it is still retained
+func (jr *JobRunner) GetJob(id string) (*Job, bool) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	job, ok := jr.jobs[id]
+	return job, ok
+}
+
+// purgeExpired drops jobs that finished more than JOB_RETENTION ago. Must be
+// called with jr.mu held.
+func (jr *JobRunner) purgeExpired() {
+	for id, job := range jr.jobs {
+		job.mu.Lock()
+		expired := !job.finishedAt.IsZero() && time.Since(job.finishedAt) > JOB_RETENTION
+		job.mu.Unlock()
+		if expired {
+			delete(jr.jobs, id)
+		}
+	}
+}
+
+// finished releases a finished job's scheduler slot and calls the OnFinish
+// callbacks
+func (jr *JobRunner) finished(job *Job) {
+	if jr.store != nil {
+		if err := jr.store.SetStatus(job.ID, QUEUED_JOB_FINISHED); err != nil {
+			fmt.Println("store.SetStatus: ", err)
+		}
+		jr.wake()
+	}
+	jr.notifyFinished(job)
+}
+
+// notifyFinished calls the OnFinish callbacks for a finished job
+func (jr *JobRunner) notifyFinished(job *Job) {
+	jr.mu.Lock()
+	callbacks := jr.onFinish
+	jr.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(job)
+	}
+}
+
+// split divides a job's envelope into chunks of at most jr.ChunkSize
+// feedback. Only map-style analyses are split; all others, and jobs that fit
+// in one chunk, are sent as a single envelope.
+func (jr *JobRunner) split(job *Job) []JobEnvelope {
+	env := job.Envelope
+	if !job.Analysis.Chunked || jr.ChunkSize <= 0 || len(env.Feedback) <= jr.ChunkSize {
+		return []JobEnvelope{env}
+	}
+	count := (len(env.Feedback) + jr.ChunkSize - 1) / jr.ChunkSize
+	chunks := make([]JobEnvelope, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * jr.ChunkSize
+		if end > len(env.Feedback) {
+			end = len(env.Feedback)
+		}
+		chunk := env
+		chunk.Feedback = env.Feedback[i*jr.ChunkSize : end]
+		chunk.Chunk = &ChunkInfo{Index: i, Count: count}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// run dispatches a job, as a group of tasks if it is split into chunks, and
+// follows the tasks' states until all finish or one fails, publishing an
+// event for each change
+func (jr *JobRunner) run(job *Job) {
+	defer jr.finished(job)
+	queue, err := jr.newQueue()
+	if err != nil {
+		job.fail("Could not connect to job queue: " + err.Error())
+		return
+	}
+
+	chunks := jr.split(job)
+	taskIDs := make([]string, len(chunks))
+	for i, env := range chunks {
+		if taskIDs[i], err = queue.Dispatch(job.Analysis.Task, env); err != nil {
+			job.fail("Could not dispatch job: " + err.Error())
+			return
+		}
+	}
+	job.setChunks(len(chunks))
+
+	results := make([]interface{}, len(chunks))
+	done := make([]bool, len(chunks))
+	started := make([]bool, len(chunks))
+	deadlines := make([]time.Time, len(chunks))
+	for i := range deadlines {
+		deadlines[i] = time.Now().Add(jr.JobTimeout)
+	}
+	remaining := len(chunks)
+	lastProgress := -1.0
+	period := QUERY_PERIOD
+	for {
+		// Poll quickly while the job is changing, and back off while it is not
+		changed := false
+		for i, taskID := range taskIDs {
+			if done[i] {
+				continue
+			}
+			state, err := queue.State(taskID)
+			if err != nil {
+				job.fail("Could not retrieve job state: " + err.Error())
+				return
+			}
+			switch state.Status {
+			case "RECEIVED", "STARTED", "PROGRESS":
+				if !started[i] {
+					// A task's clock restarts once a worker picks it up
+					started[i], deadlines[i], changed = true, time.Now().Add(jr.JobTimeout), true
+				}
+				job.start()
+				// Chunked jobs report progress by completed chunks instead
+				if pct, ok := parseProgress(state.Result); ok && len(chunks) == 1 && pct != lastProgress {
+					lastProgress, changed = pct, true
+					job.setProgress(pct)
+				}
+			case "SUCCESS":
+				decoded, err := job.Analysis.DecodeResult(state.Result, chunks[i].Feedback)
+				if err != nil {
+					job.fail("Analysis returned an invalid result: " + err.Error())
+					return
+				}
+				results[i], done[i], changed = decoded, true, true
+				remaining--
+				job.start()
+				job.chunkDone()
+				// Tasks queued behind this one get a full timeout once more
+				for j := range deadlines {
+					if !started[j] {
+						deadlines[j] = time.Now().Add(jr.JobTimeout)
+					}
+				}
+			case "FAILURE", "REVOKED":
+				if len(chunks) > 1 {
+					job.fail(fmt.Sprintf("Analysis failed on chunk %d of %d: %v", i+1, len(chunks), state.Result))
+				} else {
+					job.fail(fmt.Sprintf("Analysis failed: %v", state.Result))
+				}
+				return
+			}
+		}
+		if remaining == 0 {
+			merged, err := mergeResults(results)
+			if err != nil {
+				job.fail("Could not merge chunk results: " + err.Error())
+				return
+			}
+			job.complete(merged)
+			if jr.cache != nil && job.Hash != "" {
+				if err := jr.cache.Put(job.CompanyID, job.Hash, job.Analysis.Name, merged); err != nil {
+					fmt.Println("cache.Put: ", err)
+				}
+			}
+			return
+		}
+		for i, deadline := range deadlines {
+			if done[i] || time.Now().Before(deadline) {
+				continue
+			}
+			if len(chunks) > 1 {
+				job.fail(fmt.Sprintf("Timed out waiting for chunk %d of %d of job %s after %s", i+1, len(chunks), job.ID, jr.JobTimeout.String()))
+			} else {
+				job.fail(fmt.Sprintf("Timed out waiting for job %s after %s", job.ID, jr.JobTimeout.String()))
+			}
+			return
+		}
+		if changed {
+			period = QUERY_PERIOD
+		} else if period *= 2; period > MAX_QUERY_PERIOD {
+			period = MAX_QUERY_PERIOD
+		}
+		time.Sleep(period)
+	}
+}
+
+// mergeResults combines the decoded results of each chunk of a job into one.
+// Only FeedbackResults, as returned by map-style analyses, can be merged.
+func mergeResults(results []interface{}) (interface{}, error) {
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	var merged *FeedbackResults
+	for i, res := range results {
+		fr, ok := res.(*FeedbackResults)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("chunk %d result of type %T cannot be merged", i, res))
+		}
+		if merged == nil {
+			merged = &FeedbackResults{Analysis: fr.Analysis, Results: make(map[uint64]interface{})}
+		}
+		for id, r := range fr.Results {
+			merged.Results[id] = r
+		}
+	}
+	return merged, nil
+}
+
+// parseProgress reads a percentage from a task's PROGRESS metadata, which
+// workers report as either {"progress": pct} or {"current": n, "total": m}
+func parseProgress(meta interface{}) (float64, bool) {
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	if pct, ok := m["progress"].(float64); ok {
+		return clampProgress(pct), true
+	}
+	cur, okCur := m["current"].(float64)
+	total, okTotal := m["total"].(float64)
+	if okCur && okTotal && total > 0 {
+		return clampProgress(100 * cur / total), true
+	}
+	return 0, false
+}
+
+func clampProgress(pct float64) float64 {
+	if pct < 0 {
+		return 0
+	}
+	if pct > 100 {
+		return 100
+	}
+	return pct
+}
+
+/* -------------------------------------------------------------------------- */
+
+// writeEvent writes ev to w in Server-Sent Events format
+func writeEvent(w http.ResponseWriter, ev JobEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
+
+// jobForRequest returns the job in the URL if the caller may view it, and
+// writes a 404 to w otherwise. Jobs submitted by a company are only visible
+// to its users with PERM_VIEW_DATA. Anonymous jobs are visible to anyone
+// with their ID.
+func (jr *JobRunner) jobForRequest(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	job, ok := jr.GetJob(mux.Vars(r)["id"])
+	if ok && job.CompanyID != 0 {
+		caller, authed := ProfileFromContext(r)
+		// Respond as if the job did not exist so IDs cannot be probed
+		ok = authed && caller.CompanyID == job.CompanyID && HasPermission(caller, PERM_VIEW_DATA)
+	}
+	if !ok {
+		http.Error(w, "Job does not exist", http.StatusNotFound)
+	}
+	return job, ok
+}
+
+// GetJobStatus writes the current status of the job in the URL to w
+func (jr *JobRunner) GetJobStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := jr.jobForRequest(w, r)
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(job.Status())
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// GetJobResult writes the decoded result of the job in the URL to w, or a 409
+// if the job has not completed successfully
+func (jr *JobRunner) GetJobResult(w http.ResponseWriter, r *http.Request) {
+	job, ok := jr.jobForRequest(w, r)
+	if !ok {
+		return
+	}
+	result, ok := job.Result()
+	if !ok {
+		http.Error(w, "Job has not completed", http.StatusConflict)
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// JobEventsHandler streams the events of the job in the URL to w as
+// Server-Sent Events until the job finishes or the client disconnects.
+// Clients reconnecting with a Last-Event-ID header receive only the events
+// they missed.
+func (jr *JobRunner) JobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jr.jobForRequest(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	lastID := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		var err error
+		if lastID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Last-Event-ID must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	backlog, events, unsubscribe := job.Subscribe(lastID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, ev := range backlog {
+		if err := writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(SSE_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, open := <-events:
+			if !open {
+				return
+			}
+			if err := writeEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQueue reports each of states in turn for every task, then repeats the
+// last one
+type fakeQueue struct {
+	mu         sync.Mutex
+	states     []*TaskState
+	polls      int
+	dispatched []interface{}
+}
+
+func (q *fakeQueue) Dispatch(name string, payload interface{}) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dispatched = append(q.dispatched, payload)
+	return "task-1", nil
+}
+
+func (q *fakeQueue) State(taskID string) (*TaskState, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.polls
+	if i >= len(q.states) {
+		i = len(q.states) - 1
+	}
+	q.polls++
+	return q.states[i], nil
+}
+
+func newFakeRunner(q *fakeQueue) *JobRunner {
+	return NewJobRunner(func() (TaskQueue, error) { return q, nil })
+}
+
+var jobFeedback = []Feedback{{ID: 0, FBody: "Bleh"}, {ID: 1, FBody: "Blah"}}
+
+var ldaSuccess = &TaskState{Status: "SUCCESS", Result: map[string]interface{}{
+	"topics":     []interface{}{[]interface{}{[]interface{}{"bleh", 0.5}}},
+	"doc_topics": []interface{}{[]interface{}{}, []interface{}{}},
+}}
+
+// waitForJob blocks until a job finishes and returns all of its events
+func waitForJob(t *testing.T, job *Job) []JobEvent {
+	_, events, unsubscribe := job.Subscribe(0)
+	defer unsubscribe()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, open := <-events:
+			if open {
+				continue
+			}
+			// Subscribers that fall behind are also disconnected, so only
+			// return once the job has actually finished
+			if terminalStatus(job.Status().Status) {
+				all, _, _ := job.Subscribe(0)
+				return all
+			}
+			_, events, unsubscribe = job.Subscribe(0)
+			defer unsubscribe()
+		case <-timeout:
+			t.Fatal("Timed out waiting for job to finish")
+			return nil
+		}
+	}
+}
+
+func eventTypes(events []JobEvent) []string {
+	types := make([]string, len(events))
+	for i, ev := range events {
+		types[i] = ev.Type
+	}
+	return types
+}
+
+func TestJobRunnerCompletes(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{
+		{Status: "PENDING"},
+		{Status: "STARTED"},
+		{Status: "PROGRESS", Result: map[string]interface{}{"current": 1.0, "total": 4.0}},
+		ldaSuccess,
+	}}
+	jr := newFakeRunner(q)
+	at, _ := GetAnalysisType("lda_topics")
+	job, err := jr.Submit(0, at, NewJobEnvelope(at.Name, DefaultLDAParams(), jobFeedback), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+
+	events := waitForJob(t, job)
+	assert.Equal(t, []string{JOB_QUEUED, JOB_STARTED, JOB_PROGRESS, JOB_COMPLETED}, eventTypes(events))
+	assert.Equal(t, 25.0, events[2].Progress)
+	assert.Equal(t, "/jobs/"+job.ID+"/result", events[3].ResultURL)
+	for i, ev := range events {
+		assert.Equal(t, i+1, ev.ID)
+	}
+
+	result, ok := job.Result()
+	assert.True(t, ok)
+	assert.IsType(t, &TopicModelResult{}, result)
+	assert.Equal(t, 1, len(q.dispatched))
+}
+
+func TestJobRunnerFailure(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{{Status: "FAILURE", Result: "worker exploded"}}}
+	jr := newFakeRunner(q)
+	at, _ := GetAnalysisType("sentiment")
+	job, err := jr.Submit(0, at, NewJobEnvelope(at.Name, nil, jobFeedback), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+
+	events := waitForJob(t, job)
+	assert.Equal(t, []string{JOB_QUEUED, JOB_FAILED}, eventTypes(events))
+	assert.Contains(t, events[1].Error, "worker exploded")
+
+	_, ok := job.Result()
+	assert.False(t, ok)
+	assert.Equal(t, JOB_FAILED, job.Status().Status)
+}
+
+func TestJobRunnerTimeout(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{{Status: "PENDING"}}}
+	jr := newFakeRunner(q)
+	jr.JobTimeout = 200 * time.Millisecond
+	at, _ := GetAnalysisType("sentiment")
+	job, err := jr.Submit(0, at, NewJobEnvelope(at.Name, nil, jobFeedback), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+
+	events := waitForJob(t, job)
+	assert.Equal(t, []string{JOB_QUEUED, JOB_FAILED}, eventTypes(events))
+	assert.Contains(t, events[1].Error, "Timed out")
+	// Polling backs off while nothing changes
+	q.mu.Lock()
+	assert.True(t, q.polls < 8)
+	q.mu.Unlock()
+}
+
+// brokenQueue dispatches tasks but cannot report their state
+type brokenQueue struct{}
+
+func (brokenQueue) Dispatch(name string, payload interface{}) (string, error) { return "task-1", nil }
+func (brokenQueue) State(taskID string) (*TaskState, error) {
+	return nil, errors.New("result backend: connection refused")
+}
+
+func TestJobRunnerStateError(t *testing.T) {
+	jr := NewJobRunner(func() (TaskQueue, error) { return brokenQueue{}, nil })
+	at, _ := GetAnalysisType("sentiment")
+	job, err := jr.Submit(0, at, NewJobEnvelope(at.Name, nil, jobFeedback), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+
+	events := waitForJob(t, job)
+	assert.Equal(t, []string{JOB_QUEUED, JOB_FAILED}, eventTypes(events))
+	assert.Contains(t, events[1].Error, "connection refused")
+}
+
+func TestJobEventsHandlerLastEventID(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{{Status: "STARTED"}, ldaSuccess}}
+	jr := newFakeRunner(q)
+	at, _ := GetAnalysisType("lda_topics")
+	job, err := jr.Submit(0, at, NewJobEnvelope(at.Name, DefaultLDAParams(), jobFeedback), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	waitForJob(t, job)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs/{id}/events", jr.JobEventsHandler)
+
+	req, err := http.NewRequest("GET", "/jobs/"+job.ID+"/events", nil)
+	if err != nil {
+		t.Fatal("http.NewRequest", err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/event-stream", rr.Header().Get("Content-Type"))
+	body := rr.Body.String()
+	assert.False(t, strings.Contains(body, "event: queued"))
+	assert.True(t, strings.Contains(body, "id: 2\nevent: started\n"))
+	assert.True(t, strings.Contains(body, "id: 3\nevent: completed\n"))
+}
+
+func TestJobEventsHandlerNotFound(t *testing.T) {
+	jr := newFakeRunner(&fakeQueue{})
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs/{id}/events", jr.JobEventsHandler)
+
+	req, err := http.NewRequest("GET", "/jobs/nope/events", nil)
+	if err != nil {
+		t.Fatal("http.NewRequest", err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestParseProgress(t *testing.T) {
+	pct, ok := parseProgress(map[string]interface{}{"progress": 42.0})
+	assert.True(t, ok)
+	assert.Equal(t, 42.0, pct)
+
+	pct, ok = parseProgress(map[string]interface{}{"current": 3.0, "total": 2.0})
+	assert.True(t, ok)
+	assert.Equal(t, 100.0, pct)
+
+	_, ok = parseProgress("halfway")
+	assert.False(t, ok)
+}
+
+// chunkQueue succeeds each task with one positional result per feedback in
+// the task's envelope
+type chunkQueue struct {
+	mu    sync.Mutex
+	tasks []JobEnvelope
+}
+
+func (q *chunkQueue) Dispatch(name string, payload interface{}) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, payload.(JobEnvelope))
+	return strconv.Itoa(len(q.tasks) - 1), nil
+}
+
+func (q *chunkQueue) State(taskID string) (*TaskState, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, _ := strconv.Atoi(taskID)
+	results := []interface{}{}
+	for _, f := range q.tasks[i].Feedback {
+		results = append(results, map[string]interface{}{"length": float64(len(f.FBody))})
+	}
+	return &TaskState{Status: "SUCCESS", Result: results}, nil
+}
+
+func TestJobRunnerChunked(t *testing.T) {
+	q := &chunkQueue{}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	jr.ChunkSize = 2
+
+	fb := []Feedback{{0, "a"}, {1, "bb"}, {2, "ccc"}, {3, "dddd"}, {4, "eeeee"}}
+	at, _ := GetAnalysisType("sentiment")
+	job, err := jr.Submit(0, at, NewJobEnvelope(at.Name, nil, fb), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	events := waitForJob(t, job)
+	assert.Equal(t, JOB_COMPLETED, events[len(events)-1].Type)
+
+	assert.Equal(t, 3, len(q.tasks))
+	assert.Equal(t, 1, len(q.tasks[2].Feedback))
+	assert.Equal(t, ChunkInfo{Index: 1, Count: 3}, *q.tasks[1].Chunk)
+
+	status := job.Status()
+	assert.Equal(t, 3, status.Chunks)
+	assert.Equal(t, 3, status.ChunksDone)
+
+	result, ok := job.Result()
+	assert.True(t, ok)
+	merged := result.(*FeedbackResults)
+	assert.Equal(t, 5, len(merged.Results))
+	for _, f := range fb {
+		assert.Equal(t, float64(len(f.FBody)), merged.Results[f.ID].(map[string]interface{})["length"])
+	}
+}
+
+func TestJobRunnerNotChunkedForLDA(t *testing.T) {
+	jr := NewJobRunner(func() (TaskQueue, error) { return &chunkQueue{}, nil })
+	jr.ChunkSize = 1
+	at, _ := GetAnalysisType("lda_topics")
+	job := &Job{Analysis: at, Envelope: NewJobEnvelope(at.Name, DefaultLDAParams(), jobFeedback)}
+	chunks := jr.split(job)
+	assert.Equal(t, 1, len(chunks))
+	assert.Nil(t, chunks[0].Chunk)
+}
+
+func TestJobStatusCompanyAccess(t *testing.T) {
+	q := &fakeQueue{states: []*TaskState{ldaSuccess}}
+	jr := newFakeRunner(q)
+	at, _ := GetAnalysisType("lda_topics")
+	job, err := jr.Submit(1, at, NewJobEnvelope(at.Name, DefaultLDAParams(), jobFeedback), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	waitForJob(t, job)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs/{id}", jr.GetJobStatus)
+	get := func(caller *Profile) int {
+		req, _ := http.NewRequest("GET", "/jobs/"+job.ID, nil)
+		if caller != nil {
+			req = withProfile(req, caller)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, get(nil))
+	assert.Equal(t, http.StatusNotFound, get(&Profile{CompanyID: 2, Role: ROLE_OWNER}))
+	assert.Equal(t, http.StatusNotFound, get(&Profile{CompanyID: 1}))
+	assert.Equal(t, http.StatusOK, get(&Profile{CompanyID: 1, Role: ROLE_VIEWER}))
+}
@@ -0,0 +1,105 @@
+// Short-lived access tokens for clients that do not use cookies, signed as
+// JSON Web Tokens with HMAC-SHA256
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// How long an access token is accepted for after it is issued. Clients get
+// a new one with their refresh token (see IssueToken).
+const ACCESS_TOKEN_TTL = 15 * time.Minute
+
+// Keys access tokens are signed with, newest first. main loads them with
+// -tokenkeys; otherwise tokens stop working when the API restarts.
+var accessTokenKeys = [][]byte{securecookie.GenerateRandomKey(32)}
+
+// Reasons an access token is rejected
+var (
+	ErrInvalidAccessToken = errors.New("access token is invalid")
+	ErrAccessTokenExpired = errors.New("access token has expired")
+)
+
+// The only header access tokens are issued with. Tokens are checked against
+// it exactly, so clients cannot choose another algorithm.
+var accessTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims of an access token
+type accessClaims struct {
+	// ID of the user the token was issued to
+	Subject uint `json:"sub"`
+	// Company of the user, so clients need not look it up
+	Company   uint  `json:"cid"`
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// signAccessToken signs claims with key
+func signAccessToken(claims accessClaims, key []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := accessTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + accessTokenSignature(unsigned, key), nil
+}
+
+func accessTokenSignature(unsigned string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewAccessToken issues an access token for p at now, signed with the newest
+// of accessTokenKeys
+func NewAccessToken(p Profile, now time.Time) (string, error) {
+	return signAccessToken(accessClaims{
+		Subject:   p.ID,
+		Company:   p.CompanyID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ACCESS_TOKEN_TTL).Unix(),
+	}, accessTokenKeys[0])
+}
+
+// ParseAccessToken returns the claims of token if it was signed with one of
+// keys and has not expired by now
+func ParseAccessToken(token string, now time.Time, keys ...[]byte) (accessClaims, error) {
+	var claims accessClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != accessTokenHeader {
+		return claims, ErrInvalidAccessToken
+	}
+	unsigned := parts[0] + "." + parts[1]
+	signed := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(parts[2]), []byte(accessTokenSignature(unsigned, key))) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return claims, ErrInvalidAccessToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil || claims.Subject == 0 {
+		return claims, ErrInvalidAccessToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrAccessTokenExpired
+	}
+	return claims, nil
+}
+
+// looksLikeAccessToken reports whether a bearer credential is an access
+// token rather than a session cookie value, which contains no dots
+func looksLikeAccessToken(credential string) bool {
+	return strings.Count(credential, ".") == 2
+}
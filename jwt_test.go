@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessToken(t *testing.T) {
+	now := time.Now()
+	p := Profile{CompanyID: 3}
+	p.ID = 7
+	token, err := NewAccessToken(p, now)
+	assert.Nil(t, err)
+	assert.True(t, looksLikeAccessToken(token))
+
+	claims, err := ParseAccessToken(token, now, accessTokenKeys...)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(7), claims.Subject)
+	assert.Equal(t, uint(3), claims.Company)
+
+	_, err = ParseAccessToken(token, now.Add(ACCESS_TOKEN_TTL), accessTokenKeys...)
+	assert.Equal(t, ErrAccessTokenExpired, err)
+	_, err = ParseAccessToken(token, now, []byte(strings.Repeat("k", 32)))
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	// Changing the claims or the algorithm breaks the signature
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":1,"cid":3,"exp":99999999999}`))
+	_, err = ParseAccessToken(parts[0]+"."+forged+"."+parts[2], now, accessTokenKeys...)
+	assert.Equal(t, ErrInvalidAccessToken, err)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	_, err = ParseAccessToken(none+"."+parts[1]+".", now, accessTokenKeys...)
+	assert.Equal(t, ErrInvalidAccessToken, err)
+	_, err = ParseAccessToken("not a token", now, accessTokenKeys...)
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	// Session cookie values are never mistaken for access tokens
+	cookie, _ := dm.CreateCookieHelper("token")
+	assert.False(t, looksLikeAccessToken(cookie.Value))
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	oldKey, newKey := strings.Repeat("ab", 32), strings.Repeat("cd", 32)
+	old, err := LoadTokenKeys(strings.NewReader(oldKey + "\n"))
+	if err != nil {
+		t.Fatal("LoadTokenKeys: ", err)
+	}
+	rotated, err := LoadTokenKeys(strings.NewReader("# newest first\n" + newKey + "\n\n" + oldKey + "\n"))
+	if err != nil {
+		t.Fatal("LoadTokenKeys: ", err)
+	}
+	now := time.Now()
+	claims := accessClaims{Subject: 1, ExpiresAt: now.Add(time.Minute).Unix()}
+	token, _ := signAccessToken(claims, old[0])
+	_, err = ParseAccessToken(token, now, rotated...)
+	assert.Nil(t, err)
+	token, _ = signAccessToken(claims, rotated[0])
+	_, err = ParseAccessToken(token, now, old...)
+	assert.Equal(t, ErrInvalidAccessToken, err)
+
+	for _, keys := range []string{
+		"",
+		"# only comments\n",
+		"not-hex",
+		strings.Repeat("ab", 16),
+		oldKey + " " + newKey,
+	} {
+		_, err := LoadTokenKeys(strings.NewReader(keys))
+		assert.NotNil(t, err, keys)
+	}
+}
@@ -0,0 +1,85 @@
+// Outgoing email, used to deliver password reset links
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// Mailer sends plain-text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends email through an SMTP relay at Addr ("host:port")
+type SMTPMailer struct {
+	Addr string
+	// Sender address, optionally with a display name: "Sift <sift@example.com>"
+	From string
+	// May be nil if the relay does not require authentication
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer constructs an SMTPMailer that authenticates with PLAIN auth
+// if username is not empty
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	// Refuse header injection through the recipient or subject
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("email recipient and subject must be a single line")
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.From, to, subject, body)
+	return smtp.SendMail(m.Addr, m.Auth, from.Address, []string{to}, []byte(msg))
+}
+
+// Mail is an email recorded by MemoryMailer
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer keeps sent emails in memory instead of delivering them. Used
+// in tests and when no SMTP relay is configured.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, Mail{to, subject, body})
+	return nil
+}
+
+// Sent returns a copy of every email sent so far, oldest first
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	m := NewMemoryMailer()
+	assert.Nil(t, m.Send("sifter@sift.com", "Hello", "Body"))
+	assert.Nil(t, m.Send("other@sift.com", "Again", "Body 2"))
+	sent := m.Sent()
+	assert.Equal(t, 2, len(sent))
+	assert.Equal(t, Mail{"sifter@sift.com", "Hello", "Body"}, sent[0])
+	assert.Equal(t, "other@sift.com", sent[1].To)
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	// Nothing listens on this address, so a message that passed validation
+	// would fail with a different error
+	m := NewSMTPMailer("127.0.0.1:1", "Sift <sift@sift.com>", "", "")
+	err := m.Send("sifter@sift.com\r\nBcc: victim@sift.com", "Hello", "Body")
+	assert.EqualError(t, err, "email recipient and subject must be a single line")
+	err = m.Send("sifter@sift.com", "Hello\r\nBcc: victim@sift.com", "Body")
+	assert.EqualError(t, err, "email recipient and subject must be a single line")
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
@@ -21,6 +23,19 @@ const (
 )
 
 var db_host = flag.String("dbhost", "127.0.0.1", "The address at which the db listens")
+var breached_passwords = flag.String("breachedpasswords", "data/breached_passwords.txt", "File of common passwords users may not choose")
+var smtp_addr = flag.String("smtpaddr", "", "host:port of the SMTP relay for outgoing email, empty to disable email")
+var smtp_from = flag.String("smtpfrom", "Sift <no-reply@sift.ubclaunchpad.com>", "Sender of outgoing email")
+var smtp_user = flag.String("smtpuser", "", "SMTP username, empty if the relay does not require authentication")
+var smtp_password = flag.String("smtppassword", "", "SMTP password")
+var reset_url = flag.String("reseturl", "http://localhost:3000/password/reset", "Web app page that password reset links point to")
+var cookie_keys = flag.String("cookiekeys", "", "File of session cookie keys, newest first (see LoadCookieKeys), empty to generate keys that last until restart")
+var token_keys = flag.String("tokenkeys", "", "File of access token signing keys, newest first (see LoadTokenKeys), empty to generate a key that lasts until restart")
+var allow_origin = flag.String("alloworigin", "http://localhost:3000", "Origin of the web app, which may call the API from the browser")
+var trusted_proxies = flag.String("trustedproxies", "", "Comma-separated addresses or CIDR ranges of load balancers whose X-Forwarded-For headers identify clients")
+var insecure_cookies = flag.Bool("insecurecookies", false, "Send cookies over plain HTTP, for local development only")
+var chunk_size = flag.Int("chunksize", DEFAULT_CHUNK_SIZE, "Max feedback per task for map-style analyses, 0 to disable splitting")
+var job_timeout = flag.Int("jobtimeout", int(DEFAULT_JOB_TIMEOUT/time.Minute), "Minutes each task of an analysis job may run before the job fails")
 
 // Configures the databse with user, password, host, name, and SSL encryption
 // type
@@ -40,6 +55,14 @@ func (cfg DBConfig) createDBQueryString() string {
 // `main` function is the entry point, just like in C
 func main() {
 	flag.Parse()
+	secureCookies = !*insecure_cookies
+	// Load balancers whose forwarding headers identify clients for rate
+	// limits and session records
+	proxies, err := ParseTrustedProxies(*trusted_proxies)
+	if err != nil {
+		log.Fatal("ParseTrustedProxies: ", err)
+	}
+	trustedProxies = proxies
 	// Database configuration
 	cfg := DBConfig{
 		DBUser:     "test",
@@ -58,22 +81,154 @@ func main() {
 	}
 	// Close the connection on main() exit
 	defer db.Close()
-	dm := NewDataManager(db)
+	// Keys session cookies are signed with, which must outlive restarts for
+	// users to stay signed in across deploys
+	var cookies []securecookie.Codec
+	if *cookie_keys != "" {
+		if cookies, err = LoadCookieKeysFile(*cookie_keys); err != nil {
+			log.Fatal("LoadCookieKeysFile: ", err)
+		}
+	} else {
+		fmt.Println("No cookie keys configured, sessions will not survive a restart")
+	}
+	dm := NewDataManager(db, cookies...)
+	// Keys access tokens are signed with, likewise
+	if *token_keys != "" {
+		if accessTokenKeys, err = LoadTokenKeysFile(*token_keys); err != nil {
+			log.Fatal("LoadTokenKeysFile: ", err)
+		}
+	} else {
+		fmt.Println("No token keys configured, access tokens will not survive a restart")
+	}
+	if err := passwordPolicy.LoadBreachedFile(*breached_passwords); err != nil {
+		log.Fatal("passwordPolicy.LoadBreachedFile: ", err)
+	}
 	// Migration of native types, which can be added as arguments as needed
+	dm.AutoMigrate(&Company{})
 	dm.AutoMigrate(&Profile{})
 	dm.AutoMigrate(&Session{})
+	dm.AutoMigrate(&Webhook{})
+	dm.AutoMigrate(&WebhookDelivery{})
+	dm.AutoMigrate(&QueuedJob{})
+	dm.AutoMigrate(&CompanyQuota{})
+	dm.AutoMigrate(&CachedResult{})
+	dm.AutoMigrate(&FeedbackRecord{})
+	dm.AutoMigrate(&Schedule{})
+	dm.AutoMigrate(&ScheduleRun{})
+	dm.AutoMigrate(&PasswordHistory{})
+	dm.AutoMigrate(&PasswordResetToken{})
+	dm.AutoMigrate(&Invite{})
+	dm.AutoMigrate(&APIKey{})
+	dm.AutoMigrate(&RefreshToken{})
+	dm.AutoMigrate(&RecoveryCode{})
+	if err := dm.MigrateCompaniesHelper(); err != nil {
+		log.Fatal("dm.MigrateCompaniesHelper: ", err)
+	}
+	if err := dm.MigrateRolesHelper(); err != nil {
+		log.Fatal("dm.MigrateRolesHelper: ", err)
+	}
+	// Profiles must belong to a company that exists. Added after the
+	// migrations above have pointed every profile at its company.
+	if err := dm.Model(&Profile{}).AddForeignKey("company_id", "companies(id)", "RESTRICT", "RESTRICT").Error; err != nil {
+		log.Fatal("dm.AddForeignKey: ", err)
+	}
+	// Job runner that dispatches analyses to Celery and tracks their progress
+	jr := NewCeleryJobRunner(AMQP_URL, REDIS_URL)
+	jr.ChunkSize = *chunk_size
+	jr.JobTimeout = time.Duration(*job_timeout) * time.Minute
+	// Answer repeated analyses of the same feedback from stored results
+	jr.UseCache(NewPGResultCache(&dm))
+	// Keep uploaded feedback for scheduled analyses
+	jr.UseArchive(func(companyID uint, fb []Feedback) error {
+		return dm.ForCompany(companyID).StoreFeedbackHelper(fb)
+	})
+	// Queue jobs in the db and dispatch them fairly across companies
+	if err := jr.StartScheduler(NewPGJobQueue(&dm)); err != nil {
+		log.Fatal("jr.StartScheduler: ", err)
+	}
+	// Run scheduled recurring analyses in the background
+	recurring := NewRecurringRunner(&dm, jr)
+	recurring.Start()
+	defer recurring.Stop()
+	// Purge expired sessions in the background
+	sweeper := NewSessionSweeper(&dm)
+	sweeper.Start()
+	defer sweeper.Stop()
+	// Notify company webhooks when their jobs finish
+	jr.OnFinish(NewWebhookNotifier(&dm).JobFinished)
+	// Email password reset links through SMTP, or keep them in memory when
+	// no relay is configured
+	var mailer Mailer = NewMemoryMailer()
+	if *smtp_addr != "" {
+		mailer = NewSMTPMailer(*smtp_addr, *smtp_from, *smtp_user, *smtp_password)
+	} else {
+		fmt.Println("No SMTP relay configured, password reset emails will not be delivered")
+	}
+	resetter := NewPasswordResetter(&dm, mailer, *reset_url)
 	// Create a new router, routers handle sets of logically related routes
 	router := mux.NewRouter()
 	// Handler for the feedback upload route
-	router.HandleFunc("/feedback", FeedbackFormHandler).Methods("POST")
-	// Handlers for profile CRUD operations
+	// Sessions are optional here, and only used to attribute jobs to a company
+	router.Handle("/feedback", AllowOrigin(*allow_origin, dm.SessionMiddleware(http.HandlerFunc(jr.FeedbackFormHandler)))).Methods("POST", "OPTIONS")
+	// Handlers for following analysis jobs
+	// Sessions are needed to follow jobs attributed to a company. These are
+	// read from the same origins that may upload feedback.
+	router.Handle("/jobs/{id}", AllowOrigin(*allow_origin, dm.SessionMiddleware(http.HandlerFunc(jr.GetJobStatus)))).Methods("GET", "OPTIONS")
+	router.Handle("/jobs/{id}/result", AllowOrigin(*allow_origin, dm.SessionMiddleware(http.HandlerFunc(jr.GetJobResult)))).Methods("GET", "OPTIONS")
+	router.Handle("/jobs/{id}/events", AllowOrigin(*allow_origin, dm.SessionMiddleware(http.HandlerFunc(jr.JobEventsHandler)))).Methods("GET", "OPTIONS")
+	// Handler for listing the analyses that can be run on feedback
+	router.HandleFunc("/analyses/types", AnalysisTypesHandler).Methods("GET")
+	// Handlers for registration, logins and recovering forgotten passwords
 	router.HandleFunc("/profile", dm.IndexNewProfile).Methods("POST")
-	router.HandleFunc("/profile/{company_name}/{user_name}", dm.GetExistingProfile).Methods("GET")
-	router.HandleFunc("/profile/{company_name}/{user_name}", dm.UpdateExistingProfile).Methods("PUT")
-	router.HandleFunc("/profile/{company_name}/{user_name}", dm.DeleteExistingProfile).Methods("DELETE")
-	// Handlers for logins
-	router.HandleFunc("/login", dm.Login).Methods("POST")
-	router.HandleFunc("/logout", dm.Logout).Methods("POST")
+	// Session cookies are set and cleared for the web app at the allowed origin
+	router.Handle("/login", AllowOrigin(*allow_origin, http.HandlerFunc(dm.Login))).Methods("POST", "OPTIONS")
+	router.Handle("/login/2fa", AllowOrigin(*allow_origin, http.HandlerFunc(dm.LoginTwoFactor))).Methods("POST", "OPTIONS")
+	router.Handle("/logout", AllowOrigin(*allow_origin, http.HandlerFunc(dm.Logout))).Methods("POST", "OPTIONS")
+	// Handlers for clients that authenticate with access tokens instead of
+	// cookies, which may be web apps at the allowed origin
+	router.Handle("/auth/token", AllowOrigin(*allow_origin, http.HandlerFunc(dm.IssueToken))).Methods("POST", "OPTIONS")
+	router.Handle("/auth/revoke", AllowOrigin(*allow_origin, http.HandlerFunc(dm.RevokeToken))).Methods("POST", "OPTIONS")
+	router.HandleFunc("/password/forgot", resetter.ForgotPassword).Methods("POST")
+	router.HandleFunc("/password/reset", resetter.ResetPassword).Methods("POST")
+	// Every route below requires a logged in user, whose profile handlers
+	// read from the request context. The web app at the allowed origin may
+	// call them with its cookies, fetching the CSRF token from /csrf first.
+	auth := func(h http.HandlerFunc) http.Handler { return AllowOrigin(*allow_origin, dm.Authenticated(h)) }
+	// Handler for web apps that cannot read the CSRF cookie
+	router.Handle("/csrf", auth(dm.CSRFToken)).Methods("GET", "OPTIONS")
+	// Handlers for profile operations
+	router.Handle("/profile/password", auth(dm.ChangePassword)).Methods("POST", "OPTIONS")
+	router.Handle("/profile/2fa", auth(dm.EnrollTwoFactor)).Methods("POST", "OPTIONS")
+	router.Handle("/profile/2fa", auth(dm.DisableTwoFactor)).Methods("DELETE", "OPTIONS")
+	router.Handle("/profile/2fa/confirm", auth(dm.ConfirmTwoFactor)).Methods("POST", "OPTIONS")
+	router.Handle("/profile/2fa/recovery", auth(dm.RegenerateRecoveryCodes)).Methods("POST", "OPTIONS")
+	router.Handle("/profile/{company_name}/{user_name}", auth(dm.GetExistingProfile)).Methods("GET", "OPTIONS")
+	router.Handle("/profile/{company_name}/{user_name}", auth(dm.UpdateExistingProfile)).Methods("PUT", "OPTIONS")
+	router.Handle("/profile/{company_name}/{user_name}", auth(dm.DeleteExistingProfile)).Methods("DELETE", "OPTIONS")
+	router.Handle("/profile/{company_name}/{user_name}/role", auth(dm.SetProfileRole)).Methods("POST", "OPTIONS")
+	// Handlers for reviewing and signing out the caller's sessions
+	router.Handle("/sessions", auth(dm.ListSessions)).Methods("GET", "OPTIONS")
+	router.Handle("/sessions", auth(dm.DeleteOtherSessions)).Methods("DELETE", "OPTIONS")
+	router.Handle("/sessions/{id}", auth(dm.DeleteSession)).Methods("DELETE", "OPTIONS")
+	// Handlers for company management, invites and API keys
+	router.Handle("/companies/{id}", auth(dm.GetCompany)).Methods("GET", "OPTIONS")
+	router.Handle("/companies/{id}", auth(dm.UpdateCompany)).Methods("PUT", "OPTIONS")
+	router.Handle("/companies/{id}", auth(dm.DeleteCompany)).Methods("DELETE", "OPTIONS")
+	router.Handle("/companies/{id}/invites", auth(dm.CreateInvite)).Methods("POST", "OPTIONS")
+	router.Handle("/companies/{id}/apikeys", auth(dm.CreateAPIKey)).Methods("POST", "OPTIONS")
+	router.Handle("/companies/{id}/apikeys", auth(dm.ListAPIKeys)).Methods("GET", "OPTIONS")
+	router.Handle("/companies/{id}/apikeys/{key_id}", auth(dm.RevokeAPIKey)).Methods("DELETE", "OPTIONS")
+	// Handlers for company webhook management
+	router.Handle("/webhooks", auth(dm.RegisterWebhook)).Methods("POST", "OPTIONS")
+	router.Handle("/webhooks", auth(dm.ListWebhooks)).Methods("GET", "OPTIONS")
+	router.Handle("/webhooks/{id}", auth(dm.DeleteWebhook)).Methods("DELETE", "OPTIONS")
+	router.Handle("/webhooks/{id}/deliveries", auth(dm.ListWebhookDeliveries)).Methods("GET", "OPTIONS")
+	// Handlers for scheduled analyses
+	router.Handle("/schedules", auth(dm.CreateSchedule)).Methods("POST", "OPTIONS")
+	router.Handle("/schedules", auth(dm.ListSchedules)).Methods("GET", "OPTIONS")
+	router.Handle("/schedules/{id}/pause", auth(dm.PauseSchedule)).Methods("POST", "OPTIONS")
+	router.Handle("/schedules/{id}/resume", auth(dm.ResumeSchedule)).Methods("POST", "OPTIONS")
+	router.Handle("/schedules/{id}/runs", auth(dm.ListScheduleRuns)).Methods("GET", "OPTIONS")
 	http.Handle("/", router)
 	// Create an http server on port 9090 and start serving using our router.
 	fmt.Println("Sift API running on port 9090...")
@@ -0,0 +1,240 @@
+// API keys that let scripts call the API for a company without logging in
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Start of every API key, which tells keys apart from session tokens in
+	// Authorization headers
+	API_KEY_PREFIX = "sift_"
+	// Characters of a key, including API_KEY_PREFIX, kept to identify it
+	API_KEY_SHOWN_LENGTH = 12
+	// Use of a key is recorded at most this often, so that not every request
+	// writes to the db
+	API_KEY_TOUCH_INTERVAL = time.Minute
+)
+
+// Permissions API keys may be given: enough to upload feedback, follow jobs
+// and manage integrations, but never users, roles or the company itself
+var apiKeyScopes = PermissionList{PERM_VIEW_DATA, PERM_SUBMIT_JOBS, PERM_MANAGE_INTEGRATIONS}
+
+// PermissionList is a set of permissions stored as a JSON array
+type PermissionList []Permission
+
+// Has reports whether perm is in the list
+func (pl PermissionList) Has(perm Permission) bool {
+	for _, p := range pl {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Value stores the list as JSON text
+func (pl PermissionList) Value() (driver.Value, error) {
+	if pl == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(pl)
+	return string(b), err
+}
+
+// Scan loads a list stored by Value
+func (pl *PermissionList) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*pl = PermissionList{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, pl)
+	case string:
+		return json.Unmarshal([]byte(v), pl)
+	default:
+		return errors.New(fmt.Sprintf("cannot scan %T into PermissionList", src))
+	}
+}
+
+// Response to a new API key. The key is only ever shown here.
+type newAPIKey struct {
+	APIKey
+	Key string
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// CreateAPIKeyHelper creates an API key for the company and returns it along
+// with the key itself. Only its hash is stored.
+func (t *TenantDB) CreateAPIKeyHelper(name string, scopes PermissionList, createdBy uint) (APIKey, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := API_KEY_PREFIX + token
+	k := APIKey{
+		Name:      name,
+		Prefix:    key[:API_KEY_SHOWN_LENGTH],
+		KeyHash:   hashToken(key),
+		Scopes:    scopes,
+		CreatedBy: createdBy,
+	}
+	return k, key, t.Create(&k)
+}
+
+// GetAPIKeysHelper retrieves the company's API keys, including revoked ones
+func (t *TenantDB) GetAPIKeysHelper() (keys []APIKey, err error) {
+	err = t.Query(&APIKey{}).Order("id").Find(&keys).Error
+	return
+}
+
+// RevokeAPIKeyHelper revokes one of the company's API keys. Returns false if
+// the company has no unrevoked key with that id.
+func (t *TenantDB) RevokeAPIKeyHelper(id uint) (bool, error) {
+	res := t.Query(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now())
+	return res.RowsAffected == 1, res.Error
+}
+
+// GetAPIKeyHelper retrieves an API key by the key itself
+func (dm *DataManager) GetAPIKeyHelper(key string) (k APIKey, err error) {
+	err = dm.Where("key_hash = ?", hashToken(key)).First(&k).Error
+	return
+}
+
+// TouchAPIKeyHelper records that k was used at now, unless that was already
+// recorded within API_KEY_TOUCH_INTERVAL
+func (dm *DataManager) TouchAPIKeyHelper(k APIKey, now time.Time) error {
+	if k.LastUsedAt != nil && now.Sub(*k.LastUsedAt) < API_KEY_TOUCH_INTERVAL {
+		return nil
+	}
+	return dm.Model(&APIKey{}).Where("id = ?", k.ID).UpdateColumn("last_used_at", now).Error
+}
+
+// Parses the {key_id} path variable of API key routes
+func apiKeyIDFromRequest(r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["key_id"], 10, 32)
+	return uint(id), err == nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// CreateAPIKey creates an API key for the company in the URL, named by the
+// `name` form value and granting the permissions in the repeated `scope`
+// form value, and writes it, with the key itself, to w. Scopes must be among
+// apiKeyScopes and held by the caller. API keys cannot create other keys.
+func (dm *DataManager) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	caller, _ := ProfileFromContext(r)
+	if caller.ViaAPIKey() {
+		http.Error(w, "API keys cannot manage API keys", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Form could not be parsed correctly", http.StatusBadRequest)
+		return
+	}
+	name := r.PostFormValue("name")
+	if name == "" {
+		http.Error(w, "name must not be blank", http.StatusBadRequest)
+		return
+	}
+	scopes := PermissionList{}
+	for _, s := range r.PostForm["scope"] {
+		perm := Permission(s)
+		if !apiKeyScopes.Has(perm) {
+			http.Error(w, fmt.Sprintf("scope must be one of %s, %s or %s",
+				PERM_VIEW_DATA, PERM_SUBMIT_JOBS, PERM_MANAGE_INTEGRATIONS), http.StatusBadRequest)
+			return
+		}
+		if !HasPermission(caller, perm) {
+			http.Error(w, fmt.Sprintf("Your role does not allow %s", perm), http.StatusForbidden)
+			return
+		}
+		if !scopes.Has(perm) {
+			scopes = append(scopes, perm)
+		}
+	}
+	if len(scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	k, key, err := tenant.CreateAPIKeyHelper(name, scopes, caller.ID)
+	if err != nil {
+		fmt.Println("tenant.CreateAPIKeyHelper: ", err)
+		http.Error(w, "Database error on API key creation", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(newAPIKey{k, key})
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// ListAPIKeys writes the API keys of the company in the URL to w. The keys
+// themselves are never shown again.
+func (dm *DataManager) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	keys, err := tenant.GetAPIKeysHelper()
+	if err != nil {
+		fmt.Println("tenant.GetAPIKeysHelper: ", err)
+		http.Error(w, "Database error on API key retrieval", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(keys)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// RevokeAPIKey revokes the API key in the URL, which stops working
+// immediately
+func (dm *DataManager) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	if caller, _ := ProfileFromContext(r); caller.ViaAPIKey() {
+		http.Error(w, "API keys cannot manage API keys", http.StatusForbidden)
+		return
+	}
+	id, ok := apiKeyIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+	revoked, err := tenant.RevokeAPIKeyHelper(id)
+	if err != nil {
+		fmt.Println("tenant.RevokeAPIKeyHelper: ", err)
+		http.Error(w, "Database error on API key revocation", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key does not exist", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// apiKeyRequest serves a request to create an API key for company id as caller
+func apiKeyRequest(caller *Profile, id uint, form url.Values) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/companies/{id}/apikeys", dm.CreateAPIKey).Methods("POST")
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/companies/%d/apikeys", id), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if caller != nil {
+		req = withProfile(req, caller)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestPermissionListValueScan(t *testing.T) {
+	v, err := PermissionList(nil).Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", v)
+
+	v, err = PermissionList{PERM_VIEW_DATA, PERM_SUBMIT_JOBS}.Value()
+	assert.Nil(t, err)
+	var pl PermissionList
+	assert.Nil(t, pl.Scan([]byte(v.(string))))
+	assert.True(t, pl.Has(PERM_SUBMIT_JOBS))
+	assert.False(t, pl.Has(PERM_MANAGE_INTEGRATIONS))
+
+	assert.Nil(t, pl.Scan(nil))
+	assert.Equal(t, PermissionList{}, pl)
+	assert.NotNil(t, pl.Scan(42))
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	// Keys only hold their scopes, whatever the role field says
+	key := &Profile{CompanyID: 1, Role: ROLE_OWNER, Scopes: []Permission{PERM_SUBMIT_JOBS}}
+	assert.True(t, key.ViaAPIKey())
+	assert.True(t, HasPermission(key, PERM_SUBMIT_JOBS))
+	assert.False(t, HasPermission(key, PERM_VIEW_DATA))
+	assert.False(t, HasPermission(key, PERM_MANAGE_COMPANY))
+
+	// Keys with no scopes can do nothing, unlike users
+	none := &Profile{CompanyID: 1, Scopes: []Permission{}}
+	assert.True(t, none.ViaAPIKey())
+	assert.False(t, HasPermission(none, PERM_VIEW_DATA))
+	assert.False(t, (&Profile{Role: ROLE_VIEWER}).ViaAPIKey())
+}
+
+func TestCreateAPIKeyRejected(t *testing.T) {
+	admin := &Profile{UserName: "admin", CompanyID: 1, Role: ROLE_ADMIN}
+	viewer := &Profile{UserName: "viewer", CompanyID: 1, Role: ROLE_VIEWER}
+	key := &Profile{CompanyID: 1, Scopes: []Permission{PERM_MANAGE_INTEGRATIONS}}
+	valid := url.Values{"name": {"uploader"}, "scope": {string(PERM_SUBMIT_JOBS)}}
+	assert.Equal(t, http.StatusUnauthorized, apiKeyRequest(nil, 1, valid).Code)
+	assert.Equal(t, http.StatusForbidden, apiKeyRequest(viewer, 1, valid).Code)
+	assert.Equal(t, http.StatusNotFound, apiKeyRequest(admin, 2, valid).Code)
+	// API keys cannot mint further keys
+	assert.Equal(t, http.StatusForbidden, apiKeyRequest(key, 1, valid).Code)
+	assert.Equal(t, http.StatusBadRequest, apiKeyRequest(admin, 1, url.Values{"scope": {string(PERM_SUBMIT_JOBS)}}).Code)
+	assert.Equal(t, http.StatusBadRequest, apiKeyRequest(admin, 1, url.Values{"name": {"uploader"}}).Code)
+	// Keys can never manage users, roles or the company
+	assert.Equal(t, http.StatusBadRequest, apiKeyRequest(admin, 1, url.Values{
+		"name": {"uploader"}, "scope": {string(PERM_MANAGE_PROFILES)}}).Code)
+}
+
+func TestAPIKey(t *testing.T) {
+	company := testCompany(t, "API Key Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	admin := &Profile{UserName: "admin", CompanyID: company.ID, Role: ROLE_ADMIN}
+	admin.ID = 42
+
+	rr := apiKeyRequest(admin, company.ID, url.Values{
+		"name": {"uploader"}, "scope": {string(PERM_SUBMIT_JOBS), string(PERM_VIEW_DATA), string(PERM_SUBMIT_JOBS)}})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created newAPIKey
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.Key, API_KEY_PREFIX))
+	assert.True(t, strings.HasPrefix(created.Key, created.Prefix))
+	assert.False(t, strings.Contains(rr.Body.String(), "KeyHash"))
+	assert.Equal(t, PermissionList{PERM_SUBMIT_JOBS, PERM_VIEW_DATA}, created.Scopes)
+	assert.Equal(t, uint(42), created.CreatedBy)
+	assert.Nil(t, created.LastUsedAt)
+
+	// The key authenticates as its company with only its scopes
+	req, _ := http.NewRequest("POST", "/feedback", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	sesh, profile, err := dm.AuthenticateRequest(req, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), sesh.ID)
+	assert.Equal(t, company.ID, profile.CompanyID)
+	assert.True(t, HasPermission(&profile, PERM_SUBMIT_JOBS))
+	assert.False(t, HasPermission(&profile, PERM_MANAGE_INTEGRATIONS))
+
+	keys, err := dm.ForCompany(company.ID).GetAPIKeysHelper()
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(keys)) {
+		assert.NotNil(t, keys[0].LastUsedAt)
+	}
+
+	// Revoked keys stop working at once, and cannot be revoked twice
+	revoked, err := dm.ForCompany(company.ID).RevokeAPIKeyHelper(created.ID)
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+	revoked, _ = dm.ForCompany(company.ID).RevokeAPIKeyHelper(created.ID)
+	assert.False(t, revoked)
+	_, _, err = dm.AuthenticateRequest(req, time.Now())
+	assert.Equal(t, ErrInvalidAPIKey, err)
+
+	rr = httptest.NewRecorder()
+	dm.Authenticated(http.HandlerFunc(dm.ListSessions)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
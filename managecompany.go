@@ -0,0 +1,288 @@
+// Companies, the tenants of the API, and migration of data that identified
+// companies by name
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// CompanySettings holds arbitrary per-company configuration as a JSON object
+type CompanySettings map[string]interface{}
+
+// Value stores settings as JSON text
+func (cs CompanySettings) Value() (driver.Value, error) {
+	if cs == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(cs)
+	return string(b), err
+}
+
+// Scan loads settings stored by Value
+func (cs *CompanySettings) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*cs = CompanySettings{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, cs)
+	case string:
+		return json.Unmarshal([]byte(v), cs)
+	default:
+		return errors.New(fmt.Sprintf("cannot scan %T into CompanySettings", src))
+	}
+}
+
+// Tables that identified companies by a company_name column before Company
+// existed, and are migrated to company_id by MigrateCompaniesHelper
+var legacyCompanyTables = []interface{}{
+	&Profile{}, &Webhook{}, &QueuedJob{}, &CompanyQuota{}, &FeedbackRecord{}, &Schedule{},
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// GetCompanyHelper retrieves a company by id
+func (dm *DataManager) GetCompanyHelper(id uint) (c Company, err error) {
+	err = dm.First(&c, id).Error
+	return
+}
+
+// GetCompanyHelper retrieves the company a TenantDB is restricted to
+func (t *TenantDB) GetCompanyHelper() (Company, error) {
+	return t.dm.GetCompanyHelper(t.CompanyID)
+}
+
+// GetCompanyByNameHelper retrieves a company by its unique name
+func (dm *DataManager) GetCompanyByNameHelper(name string) (c Company, err error) {
+	err = dm.Where("name = ?", name).First(&c).Error
+	return
+}
+
+// companyNameTaken reports whether a company other than id is named name
+func (dm *DataManager) companyNameTaken(name string, id uint) bool {
+	return !dm.Where("name = ? AND id <> ?", name, id).First(&Company{}).RecordNotFound()
+}
+
+// DeleteCompanyHelper deletes a company along with its users, their
+// sessions, and all of its data
+func (dm *DataManager) DeleteCompanyHelper(id uint) error {
+	tx := dm.Begin()
+	users := tx.Model(&Profile{}).Where("company_id = ?", id).Select("id").QueryExpr()
+	hooks := tx.Model(&Webhook{}).Where("company_id = ?", id).Select("id").QueryExpr()
+	schedules := tx.Model(&Schedule{}).Where("company_id = ?", id).Select("id").QueryExpr()
+	// Dependent rows are deleted before the rows they refer to
+	deletes := []struct {
+		model interface{}
+		query string
+		arg   interface{}
+	}{
+		{Session{}, "user_id IN (?)", users},
+		{RefreshToken{}, "user_id IN (?)", users},
+		{RecoveryCode{}, "user_id IN (?)", users},
+		{PasswordHistory{}, "user_id IN (?)", users},
+		{PasswordResetToken{}, "user_id IN (?)", users},
+		{Profile{}, "company_id = ?", id},
+		{Invite{}, "company_id = ?", id},
+		{APIKey{}, "company_id = ?", id},
+		{WebhookDelivery{}, "webhook_id IN (?)", hooks},
+		{Webhook{}, "company_id = ?", id},
+		{ScheduleRun{}, "schedule_id IN (?)", schedules},
+		{Schedule{}, "company_id = ?", id},
+		{FeedbackRecord{}, "company_id = ?", id},
+		{CompanyQuota{}, "company_id = ?", id},
+		{QueuedJob{}, "company_id = ?", id},
+		{CachedResult{}, "company_id = ?", id},
+		{Company{}, "id = ?", id},
+	}
+	for _, d := range deletes {
+		if err := tx.Unscoped().Where(d.query, d.arg).Delete(d.model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// MigrateCompaniesHelper moves data that identified companies by name onto
+// Company records. A company is created for every distinct company_name in
+// legacyCompanyTables, taking its address from its profiles, and each row is
+// pointed at it through company_id before company_name is dropped. Must run
+// after the tables have been auto-migrated. Does nothing once migrated.
+func (dm *DataManager) MigrateCompaniesHelper() error {
+	var tables []string
+	for _, model := range legacyCompanyTables {
+		table := dm.NewScope(model).TableName()
+		if dm.Dialect().HasColumn(table, "company_name") {
+			tables = append(tables, table)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	tx := dm.Begin()
+	for _, table := range tables {
+		address := "''"
+		if table == "profiles" {
+			address = "COALESCE(MAX(t.address), '')"
+		}
+		stmts := []string{
+			fmt.Sprintf(`INSERT INTO companies (name, address, settings, created_at, updated_at)
+				SELECT t.company_name, %s, '{}', MIN(t.created_at), NOW() FROM %s t
+				WHERE t.company_name <> '' AND NOT EXISTS (SELECT 1 FROM companies c WHERE c.name = t.company_name)
+				GROUP BY t.company_name`, address, table),
+			fmt.Sprintf(`UPDATE %s t SET company_id = c.id FROM companies c
+				WHERE t.company_name = c.name AND (t.company_id IS NULL OR t.company_id = 0)`, table),
+			fmt.Sprintf(`ALTER TABLE %s DROP COLUMN company_name`, table),
+		}
+		if table == "profiles" {
+			// company_name was part of the profiles primary key, which is
+			// dropped with it
+			stmts = append(stmts,
+				`ALTER TABLE profiles DROP COLUMN IF EXISTS address`,
+				`ALTER TABLE profiles ADD PRIMARY KEY (id)`)
+		}
+		for _, stmt := range stmts {
+			if err := tx.Exec(stmt).Error; err != nil {
+				tx.Rollback()
+				return errors.New(fmt.Sprintf("migrating %s: %s", table, err.Error()))
+			}
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Parses the {id} path variable of company routes
+func companyIDFromRequest(r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	return uint(id), err == nil
+}
+
+// Checks that the caller holds perm in the company in the URL, writing an
+// error to w if not. Other companies are reported as not existing.
+func (dm *DataManager) companyForRequest(w http.ResponseWriter, r *http.Request, perm Permission) (*TenantDB, bool) {
+	tenant, _, ok := dm.TenantForRequest(w, r, perm)
+	if !ok {
+		return nil, false
+	}
+	id, ok := companyIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid company ID", http.StatusBadRequest)
+		return nil, false
+	}
+	if id != tenant.CompanyID {
+		http.Error(w, "Company does not exist", http.StatusNotFound)
+		return nil, false
+	}
+	return tenant, true
+}
+
+func writeCompany(w http.ResponseWriter, c Company) {
+	body, err := json.Marshal(c)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// GetCompany writes the company in the URL to w. Users may only view their
+// own company.
+func (dm *DataManager) GetCompany(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_VIEW_DATA)
+	if !ok {
+		return
+	}
+	c, err := tenant.GetCompanyHelper()
+	if err != nil {
+		http.Error(w, "Company does not exist", http.StatusNotFound)
+		return
+	}
+	writeCompany(w, c)
+}
+
+// UpdateCompany updates the `name`, `address`, `settings` and
+// `require_two_factor` of the company in the URL from the form values that
+// are present. settings must be a JSON object and replaces the existing
+// settings. Callers must enable two-factor authentication themselves before
+// requiring it, so they are not shut out.
+func (dm *DataManager) UpdateCompany(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_MANAGE_COMPANY)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Form could not be parsed correctly", http.StatusBadRequest)
+		return
+	}
+	c, err := tenant.GetCompanyHelper()
+	if err != nil {
+		http.Error(w, "Company does not exist", http.StatusNotFound)
+		return
+	}
+	if name, ok := r.PostForm["name"]; ok {
+		if name[0] == "" {
+			http.Error(w, "name must not be blank", http.StatusBadRequest)
+			return
+		}
+		if dm.companyNameTaken(name[0], c.ID) {
+			http.Error(w, "A company with that name already exists", http.StatusConflict)
+			return
+		}
+		c.Name = name[0]
+	}
+	if address, ok := r.PostForm["address"]; ok {
+		c.Address = address[0]
+	}
+	if settings, ok := r.PostForm["settings"]; ok {
+		var s CompanySettings
+		if err := json.Unmarshal([]byte(settings[0]), &s); err != nil || s == nil {
+			http.Error(w, "settings must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		c.Settings = s
+	}
+	if require, ok := r.PostForm["require_two_factor"]; ok {
+		on, err := strconv.ParseBool(require[0])
+		if err != nil {
+			http.Error(w, "require_two_factor must be true or false", http.StatusBadRequest)
+			return
+		}
+		if caller, _ := ProfileFromContext(r); on && !caller.TwoFactorEnabled {
+			http.Error(w, "Enable two-factor authentication before requiring it", http.StatusForbidden)
+			return
+		}
+		c.RequireTwoFactor = on
+	}
+	if err := dm.Save(&c).Error; err != nil {
+		fmt.Println("dm.Save: ", err)
+		http.Error(w, "Database error on company update", http.StatusInternalServerError)
+		return
+	}
+	writeCompany(w, c)
+}
+
+// DeleteCompany deletes the company in the URL and everything belonging to
+// it, including its users
+func (dm *DataManager) DeleteCompany(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_MANAGE_COMPANY)
+	if !ok {
+		return
+	}
+	if err := dm.DeleteCompanyHelper(tenant.CompanyID); err != nil {
+		fmt.Println("dm.DeleteCompanyHelper: ", err)
+		http.Error(w, "Database error on company delete", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCompany returns the company named name, creating it if needed
+func testCompany(t *testing.T, name string) Company {
+	c, err := dm.GetCompanyByNameHelper(name)
+	if err == gorm.ErrRecordNotFound {
+		c = Company{Name: name, Settings: CompanySettings{}}
+		err = dm.Create(&c).Error
+	}
+	if err != nil {
+		t.Fatal("Creation of company failed with err: ", err)
+	}
+	return c
+}
+
+// companyRequest serves a request to /companies/{id} as caller
+func companyRequest(caller *Profile, method string, id uint, form url.Values) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/companies/{id}", dm.GetCompany).Methods("GET")
+	router.HandleFunc("/companies/{id}", dm.UpdateCompany).Methods("PUT")
+	router.HandleFunc("/companies/{id}", dm.DeleteCompany).Methods("DELETE")
+	req, _ := http.NewRequest(method, fmt.Sprintf("/companies/%d", id), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if caller != nil {
+		req = withProfile(req, caller)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCompanySettingsValueScan(t *testing.T) {
+	v, err := CompanySettings(nil).Value()
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", v)
+
+	v, err = CompanySettings{"timezone": "America/Vancouver"}.Value()
+	assert.Nil(t, err)
+	var cs CompanySettings
+	assert.Nil(t, cs.Scan([]byte(v.(string))))
+	assert.Equal(t, "America/Vancouver", cs["timezone"])
+
+	assert.Nil(t, cs.Scan(nil))
+	assert.Equal(t, CompanySettings{}, cs)
+	assert.NotNil(t, cs.Scan(42))
+}
+
+func TestCompanyRequestRejected(t *testing.T) {
+	owner := &Profile{UserName: "owner", CompanyID: 1, Role: ROLE_OWNER}
+	admin := &Profile{UserName: "admin", CompanyID: 1, Role: ROLE_ADMIN}
+	assert.Equal(t, http.StatusUnauthorized, companyRequest(nil, "GET", 1, nil).Code)
+	// Other companies are reported as not existing
+	assert.Equal(t, http.StatusNotFound, companyRequest(owner, "GET", 2, nil).Code)
+	assert.Equal(t, http.StatusNotFound, companyRequest(owner, "DELETE", 2, nil).Code)
+	// Only owners manage their company
+	assert.Equal(t, http.StatusForbidden, companyRequest(admin, "PUT", 1, url.Values{"name": {"Acme"}}).Code)
+	assert.Equal(t, http.StatusForbidden, companyRequest(admin, "DELETE", 1, nil).Code)
+}
+
+func TestCompanyCRUD(t *testing.T) {
+	company := testCompany(t, "CRUD Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	taken := testCompany(t, "Taken Co")
+	defer dm.DeleteCompanyHelper(taken.ID)
+	owner := Profile{UserName: "owner", CompanyID: company.ID, Role: ROLE_OWNER}
+	if err := db.Create(&owner).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+	viewer := &Profile{UserName: "viewer", CompanyID: company.ID, Role: ROLE_VIEWER}
+
+	rr := companyRequest(viewer, "GET", company.ID, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var got Company
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal(t, "CRUD Co", got.Name)
+
+	rr = companyRequest(&owner, "PUT", company.ID, url.Values{"name": {"Taken Co"}})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = companyRequest(&owner, "PUT", company.ID, url.Values{"settings": {"[1, 2]"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = companyRequest(&owner, "PUT", company.ID, url.Values{
+		"address":  {"1 Renamed Rd"},
+		"settings": {`{"timezone": "America/Vancouver"}`},
+	})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	stored, err := dm.GetCompanyHelper(company.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "CRUD Co", stored.Name)
+	assert.Equal(t, "1 Renamed Rd", stored.Address)
+	assert.Equal(t, "America/Vancouver", stored.Settings["timezone"])
+
+	// Deleting a company deletes its users and its jobs' data
+	job := QueuedJob{JobID: "crud-job", CompanyID: company.ID, Status: JOB_QUEUED}
+	assert.Nil(t, db.Create(&job).Error)
+	cached := CachedResult{CompanyID: company.ID, Hash: "crud-hash"}
+	assert.Nil(t, db.Create(&cached).Error)
+	rr = companyRequest(&owner, "DELETE", company.ID, nil)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	_, err = dm.GetCompanyHelper(company.ID)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+	_, err = dm.GetProfileByIdHelper(owner.ID)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+	assert.True(t, db.Unscoped().First(&QueuedJob{}, job.ID).RecordNotFound())
+	assert.True(t, db.Unscoped().First(&CachedResult{}, cached.ID).RecordNotFound())
+}
+
+func TestMigrateCompaniesHelper(t *testing.T) {
+	// Recreate the column feedback was stored by before companies existed
+	if err := db.Exec("ALTER TABLE feedback_records ADD COLUMN company_name text").Error; err != nil {
+		t.Fatal("db.Exec: ", err)
+	}
+	existing := testCompany(t, "Existing Co")
+	defer dm.DeleteCompanyHelper(existing.ID)
+	for _, cn := range []string{"Migrated Co", "Migrated Co", "Existing Co"} {
+		err := db.Exec("INSERT INTO feedback_records (company_name, body, created_at) VALUES (?, 'legacy', NOW())", cn).Error
+		if err != nil {
+			t.Fatal("db.Exec: ", err)
+		}
+	}
+
+	assert.Nil(t, dm.MigrateCompaniesHelper())
+	assert.False(t, dm.Dialect().HasColumn("feedback_records", "company_name"))
+	migrated, err := dm.GetCompanyByNameHelper("Migrated Co")
+	if err != nil {
+		t.Fatal("dm.GetCompanyByNameHelper: ", err)
+	}
+	defer dm.DeleteCompanyHelper(migrated.ID)
+
+	var n int
+	dm.Model(&FeedbackRecord{}).Where("company_id = ?", migrated.ID).Count(&n)
+	assert.Equal(t, 2, n)
+	dm.Model(&FeedbackRecord{}).Where("company_id = ?", existing.ID).Count(&n)
+	assert.Equal(t, 1, n)
+	dm.Model(&Company{}).Where("name = ?", "Existing Co").Count(&n)
+	assert.Equal(t, 1, n)
+
+	// Running again is a no-op
+	assert.Nil(t, dm.MigrateCompaniesHelper())
+}
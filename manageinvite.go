@@ -0,0 +1,94 @@
+// Invitations that let new users register into an existing company
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long an invite can be redeemed for after it is issued
+const INVITE_TTL = 7 * 24 * time.Hour
+
+// Response to a new invite. The token is only ever shown here.
+type newInvite struct {
+	Invite
+	Token string
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// CreateInviteHelper issues an invite into the company for a user with role,
+// and returns it along with the token to give them. Only its hash is stored.
+func (t *TenantDB) CreateInviteHelper(role string, createdBy uint) (Invite, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return Invite{}, "", err
+	}
+	inv := Invite{
+		TokenHash: hashToken(token),
+		Role:      role,
+		CreatedBy: createdBy,
+		ExpiresAt: time.Now().Add(INVITE_TTL),
+	}
+	return inv, token, t.Create(&inv)
+}
+
+// GetInviteHelper retrieves an invite by its token, returning false if it
+// does not exist, has expired, or has already been redeemed
+func (dm *DataManager) GetInviteHelper(token string) (Invite, bool) {
+	var inv Invite
+	if dm.Where("token_hash = ?", hashToken(token)).First(&inv).RecordNotFound() {
+		return inv, false
+	}
+	return inv, inv.UsedAt == nil && time.Now().Before(inv.ExpiresAt)
+}
+
+// ConsumeInviteHelper marks an invite redeemed. Returns false if it was
+// already redeemed, so each invite admits at most one user.
+func (dm *DataManager) ConsumeInviteHelper(inv Invite) (bool, error) {
+	res := dm.Model(&Invite{}).Where("id = ? AND used_at IS NULL", inv.ID).Update("used_at", time.Now())
+	return res.RowsAffected == 1, res.Error
+}
+
+/* -------------------------------------------------------------------------- */
+
+// CreateInvite issues an invite into the company in the URL and writes it,
+// with its token, to w. The invited user is given the `role` form value,
+// or analyst if it is blank, which may not outrank the caller's own role.
+func (dm *DataManager) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	tenant, ok := dm.companyForRequest(w, r, PERM_MANAGE_PROFILES)
+	if !ok {
+		return
+	}
+	caller, _ := ProfileFromContext(r)
+	role := r.FormValue("role")
+	if role == "" {
+		role = ROLE_ANALYST
+	}
+	if !ValidRole(role) {
+		http.Error(w, fmt.Sprintf("role must be one of %s, %s, %s or %s",
+			ROLE_OWNER, ROLE_ADMIN, ROLE_ANALYST, ROLE_VIEWER), http.StatusBadRequest)
+		return
+	}
+	if roleOutranks(role, caller.Role) {
+		http.Error(w, "Cannot invite users with a role above your own", http.StatusForbidden)
+		return
+	}
+	inv, token, err := tenant.CreateInviteHelper(role, caller.ID)
+	if err != nil {
+		fmt.Println("tenant.CreateInviteHelper: ", err)
+		http.Error(w, "Database error on invite creation", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(newInvite{inv, token})
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
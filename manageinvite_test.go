@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// inviteRequest serves a request to create an invite into company id as caller
+func inviteRequest(caller *Profile, id uint, form url.Values) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/companies/{id}/invites", dm.CreateInvite).Methods("POST")
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/companies/%d/invites", id), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if caller != nil {
+		req = withProfile(req, caller)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCreateInviteRejected(t *testing.T) {
+	admin := &Profile{UserName: "admin", CompanyID: 1, Role: ROLE_ADMIN}
+	analyst := &Profile{UserName: "analyst", CompanyID: 1, Role: ROLE_ANALYST}
+	assert.Equal(t, http.StatusUnauthorized, inviteRequest(nil, 1, nil).Code)
+	assert.Equal(t, http.StatusForbidden, inviteRequest(analyst, 1, nil).Code)
+	assert.Equal(t, http.StatusNotFound, inviteRequest(admin, 2, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, inviteRequest(admin, 1, url.Values{"role": {"janitor"}}).Code)
+	// Admins cannot hand out ownership
+	assert.Equal(t, http.StatusForbidden, inviteRequest(admin, 1, url.Values{"role": {ROLE_OWNER}}).Code)
+}
+
+func TestCreateInvite(t *testing.T) {
+	company := testCompany(t, "Invite Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	admin := &Profile{UserName: "admin", CompanyID: company.ID, Role: ROLE_ADMIN}
+	admin.ID = 42
+
+	rr := inviteRequest(admin, company.ID, url.Values{"role": {ROLE_ADMIN}})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var inv newInvite
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &inv))
+	assert.NotEmpty(t, inv.Token)
+	assert.False(t, strings.Contains(rr.Body.String(), "TokenHash"))
+	assert.Equal(t, ROLE_ADMIN, inv.Role)
+	assert.Equal(t, company.ID, inv.CompanyID)
+	assert.Equal(t, uint(42), inv.CreatedBy)
+
+	stored, ok := dm.GetInviteHelper(inv.Token)
+	assert.True(t, ok)
+	assert.Equal(t, inv.ID, stored.ID)
+	assert.NotEqual(t, inv.Token, stored.TokenHash)
+
+	// Redeeming an invite only succeeds once
+	ok, err := dm.ConsumeInviteHelper(stored)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, _ = dm.ConsumeInviteHelper(stored)
+	assert.False(t, ok)
+	_, ok = dm.GetInviteHelper(inv.Token)
+	assert.False(t, ok)
+}
+
+func TestInviteExpires(t *testing.T) {
+	company := testCompany(t, "Invite Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	inv, token, err := dm.ForCompany(company.ID).CreateInviteHelper(ROLE_ANALYST, 0)
+	if err != nil {
+		t.Fatal("tenant.CreateInviteHelper: ", err)
+	}
+	dm.Model(&inv).Update("expires_at", time.Now().Add(-time.Minute))
+	_, ok := dm.GetInviteHelper(token)
+	assert.False(t, ok)
+}
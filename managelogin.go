@@ -4,18 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 )
 
-// Login takes a request with a username, company name, and password hash,
+// Login takes a request with a username, company name, and password,
 // it then authenticates the credentials, creates a session for the user
 // if successful, then redirects the user to the landing page with a cookie
-// attached containing the session ID
+// attached containing the session ID. Users with two-factor authentication
+// are instead given a token to finish signing in with at LoginTwoFactor.
 func (dm *DataManager) Login(w http.ResponseWriter, r *http.Request) {
 
 	// Get credentials from request form values
 	name := r.FormValue("user_name")
 	company := r.FormValue("company_name")
-	pass := r.FormValue("pw_hash")
+	pass := passwordFromRequest(r)
 
 	// Make sure credentials not empty
 	if name == "" || company == "" || pass == "" {
@@ -23,10 +25,8 @@ func (dm *DataManager) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passHash := []byte(pass)
-
 	// Failed authentication
-	if !dm.UserPwAuthSuccess(name, company, passHash) {
+	if !dm.UserPwAuthSuccess(name, company, pass) {
 		http.Error(w, "Failed authentication", http.StatusUnauthorized)
 		return
 	}
@@ -40,159 +40,87 @@ func (dm *DataManager) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Clear out any existing sessions for user
-
-	if err = dm.DeleteSessionsByUserHelper(profile.ID); err != nil {
-		fmt.Println("dm.DeleteSessionsByUserHelper: ", err.Error())
-		http.Error(w, "Database error on clearing sessions for user login", http.StatusInternalServerError)
-		return
-	}
-
-	// Create new session for user
-
-	sesh := Session{UserID: profile.ID}
+	// Ask for a second factor before signing in users who have one
 
-	if err = dm.CreateSessionHelper(sesh); err != nil {
-		fmt.Println("dm.CreateSessionHelperHelper", err)
-		http.Error(w, "Database error on creating new session for login", http.StatusInternalServerError)
+	if profile.TwoFactorEnabled {
+		token, err := dm.TwoFactorLoginTokenHelper(profile.ID, time.Now())
+		if err != nil {
+			fmt.Println("dm.TwoFactorLoginTokenHelper", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		body, err := json.Marshal(twoFactorChallenge{token})
+		if err != nil {
+			fmt.Println("json.Marshal: ", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
 		return
 	}
 
-	// Retrieve created session to get session ID
-
-	createdSesh, err := dm.GetSessionByUserHelper(profile.ID)
+	// Create new session for user and attach cookies with its token to the
+	// response. Any sessions the user has on other devices are kept.
 
-	if err != nil {
-		fmt.Println("dm.GetSessionByUserHelper", err)
+	if err = dm.StartSessionHelper(w, profile.ID, r); err != nil {
+		fmt.Println("dm.StartSessionHelper", err)
 		http.Error(w, "Database error on creating new session for login", http.StatusInternalServerError)
 		return
 	}
 
-	// Create cookie with encoded session ID
-
-	cookieValue := map[string]uint{
-		"id": createdSesh.ID,
-	}
-
-	encoded, err := dm.Encode("session", cookieValue)
-
-	if err != nil {
-		fmt.Println("dm.Encode", err)
-		http.Error(w, "Error creating cookie for user", http.StatusInternalServerError)
-		return
-	}
-
-	cookie := &http.Cookie{
-		Name:  "session",
-		Value: encoded,
-		Path:  "/",
-	}
-
-	// Attach cookie to response and redirect to landing
-
-	http.SetCookie(w, cookie)
+	// Redirect to landing
 
 	redirect := "/dashboard"
 	http.Redirect(w, r, redirect, http.StatusFound)
 
 }
 
-// Logout takes a request with a cookie in the header and deletes the
-// session found in the decoded cookie
+// Logout takes a request made under a session and deletes the session.
+// Requests under a session cookie must carry its CSRF token so other sites
+// cannot sign users out.
 func (dm *DataManager) Logout(w http.ResponseWriter, r *http.Request) {
 
-	cookies := r.Cookies()
-	var seshCookie http.Cookie
-
-	switch len(cookies) {
-	case 0:
-		// no cookie present, user must be already logged out
+	token, fromCookie, err := dm.sessionToken(r)
+	if err == ErrNoSession {
+		// no session present, user must be already logged out
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
-	case 1:
-		// has cookie
-		seshCookie = *cookies[0]
-	default:
-		fmt.Println("Length of request cookie array is not 0 or 1")
-		http.Error(w, "Error logging user out", http.StatusInternalServerError)
-		return
 	}
-
-	// decode cookie
-
-	seshID, err := dm.DecodeCookieHelper(seshCookie)
-
+	if err == nil && fromCookie && !csrfSafe(r, token) {
+		err = ErrCSRF
+	}
 	if err != nil {
-		fmt.Println("dm.DecodeCookieHelper", err)
-		http.Error(w, "Could not get session ID from cookie", http.StatusBadRequest)
+		writeSessionError(w, err)
 		return
 	}
 
-	// delete session ID
+	// delete session
 
-	if err = dm.DeleteSessionByIdHelper(seshID); err != nil {
-		fmt.Println("dm.DeleteSessionByIdHelper", err)
+	if err = dm.DeleteSessionByTokenHelper(token); err != nil {
+		fmt.Println("dm.DeleteSessionByTokenHelper", err)
 		http.Error(w, "Error clearing sessions for logout", http.StatusInternalServerError)
 		return
 	}
 
+	clearSessionCookie(w)
+
 	redirect := "/"
 
 	http.Redirect(w, r, redirect, http.StatusFound)
 }
 
-// GetProfileFromCookie takes a request with a cookie in the header
-// checks if the user is logged in and returns the profile if
-// they are, else it returns a 401 Not Authorized
+// GetProfileFromCookie takes a request made under a session, checks if the
+// user is logged in and returns the profile if they are, else it returns a
+// 401 Not Authorized
 func (dm *DataManager) GetProfileFromCookie(w http.ResponseWriter, r *http.Request) {
 
-	cookies := r.Cookies()
-	var seshCookie http.Cookie
-
-	switch len(cookies) {
-	case 0:
-		// no cookie present
-		http.Error(w, "No cookie in request header", http.StatusBadRequest)
-		return
-	case 1:
-		// has cookie
-		seshCookie = *cookies[0]
-	default:
-		fmt.Println("Length of request cookie array is not 0 or 1")
-		http.Error(w, "Error logging user out", http.StatusInternalServerError)
-		return
-	}
-
-	// decode cookie
-
-	seshID, err := dm.DecodeCookieHelper(seshCookie)
-
+	_, profile, err := dm.AuthenticateRequest(r, time.Now())
 	if err != nil {
-		fmt.Println("dm.DecodeCookieHelper", err)
-		http.Error(w, "Could not get session ID from cookie", http.StatusBadRequest)
+		writeSessionError(w, err)
 		return
 	}
 
-	sesh, err := dm.GetSessionByIdHelper(seshID)
-
-	// check if user is logged in
-	if err != nil {
-		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
-		return
-	}
-
-	// get profile object
-	profile, err := dm.GetProfileByIdHelper(sesh.UserID)
-
-	if err != nil {
-		fmt.Println("dm.GetProfileByIdHelper", err)
-		http.Error(w, "Could not find user from that session", http.StatusInternalServerError)
-		return
-	}
-
-	// strip password
-	profile.PwHash = []byte("")
-
 	body, err := json.Marshal(profile)
 	if err != nil {
 		fmt.Println("json.Marshal: ", err)
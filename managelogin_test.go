@@ -15,10 +15,9 @@ import (
 func TestLoginGood(t *testing.T) {
 
 	prof := Profile{
-		UserName:    "super_sifter",
-		CompanyName: "Sift Technologies, Inc.",
-		Address:     "4321 Pleasantown Rd, Pleasantville, PV, UPV, V1A 1X1",
-		PwHash:      []byte("cd026ec28d7976550a52da2520660bd8e26b5b40"),
+		UserName:  "super_sifter",
+		CompanyID: testCompany(t, "Sift Technologies, Inc.").ID,
+		PwHash:    []byte("cd026ec28d7976550a52da2520660bd8e26b5b40"),
 	}
 
 	if err := dm.Create(&prof).Error; err != nil {
@@ -134,22 +133,27 @@ func TestLogoutGood(t *testing.T) {
 
 	// now we logout
 
-	req, err = http.NewRequest("GET", "/logout", nil)
+	token, err := dm.DecodeCookieHelper(*cookie[0])
+
+	if err != nil {
+		t.Error("dm.DecodeCookieHelper", err)
+	}
+
+	req, err = http.NewRequest("POST", "/logout", nil)
 
 	if err != nil {
 		t.Error("http.NewRequest", err)
 	}
 
-	req.AddCookie(cookie[0])
+	rr = httptest.NewRecorder()
 	handler = http.HandlerFunc(dm.Logout)
-	handler.ServeHTTP(rr, req)
+	handler.ServeHTTP(rr, withSession(req, cookie))
 
 	// check we got a redirect
 	assert.Equal(t, rr.Code, http.StatusFound)
 
-	// check that our session was deleted
-	deletedSesh, err := dm.GetSessionByUserHelper(profile.ID)
-	assert.Equal(t, deletedSesh.ID, uint(0))
+	// check that our session was deleted, leaving any others the user has
+	_, err = dm.GetSessionByTokenHelper(token)
 	assert.NotNil(t, err)
 
 }
@@ -227,16 +231,16 @@ func TestGetProfileFromCookie(t *testing.T) {
 
 	assert.Equal(t, profile.ID, resProfile.ID)
 	assert.Equal(t, profile.UserName, resProfile.UserName)
-	assert.Equal(t, profile.CompanyName, resProfile.CompanyName)
+	assert.Equal(t, profile.CompanyID, resProfile.CompanyID)
 	assert.Equal(t, 0, bytes.Compare(resProfile.PwHash, []byte("")))
 
 }
 
 func TestGetProfileFromCookieUnauthorized(t *testing.T) {
 
-	// make up a bad session ID and encode in cookie
+	// make up a bad session token and encode in cookie
 
-	cookie, err := dm.CreateCookieHelper(99999)
+	cookie, err := dm.CreateCookieHelper("not-a-session-token")
 
 	if err != nil {
 		t.Error("dm.CreateCookieHelper", err)
@@ -0,0 +1,214 @@
+// Recovery of forgotten passwords through emailed one-time reset tokens
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// How long a password reset token can be used for after it is sent
+	RESET_TOKEN_TTL = time.Hour
+	// Reset emails sent per account, and reset requests accepted per client
+	// IP, within RESET_RATE_WINDOW
+	RESET_EMAILS_PER_ACCOUNT = 3
+	RESET_REQUESTS_PER_IP    = 20
+	RESET_RATE_WINDOW        = time.Hour
+)
+
+// Response to every forgot-password request, whether or not the account
+// exists, so that the endpoint cannot be used to discover users
+const RESET_REQUESTED_MESSAGE = "If the account exists and has an email address, a password reset link has been sent to it"
+
+// newToken returns a random token to hand to a user, such as a password reset
+// or invite token
+func newToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// hashToken returns the form of a token made by newToken that is stored in
+// the db
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// CreateResetTokenHelper creates a reset token for a user, replacing any they
+// already had, and returns the token to send them. Only its hash is stored.
+func (dm *DataManager) CreateResetTokenHelper(userID uint) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	tx := dm.Begin()
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(PasswordResetToken{}).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	rt := PasswordResetToken{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(RESET_TOKEN_TTL),
+	}
+	if err := tx.Create(&rt).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	return token, tx.Commit().Error
+}
+
+// GetResetTokenHelper retrieves a reset token, returning false if it does not
+// exist, has expired, or has already been used
+func (dm *DataManager) GetResetTokenHelper(token string) (PasswordResetToken, bool) {
+	var rt PasswordResetToken
+	if dm.Where("token_hash = ?", hashToken(token)).First(&rt).RecordNotFound() {
+		return rt, false
+	}
+	return rt, rt.UsedAt == nil && time.Now().Before(rt.ExpiresAt)
+}
+
+// ConsumeResetTokenHelper marks a reset token used. Returns false if it was
+// already used, so only one of several concurrent requests with the same
+// token can succeed.
+func (dm *DataManager) ConsumeResetTokenHelper(rt PasswordResetToken) (bool, error) {
+	res := dm.Model(&PasswordResetToken{}).Where("id = ? AND used_at IS NULL", rt.ID).Update("used_at", time.Now())
+	return res.RowsAffected == 1, res.Error
+}
+
+/* -------------------------------------------------------------------------- */
+
+// PasswordResetter emails password reset links to users and resets passwords
+// given a valid token
+type PasswordResetter struct {
+	dm     *DataManager
+	Mailer Mailer
+	// Page of the web app that reset links point to. The token is appended
+	// as the `token` query parameter.
+	ResetURL string
+
+	accountLimit *RateLimiter
+	ipLimit      *RateLimiter
+}
+
+// NewPasswordResetter constructs a PasswordResetter with the default rate limits
+func NewPasswordResetter(dm *DataManager, mailer Mailer, resetURL string) *PasswordResetter {
+	return &PasswordResetter{
+		dm:           dm,
+		Mailer:       mailer,
+		ResetURL:     resetURL,
+		accountLimit: NewRateLimiter(RESET_EMAILS_PER_ACCOUNT, RESET_RATE_WINDOW),
+		ipLimit:      NewRateLimiter(RESET_REQUESTS_PER_IP, RESET_RATE_WINDOW),
+	}
+}
+
+// ForgotPassword sends a reset link to the email of the account named by the
+// `user_name` and `company_name` form values. The response is the same
+// whether or not the account exists, and the email is sent in the background
+// so response times do not reveal it either.
+func (pr *PasswordResetter) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if !pr.ipLimit.Allow(clientIP(r)) {
+		http.Error(w, "Too many password reset requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+	un, cn := r.FormValue("user_name"), r.FormValue("company_name")
+	if un == "" || cn == "" {
+		http.Error(w, "One or more credentials were blank", http.StatusBadRequest)
+		return
+	}
+	go pr.sendReset(un, cn)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, RESET_REQUESTED_MESSAGE)
+}
+
+// sendReset emails a new reset token to the account, if it exists, has an
+// email address, and has not had too many reset emails recently
+func (pr *PasswordResetter) sendReset(un, cn string) {
+	prof, err := pr.dm.GetProfileHelper(un, cn)
+	if err != nil || prof.Email == "" {
+		return
+	}
+	if !pr.accountLimit.Allow(fmt.Sprint(prof.ID)) {
+		return
+	}
+	token, err := pr.dm.CreateResetTokenHelper(prof.ID)
+	if err != nil {
+		fmt.Println("dm.CreateResetTokenHelper: ", err)
+		return
+	}
+	link := pr.ResetURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"Someone asked to reset the password of your Sift account at %s. "+
+		"If it was you, choose a new password here within %v:\n\n%s\n\n"+
+		"If it wasn't, you can ignore this email.\n",
+		prof.UserName, cn, RESET_TOKEN_TTL, link)
+	if err := pr.Mailer.Send(prof.Email, "Reset your Sift password", body); err != nil {
+		fmt.Println("Mailer.Send: ", err)
+	}
+}
+
+// ResetPassword sets the password of the user a reset `token` was sent to to
+// the `new_password` form value. The token can only be used once, and all of
+// the user's sessions are ended.
+func (pr *PasswordResetter) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !pr.ipLimit.Allow(clientIP(r)) {
+		http.Error(w, "Too many password reset requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+	token, next := r.FormValue("token"), r.FormValue("new_password")
+	if token == "" || next == "" {
+		http.Error(w, "Token or password was blank", http.StatusBadRequest)
+		return
+	}
+	rt, ok := pr.dm.GetResetTokenHelper(token)
+	if !ok {
+		http.Error(w, "Reset token is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	prof, err := pr.dm.GetProfileByIdHelper(rt.UserID)
+	if err != nil {
+		fmt.Println("dm.GetProfileByIdHelper: ", err)
+		http.Error(w, "Reset token is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	// Check the password before using up the token so a rejected password
+	// can be corrected
+	if err := passwordPolicy.Check(next); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pr.dm.passwordReused(prof, next) {
+		http.Error(w, fmt.Sprintf("password must differ from your last %d passwords", PASSWORD_HISTORY_SIZE),
+			http.StatusBadRequest)
+		return
+	}
+	if ok, err := pr.dm.ConsumeResetTokenHelper(rt); !ok {
+		if err != nil {
+			fmt.Println("dm.ConsumeResetTokenHelper: ", err)
+		}
+		http.Error(w, "Reset token is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err := pr.dm.SetPasswordHelper(prof, next); err != nil {
+		fmt.Println("dm.SetPasswordHelper: ", err)
+		http.Error(w, "Database error on password reset", http.StatusInternalServerError)
+		return
+	}
+	if err := pr.dm.DeleteSessionsByUserHelper(prof.ID); err != nil {
+		fmt.Println("dm.DeleteSessionsByUserHelper: ", err)
+	}
+	if err := pr.dm.DeleteRefreshTokensByUserHelper(prof.ID); err != nil {
+		fmt.Println("dm.DeleteRefreshTokensByUserHelper: ", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var resetTokenPattern = regexp.MustCompile(`token=([0-9a-f]+)`)
+
+func postForm(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "10.0.0.1:51234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// Waits for the mailer to have sent n emails
+func waitForMail(t *testing.T, m *MemoryMailer, n int) []Mail {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sent := m.Sent(); len(sent) >= n {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d emails to be sent, got %d", n, len(m.Sent()))
+	return nil
+}
+
+func TestForgotAndResetPassword(t *testing.T) {
+	hash, _ := HashPassword("correct horse battery staple")
+	cn := "Sift Technologies, Inc."
+	prof := Profile{
+		UserName:  "forgetful_sifter",
+		CompanyID: testCompany(t, cn).ID,
+		PwHash:    hash,
+		Email:     "forgetful@sift.com",
+	}
+	if err := db.Create(&prof).Error; err != nil {
+		t.Errorf("Error creating profile not expected. err: %v", err)
+	}
+	defer db.Unscoped().Delete(&prof)
+	defer db.Unscoped().Where("user_id = ?", prof.ID).Delete(&PasswordHistory{})
+	defer db.Unscoped().Where("user_id = ?", prof.ID).Delete(&PasswordResetToken{})
+
+	mailer := NewMemoryMailer()
+	pr := NewPasswordResetter(&dm, mailer, "https://sift.com/reset")
+
+	rr := postForm(pr.ForgotPassword, "/password/forgot", url.Values{
+		"user_name":    {prof.UserName},
+		"company_name": {cn},
+	})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	sent := waitForMail(t, mailer, 1)
+	assert.Equal(t, prof.Email, sent[0].To)
+	match := resetTokenPattern.FindStringSubmatch(sent[0].Body)
+	if match == nil {
+		t.Fatalf("No reset link in email body: %s", sent[0].Body)
+	}
+	token := match[1]
+
+	// Only the token's hash is stored
+	var rt PasswordResetToken
+	assert.Nil(t, db.Where("user_id = ?", prof.ID).First(&rt).Error)
+	assert.NotEqual(t, token, rt.TokenHash)
+
+	// A rejected password does not use up the token
+	rr = postForm(pr.ResetPassword, "/password/reset", url.Values{"token": {token}, "new_password": {"short"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = postForm(pr.ResetPassword, "/password/reset", url.Values{
+		"token":        {token},
+		"new_password": {"tr0ub4dor and three"},
+	})
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.True(t, dm.UserPwAuthSuccess(prof.UserName, cn, "tr0ub4dor and three"))
+
+	// Tokens are single-use
+	rr = postForm(pr.ResetPassword, "/password/reset", url.Values{
+		"token":        {token},
+		"new_password": {"yet another passphrase"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.True(t, dm.UserPwAuthSuccess(prof.UserName, cn, "tr0ub4dor and three"))
+}
+
+func TestForgotPasswordUnknownUser(t *testing.T) {
+	mailer := NewMemoryMailer()
+	pr := NewPasswordResetter(&dm, mailer, "https://sift.com/reset")
+	rr := postForm(pr.ForgotPassword, "/password/forgot", url.Values{
+		"user_name":    {"nobody"},
+		"company_name": {"Sift Technologies, Inc."},
+	})
+	// Indistinguishable from a request for an existing user
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, RESET_REQUESTED_MESSAGE+"\n", rr.Body.String())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(mailer.Sent()))
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	prof := Profile{UserName: "slow_sifter", CompanyID: testCompany(t, "Sift Technologies, Inc.").ID}
+	if err := db.Create(&prof).Error; err != nil {
+		t.Errorf("Error creating profile not expected. err: %v", err)
+	}
+	defer db.Unscoped().Delete(&prof)
+	defer db.Unscoped().Where("user_id = ?", prof.ID).Delete(&PasswordResetToken{})
+
+	token, err := dm.CreateResetTokenHelper(prof.ID)
+	assert.Nil(t, err)
+	db.Model(&PasswordResetToken{}).Where("user_id = ?", prof.ID).Update("expires_at", time.Now().Add(-time.Minute))
+
+	pr := NewPasswordResetter(&dm, NewMemoryMailer(), "https://sift.com/reset")
+	rr := postForm(pr.ResetPassword, "/password/reset", url.Values{
+		"token":        {token},
+		"new_password": {"tr0ub4dor and three"},
+	})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestForgotPasswordRateLimited(t *testing.T) {
+	pr := NewPasswordResetter(&dm, NewMemoryMailer(), "https://sift.com/reset")
+	pr.ipLimit = NewRateLimiter(1, time.Hour)
+	form := url.Values{"user_name": {"nobody"}, "company_name": {"Sift Technologies, Inc."}}
+	assert.Equal(t, http.StatusAccepted, postForm(pr.ForgotPassword, "/password/forgot", form).Code)
+	assert.Equal(t, http.StatusTooManyRequests, postForm(pr.ForgotPassword, "/password/forgot", form).Code)
+	assert.Equal(t, http.StatusTooManyRequests,
+		postForm(pr.ResetPassword, "/password/reset", url.Values{"token": {"abc"}, "new_password": {"x"}}).Code)
+}
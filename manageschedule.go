@@ -0,0 +1,397 @@
+// Scheduled recurring analyses over a company's stored feedback
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How often due schedules are checked for
+	RECURRING_PERIOD = 30 * time.Second
+	// Days of feedback analysed by a schedule when lookback_days is omitted
+	DEFAULT_LOOKBACK_DAYS = 7
+	MAX_LOOKBACK_DAYS     = 365
+)
+
+// Statuses of a ScheduleRun
+const (
+	SCHEDULE_RUN_DISPATCHED = "dispatched"
+	// No feedback was uploaded within the schedule's lookback window
+	SCHEDULE_RUN_SKIPPED = "skipped"
+	SCHEDULE_RUN_FAILED  = "failed"
+)
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// StoreFeedbackHelper records feedback uploaded by the company
+func (t *TenantDB) StoreFeedbackHelper(fb []Feedback) error {
+	tx := t.Begin()
+	for _, f := range fb {
+		if err := tx.Create(&FeedbackRecord{Body: f.FBody}); err != nil {
+			tx.DB().Rollback()
+			return err
+		}
+	}
+	return tx.DB().Commit().Error
+}
+
+// GetFeedbackSinceHelper retrieves the feedback the company uploaded after
+// since, identified by record ID
+func (t *TenantDB) GetFeedbackSinceHelper(since time.Time) ([]Feedback, error) {
+	var records []FeedbackRecord
+	err := t.Query(&FeedbackRecord{}).Where("created_at > ?", since).Order("id asc").Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+	fb := make([]Feedback, len(records))
+	for i, rec := range records {
+		fb[i] = Feedback{ID: uint64(rec.ID), FBody: rec.Body}
+	}
+	return fb, nil
+}
+
+// GetSchedulesHelper retrieves all of the company's schedules
+func (t *TenantDB) GetSchedulesHelper() (schedules []Schedule, err error) {
+	err = t.Query(&Schedule{}).Order("id asc").Find(&schedules).Error
+	return
+}
+
+// GetScheduleHelper retrieves one of the company's schedules by id
+func (t *TenantDB) GetScheduleHelper(id uint) (s Schedule, err error) {
+	err = t.Query(&Schedule{}).Where("id = ?", id).First(&s).Error
+	return
+}
+
+// GetDueSchedulesHelper retrieves unpaused schedules due to run at t
+func (dm *DataManager) GetDueSchedulesHelper(t time.Time) (schedules []Schedule, err error) {
+	err = dm.Where("paused = ? AND next_run_at <= ?", false, t).Find(&schedules).Error
+	return
+}
+
+// ClaimScheduleRunHelper advances a due schedule read as s to its next run
+// time, recording a run at now, unless it has been advanced or paused since
+// it was read. Reports whether the run was claimed, so that only one API
+// instance runs it. Only the run times are written, so edits made while the
+// schedule runs are kept.
+func (dm *DataManager) ClaimScheduleRunHelper(s Schedule, now, next time.Time, pause bool) (bool, error) {
+	updates := map[string]interface{}{"last_run_at": now, "next_run_at": next}
+	if pause {
+		updates["paused"] = true
+	}
+	res := dm.Model(&Schedule{}).Where("id = ? AND next_run_at = ? AND paused = ?", s.ID, s.NextRunAt, false).Updates(updates)
+	return res.RowsAffected == 1, res.Error
+}
+
+// GetScheduleRunsHelper retrieves the runs of one of the company's
+// schedules, newest first
+func (t *TenantDB) GetScheduleRunsHelper(id uint) (runs []ScheduleRun, err error) {
+	schedule := t.Query(&Schedule{}).Where("id = ?", id).Select("id").QueryExpr()
+	err = t.dm.Where("schedule_id IN (?)", schedule).Order("id desc").Find(&runs).Error
+	return
+}
+
+// nextRun returns the next time after t that the cron expression matches
+func nextRun(expr string, t time.Time) (time.Time, error) {
+	c, err := ParseCron(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := c.Next(t.UTC())
+	if next.IsZero() {
+		return next, errors.New("cron expression never matches")
+	}
+	return next, nil
+}
+
+// Parses the {id} path variable of schedule routes
+func scheduleIDFromRequest(r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	return uint(id), err == nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// CreateSchedule creates a schedule for the caller's company from the form
+// values `cron`, `analysis` and `lookback_days`. Any other form values are
+// validated and stored as the analysis type's parameters.
+func (dm *DataManager) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_SUBMIT_JOBS)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Form could not be parsed correctly", http.StatusBadRequest)
+		return
+	}
+	expr := r.PostFormValue("cron")
+	next, err := nextRun(expr, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, err := GetAnalysisType(r.PostFormValue("analysis"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := at.ParseParams(r.PostForm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lookback := DEFAULT_LOOKBACK_DAYS
+	if v := r.PostFormValue("lookback_days"); v != "" {
+		if lookback, err = strconv.Atoi(v); err != nil || lookback < 1 || lookback > MAX_LOOKBACK_DAYS {
+			http.Error(w, fmt.Sprintf("lookback_days must be between 1 and %d", MAX_LOOKBACK_DAYS),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	// Only keep the values that are parameters of the analysis
+	params := url.Values{}
+	for _, p := range at.Params {
+		if v, ok := r.PostForm[p.Name]; ok {
+			params[p.Name] = v
+		}
+	}
+
+	s := Schedule{
+		Cron:         expr,
+		Analysis:     at.Name,
+		Params:       params.Encode(),
+		LookbackDays: lookback,
+		NextRunAt:    next,
+	}
+	if err := tenant.Create(&s); err != nil {
+		fmt.Println("tenant.Create: ", err)
+		http.Error(w, "Database error on schedule creation", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(s)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// ListSchedules writes the caller's company's schedules to w
+func (dm *DataManager) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_VIEW_DATA)
+	if !ok {
+		return
+	}
+	schedules, err := tenant.GetSchedulesHelper()
+	if err != nil {
+		fmt.Println("tenant.GetSchedulesHelper: ", err)
+		http.Error(w, "Database error on schedule retrieval", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(schedules)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// setSchedulePaused pauses or resumes the schedule in the URL. Resumed
+// schedules next run at the first match after now, so runs missed while
+// paused are not made up.
+func (dm *DataManager) setSchedulePaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_SUBMIT_JOBS)
+	if !ok {
+		return
+	}
+	id, ok := scheduleIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+	s, err := tenant.GetScheduleHelper(id)
+	if err != nil {
+		http.Error(w, "Schedule does not exist", http.StatusNotFound)
+		return
+	}
+	s.Paused = paused
+	if !paused {
+		if s.NextRunAt, err = nextRun(s.Cron, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := tenant.Save(&s); err != nil {
+		fmt.Println("tenant.Save: ", err)
+		http.Error(w, "Database error on schedule update", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(s)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// PauseSchedule stops the schedule in the URL from running until resumed
+func (dm *DataManager) PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	dm.setSchedulePaused(w, r, true)
+}
+
+// ResumeSchedule restarts the paused schedule in the URL
+func (dm *DataManager) ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	dm.setSchedulePaused(w, r, false)
+}
+
+// ListScheduleRuns writes the runs of the schedule in the URL to w
+func (dm *DataManager) ListScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_VIEW_DATA)
+	if !ok {
+		return
+	}
+	id, ok := scheduleIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := tenant.GetScheduleHelper(id); err != nil {
+		http.Error(w, "Schedule does not exist", http.StatusNotFound)
+		return
+	}
+	runs, err := tenant.GetScheduleRunsHelper(id)
+	if err != nil {
+		fmt.Println("tenant.GetScheduleRunsHelper: ", err)
+		http.Error(w, "Database error on schedule run retrieval", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(runs)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// RecurringRunner dispatches due schedules through a JobRunner
+type RecurringRunner struct {
+	dm   *DataManager
+	jr   *JobRunner
+	stop chan bool
+}
+
+func NewRecurringRunner(dm *DataManager, jr *JobRunner) *RecurringRunner {
+	return &RecurringRunner{dm: dm, jr: jr, stop: make(chan bool)}
+}
+
+// Start checks for due schedules every RECURRING_PERIOD until Stop is called
+func (rr *RecurringRunner) Start() {
+	go func() {
+		ticker := time.NewTicker(RECURRING_PERIOD)
+		defer ticker.Stop()
+		for {
+			if err := rr.RunDue(time.Now()); err != nil {
+				fmt.Println("rr.RunDue: ", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-rr.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (rr *RecurringRunner) Stop() {
+	close(rr.stop)
+}
+
+// RunDue runs every schedule due at now that no other API instance has
+// claimed, records each run, and advances the schedules to their next run
+// time
+func (rr *RecurringRunner) RunDue(now time.Time) error {
+	schedules, err := rr.dm.GetDueSchedulesHelper(now)
+	if err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		next, err := nextRun(s.Cron, now)
+		// Unreachable for schedules validated on creation, but never leave a
+		// schedule due forever
+		pause := err != nil
+		if pause {
+			next = s.NextRunAt
+		}
+		claimed, err := rr.dm.ClaimScheduleRunHelper(s, now, next, pause)
+		if err != nil {
+			fmt.Println("dm.ClaimScheduleRunHelper: ", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		run := rr.runSchedule(s, now)
+		if err := rr.dm.Create(&run).Error; err != nil {
+			fmt.Println("dm.Create: ", err)
+		}
+	}
+	return nil
+}
+
+// runSchedule builds a payload from the company's recent feedback and
+// submits it as a job
+func (rr *RecurringRunner) runSchedule(s Schedule, now time.Time) ScheduleRun {
+	run := ScheduleRun{ScheduleID: s.ID}
+	fail := func(err error) ScheduleRun {
+		run.Status = SCHEDULE_RUN_FAILED
+		run.Error = err.Error()
+		return run
+	}
+
+	at, err := GetAnalysisType(s.Analysis)
+	if err != nil {
+		return fail(err)
+	}
+	form, err := url.ParseQuery(s.Params)
+	if err != nil {
+		return fail(err)
+	}
+	params, err := at.ParseParams(form)
+	if err != nil {
+		return fail(err)
+	}
+	fb, err := rr.dm.ForCompany(s.CompanyID).GetFeedbackSinceHelper(now.AddDate(0, 0, -s.LookbackDays))
+	if err != nil {
+		return fail(err)
+	}
+	run.FeedbackCount = len(fb)
+	if len(fb) == 0 {
+		run.Status = SCHEDULE_RUN_SKIPPED
+		return run
+	}
+
+	job, err := rr.jr.Submit(s.CompanyID, at, NewJobEnvelope(at.Name, params, fb), false)
+	if err != nil {
+		return fail(err)
+	}
+	run.Status = SCHEDULE_RUN_DISPATCHED
+	run.JobID = job.ID
+	return run
+}
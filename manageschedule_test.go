@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecurringRunnerRunDue(t *testing.T) {
+	company := testCompany(t, "Recurring Co").ID
+	defer dm.DeleteCompanyHelper(company)
+	tenant := dm.ForCompany(company)
+	fb := []Feedback{{0, "Blender is loud"}, {1, "Toaster is great"}}
+	if err := tenant.StoreFeedbackHelper(fb); err != nil {
+		t.Fatal("tenant.StoreFeedbackHelper", err)
+	}
+
+	now := time.Now()
+	s := Schedule{
+		CompanyID:    company,
+		Cron:         "0 9 * * 1",
+		Analysis:     "summarization",
+		LookbackDays: 7,
+		NextRunAt:    now.Add(-time.Minute),
+	}
+	if err := dm.Create(&s).Error; err != nil {
+		t.Fatal("dm.Create", err)
+	}
+	defer dm.Unscoped().Delete(&s)
+	defer dm.Unscoped().Where("schedule_id = ?", s.ID).Delete(ScheduleRun{})
+
+	due, err := tenant.GetScheduleHelper(s.ID)
+	if err != nil {
+		t.Fatal("tenant.GetScheduleHelper", err)
+	}
+	q := &fakeQueue{states: []*TaskState{{Status: "SUCCESS", Result: "summary"}}}
+	rr := NewRecurringRunner(&dm, newFakeRunner(q))
+	if err := rr.RunDue(now); err != nil {
+		t.Fatal("rr.RunDue", err)
+	}
+
+	runs, err := tenant.GetScheduleRunsHelper(s.ID)
+	if err != nil {
+		t.Fatal("tenant.GetScheduleRunsHelper", err)
+	}
+	assert.Equal(t, 1, len(runs))
+	assert.Equal(t, SCHEDULE_RUN_DISPATCHED, runs[0].Status)
+	assert.Equal(t, 2, runs[0].FeedbackCount)
+	assert.NotEqual(t, "", runs[0].JobID)
+
+	updated, err := tenant.GetScheduleHelper(s.ID)
+	if err != nil {
+		t.Fatal("tenant.GetScheduleHelper", err)
+	}
+	assert.True(t, updated.NextRunAt.After(now))
+	assert.NotNil(t, updated.LastRunAt)
+
+	// Another instance that read the schedule while it was due cannot run it
+	claimed, err := dm.ClaimScheduleRunHelper(due, now, updated.NextRunAt, false)
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+
+	// Not due again until the next match
+	if err := rr.RunDue(now); err != nil {
+		t.Fatal("rr.RunDue", err)
+	}
+	runs, _ = tenant.GetScheduleRunsHelper(s.ID)
+	assert.Equal(t, 1, len(runs))
+}
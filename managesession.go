@@ -2,52 +2,123 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// Cookie carrying the encoded session token
+	SESSION_COOKIE_NAME = "session"
+	// Longest a session lasts after login, however active its user is
+	SESSION_LIFETIME = 7 * 24 * time.Hour
+	// Sessions end after going this long without a request
+	SESSION_IDLE_TIMEOUT = 2 * time.Hour
+	// Activity is recorded at most this often per session, so that not every
+	// request writes to the db
+	SESSION_RENEW_INTERVAL = time.Minute
+	// How often SessionSweeper purges expired sessions and refresh tokens
+	SESSION_SWEEP_PERIOD = 15 * time.Minute
 )
 
+// ErrSessionExpired is returned when resuming a session that has ended
+var ErrSessionExpired = errors.New("session has expired")
+
+// Expired reports whether the session has ended by now. Sessions created
+// before expiry was recorded have no ExpiresAt and are always expired.
+func (s Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || !now.Before(s.LastSeenAt.Add(SESSION_IDLE_TIMEOUT))
+}
+
 // Cookie Helpers
 
-// CreateCookieHelper takes a session id and returns an encoded cookie
-func (dm *DataManager) CreateCookieHelper(id uint) (http.Cookie, error) {
+// CreateCookieHelper takes a session token and returns an encoded cookie
+func (dm *DataManager) CreateCookieHelper(token string) (http.Cookie, error) {
 
-	value := map[string]uint{
-		"id": id,
+	value := map[string]string{
+		"token": token,
 	}
 
-	encoded, err := dm.Encode("session", value)
+	encoded, err := securecookie.EncodeMulti("session", value, dm.Cookies...)
 	if err != nil {
-		fmt.Println("dm.Encode, err:", err)
+		fmt.Println("securecookie.EncodeMulti, err:", err)
 		return http.Cookie{}, err
 	}
 
+	// Scripts never need the session cookie, so they are not allowed it
 	cookie := http.Cookie{
-		Name:  "session",
-		Value: encoded,
-		Path:  "/",
+		Name:     SESSION_COOKIE_NAME,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   int(SESSION_LIFETIME / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies,
 	}
 
 	return cookie, nil
 }
 
-// DecodeCookieHelper takes a cookie and returns the associated session ID
-func (dm *DataManager) DecodeCookieHelper(cookie http.Cookie) (uint, error) {
+// DecodeCookieHelper takes a cookie and returns the associated session token
+func (dm *DataManager) DecodeCookieHelper(cookie http.Cookie) (string, error) {
 
-	value := make(map[string]uint)
+	value := make(map[string]string)
 
-	if err := dm.Decode("session", cookie.Value, &value); err != nil {
-		fmt.Println("dm.Decode:", err)
-		return 0, err
+	if err := securecookie.DecodeMulti("session", cookie.Value, &value, dm.Cookies...); err != nil {
+		fmt.Println("securecookie.DecodeMulti:", err)
+		return "", err
 	}
 
-	return value["id"], nil
+	return value["token"], nil
 }
 
 // Helper Methods
 
-// CreateSessionHelper validates session object then pushes to session table
-func (dm *DataManager) CreateSessionHelper(sesh Session) error {
-	return dm.Create(&sesh).Error
+// CreateSessionHelper gives a session a new random token, then pushes it to
+// the session table and returns the token. Only its hash is stored. Sessions
+// without an expiry start now and last SESSION_LIFETIME.
+func (dm *DataManager) CreateSessionHelper(sesh *Session) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	sesh.TokenHash = hashToken(token)
+	now := time.Now()
+	if sesh.ExpiresAt.IsZero() {
+		sesh.ExpiresAt = now.Add(SESSION_LIFETIME)
+	}
+	if sesh.LastSeenAt.IsZero() {
+		sesh.LastSeenAt = now
+	}
+	return token, dm.Create(sesh).Error
+}
+
+// StartSessionHelper creates a session for a user logging in with r, and
+// sets the cookie carrying its token and the cookie with its CSRF token on w
+func (dm *DataManager) StartSessionHelper(w http.ResponseWriter, userID uint, r *http.Request) error {
+	sesh := Session{
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	token, err := dm.CreateSessionHelper(&sesh)
+	if err != nil {
+		return err
+	}
+	cookie, err := dm.CreateCookieHelper(token)
+	if err != nil {
+		return err
+	}
+	csrf := CSRFCookieHelper(token)
+	setCookie(w, &cookie)
+	setCookie(w, &csrf)
+	return nil
 }
 
 // GetSessionByIdHelper retrieves using id primary key
@@ -56,80 +127,282 @@ func (dm *DataManager) GetSessionByIdHelper(id uint) (sesh Session, err error) {
 	return
 }
 
+// GetSessionByTokenHelper retrieves using the token carried by its cookie
+func (dm *DataManager) GetSessionByTokenHelper(token string) (sesh Session, err error) {
+	if token == "" {
+		return sesh, gorm.ErrRecordNotFound
+	}
+	err = dm.Where("token_hash = ?", hashToken(token)).First(&sesh).Error
+	return
+}
+
 // GetSessionByUserHelper retrieves using UserID
 func (dm *DataManager) GetSessionByUserHelper(id uint) (sesh Session, err error) {
 	err = dm.Where("user_id = ?", id).First(&sesh).Error
 	return
 }
 
+// ResumeSessionHelper retrieves a session for a request made at now and
+// records the activity, sliding its idle timeout forward. Sessions that have
+// ended are deleted and ErrSessionExpired is returned.
+func (dm *DataManager) ResumeSessionHelper(token string, now time.Time) (Session, error) {
+	sesh, err := dm.GetSessionByTokenHelper(token)
+	if err != nil {
+		return sesh, err
+	}
+	if sesh.Expired(now) {
+		if err := dm.DeleteSessionByIdHelper(sesh.ID); err != nil {
+			fmt.Println("dm.DeleteSessionByIdHelper: ", err)
+		}
+		return sesh, ErrSessionExpired
+	}
+	if now.Sub(sesh.LastSeenAt) >= SESSION_RENEW_INTERVAL {
+		if err := dm.Model(&sesh).Update("last_seen_at", now).Error; err != nil {
+			return sesh, err
+		}
+	}
+	return sesh, nil
+}
+
+// DeleteExpiredSessionsHelper deletes every session that has ended by now
+func (dm *DataManager) DeleteExpiredSessionsHelper(now time.Time) error {
+	return dm.Unscoped().Where("expires_at <= ? OR last_seen_at <= ?",
+		now, now.Add(-SESSION_IDLE_TIMEOUT)).Delete(Session{}).Error
+}
+
 // DeleteSessionByIdHelper deletes a single session by id
 func (dm *DataManager) DeleteSessionByIdHelper(id uint) error {
 	return dm.Unscoped().Where("id = ?", id).Delete(Session{}).Error
 }
 
+// DeleteSessionByTokenHelper deletes the session carrying token
+func (dm *DataManager) DeleteSessionByTokenHelper(token string) error {
+	return dm.Unscoped().Where("token_hash = ?", hashToken(token)).Delete(Session{}).Error
+}
+
 // DeleteSessionsByUserHelper delete all sessions for a given UserID
 func (dm *DataManager) DeleteSessionsByUserHelper(id uint) error {
 	return dm.Unscoped().Where("user_id = ?", id).Delete(Session{}).Error
 }
 
-// SessionMiddleware takes a request, checks if it has a cookie,
-// decodes it if it does, then finds the profile associated with the
-// decoded sessionID and attaches it to the context struct, it then
-// calls the next middleware in the chain
-func (dm *DataManager) SessionMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// GetActiveSessionsHelper retrieves the sessions of a user that have not
+// ended by now, most recently used first
+func (dm *DataManager) GetActiveSessionsHelper(userID uint, now time.Time) (sessions []Session, err error) {
+	err = dm.Where("user_id = ? AND expires_at > ? AND last_seen_at > ?",
+		userID, now, now.Add(-SESSION_IDLE_TIMEOUT)).Order("last_seen_at DESC").Find(&sessions).Error
+	return
+}
 
-		cookies := r.Cookies()
-		var seshCookie http.Cookie
+// DeleteUserSessionHelper deletes a session of a user. Returns false if the
+// user has no session with that id.
+func (dm *DataManager) DeleteUserSessionHelper(userID, id uint) (bool, error) {
+	res := dm.Unscoped().Where("id = ? AND user_id = ?", id, userID).Delete(Session{})
+	return res.RowsAffected == 1, res.Error
+}
 
-		switch len(cookies) {
-		case 0:
-			// no cookie present, user must be already logged out
-			next.ServeHTTP(w, r)
-			return
-		case 1:
-			// has cookie
-			seshCookie = *cookies[0]
-		default:
-			fmt.Println("Length of request cookie array is not 0 or 1")
-			http.Error(w, "Error logging user out", http.StatusInternalServerError)
-			return
-		}
+// DeleteOtherSessionsHelper deletes every session of a user except keep
+func (dm *DataManager) DeleteOtherSessionsHelper(userID, keep uint) error {
+	return dm.Unscoped().Where("user_id = ? AND id <> ?", userID, keep).Delete(Session{}).Error
+}
 
-		// Decode cookie
-		seshID, err := dm.DecodeCookieHelper(seshCookie)
-		if err != nil {
-			fmt.Println("dm.DecodeCookieHelper", err)
-			http.Error(w, "Could not get session ID from cookie", http.StatusBadRequest)
+// clearSessionCookie tells the client to discard its session cookies
+func clearSessionCookie(w http.ResponseWriter) {
+	setCookie(w, &http.Cookie{Name: SESSION_COOKIE_NAME, Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureCookies})
+	setCookie(w, &http.Cookie{Name: CSRF_COOKIE_NAME, Path: "/", MaxAge: -1, Secure: secureCookies})
+}
+
+// SessionFromContext returns the session attached to the request context by
+// SessionMiddleware, and false if the request is not authenticated
+func SessionFromContext(r *http.Request) (*Session, bool) {
+	sesh, ok := r.Context().Value("session").(*Session)
+	return sesh, ok && sesh != nil
+}
+
+// ProfileFromContext returns the profile attached to the request context by
+// SessionMiddleware, and false if the request is not authenticated
+func ProfileFromContext(r *http.Request) (*Profile, bool) {
+	profile, ok := r.Context().Value("profile").(*Profile)
+	return profile, ok && profile != nil
+}
+
+// Authenticated wraps handlers that require a logged in user. Requests are
+// passed through SessionMiddleware and rejected with 401 if they do not carry
+// a session, so next can rely on ProfileFromContext.
+func (dm *DataManager) Authenticated(next http.Handler) http.Handler {
+	return dm.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := ProfileFromContext(r); !ok {
+			http.Error(w, "User is not authenticated", http.StatusUnauthorized)
 			return
 		}
+		next.ServeHTTP(w, r)
+	}))
+}
 
-		// Get session record
-		sesh, err := dm.GetSessionByIdHelper(seshID)
-		if err != nil {
-			fmt.Println("dm.GetSessionByIdHelper", err)
-			http.Error(w, "Could not find session with that ID", http.StatusBadRequest)
+// SessionMiddleware takes a request, resolves the session it is made under
+// with AuthenticateRequest, and attaches the session and its user's profile
+// to the context struct, it then calls the next middleware in the chain.
+// Requests without a session pass through anonymously, and requests with a
+// session that does not work are rejected (see writeSessionError).
+func (dm *DataManager) SessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		sesh, profile, err := dm.AuthenticateRequest(r, time.Now())
+		if err == ErrNoSession {
+			// no session present, user must be already logged out
+			next.ServeHTTP(w, r)
 			return
 		}
-
-		// Get user profile for session
-		profile, err := dm.GetProfileByIdHelper(sesh.UserID)
 		if err != nil {
-			fmt.Println("dm.GetProfileByIdHelper")
-			http.Error(w, "Could not find profile with that ID", http.StatusBadRequest)
+			writeSessionError(w, err)
 			return
 		}
 
-		// Remove password for security
-		profile.PwHash = []byte("")
-
 		// Attach user profile to request context
 		// TODO: custom 'key' type for profile to avoid possible
 		// collisions with other packages (recommended by docs)
 		ctx := context.WithValue(r.Context(), "profile", &profile)
+		if sesh.ID != 0 {
+			ctx = context.WithValue(ctx, "session", &sesh)
+		}
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 		return
 	})
 }
+
+/* -------------------------------------------------------------------------- */
+
+// Description of a session for its user, marking the one making the request.
+// Only what helps users recognise their devices is included.
+type sessionListing struct {
+	ID         uint      `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// ListSessions writes the caller's active sessions, most recently used
+// first, to w
+func (dm *DataManager) ListSessions(w http.ResponseWriter, r *http.Request) {
+	caller, ok := ProfileFromContext(r)
+	if !ok {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	current, _ := SessionFromContext(r)
+	sessions, err := dm.GetActiveSessionsHelper(caller.ID, time.Now())
+	if err != nil {
+		fmt.Println("dm.GetActiveSessionsHelper: ", err)
+		http.Error(w, "Database error on session retrieval", http.StatusInternalServerError)
+		return
+	}
+	listings := make([]sessionListing, len(sessions))
+	for i, sesh := range sessions {
+		listings[i] = sessionListing{
+			ID:         sesh.ID,
+			CreatedAt:  sesh.CreatedAt,
+			LastSeenAt: sesh.LastSeenAt,
+			ExpiresAt:  sesh.ExpiresAt,
+			UserAgent:  sesh.UserAgent,
+			IP:         sesh.IP,
+			Current:    current != nil && sesh.ID == current.ID,
+		}
+	}
+	body, err := json.Marshal(listings)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// DeleteSession signs out the caller's session in the URL
+func (dm *DataManager) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	caller, ok := ProfileFromContext(r)
+	if !ok {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+	deleted, err := dm.DeleteUserSessionHelper(caller.ID, uint(id))
+	if err != nil {
+		fmt.Println("dm.DeleteUserSessionHelper: ", err)
+		http.Error(w, "Database error on session delete", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Session does not exist", http.StatusNotFound)
+		return
+	}
+	if current, ok := SessionFromContext(r); ok && current.ID == uint(id) {
+		clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteOtherSessions signs the caller out everywhere except the session
+// making the request
+func (dm *DataManager) DeleteOtherSessions(w http.ResponseWriter, r *http.Request) {
+	caller, ok := ProfileFromContext(r)
+	current, hasSession := SessionFromContext(r)
+	if !ok || !hasSession {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if err := dm.DeleteOtherSessionsHelper(caller.ID, current.ID); err != nil {
+		fmt.Println("dm.DeleteOtherSessionsHelper: ", err)
+		http.Error(w, "Database error on session delete", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// SessionSweeper periodically purges expired sessions, which are otherwise
+// only deleted when their user next makes a request, and expired refresh
+// tokens
+type SessionSweeper struct {
+	dm   *DataManager
+	stop chan bool
+}
+
+func NewSessionSweeper(dm *DataManager) *SessionSweeper {
+	return &SessionSweeper{dm: dm, stop: make(chan bool)}
+}
+
+// Start purges expired sessions and refresh tokens every
+// SESSION_SWEEP_PERIOD until Stop is called
+func (ss *SessionSweeper) Start() {
+	go func() {
+		ticker := time.NewTicker(SESSION_SWEEP_PERIOD)
+		defer ticker.Stop()
+		for {
+			if err := ss.dm.DeleteExpiredSessionsHelper(time.Now()); err != nil {
+				fmt.Println("dm.DeleteExpiredSessionsHelper: ", err)
+			}
+			if err := ss.dm.DeleteExpiredRefreshTokensHelper(time.Now()); err != nil {
+				fmt.Println("dm.DeleteExpiredRefreshTokensHelper: ", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ss.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (ss *SessionSweeper) Stop() {
+	close(ss.stop)
+}
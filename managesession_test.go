@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
@@ -15,10 +18,12 @@ import (
 func TestGetSessionById(t *testing.T) {
 	s := Session{UserID: 1}
 
-	ns := dm.Create(&s).Value
+	if _, err := dm.CreateSessionHelper(&s); err != nil {
+		t.Error("dm.CreateSessionHelper", err)
+	}
 	defer dm.Unscoped().Delete(&s)
 
-	id := (ns.(*Session)).ID
+	id := s.ID
 	if dm.First(&s).RecordNotFound() {
 		t.Error("Record not found")
 	}
@@ -36,7 +41,8 @@ func TestCreateSession(t *testing.T) {
 	sesh := Session{UserID: userID}
 
 	// Create sesh
-	if err := dm.CreateSessionHelper(sesh); err != nil {
+	token, err := dm.CreateSessionHelper(&sesh)
+	if err != nil {
 		t.Error("dm.CreateSessionHelper", err)
 	}
 
@@ -49,6 +55,14 @@ func TestCreateSession(t *testing.T) {
 		assert.Equal(t, sesh.UserID, seshRetrieved.UserID)
 	}
 
+	// and can be found by its token, which is only stored hashed
+	if seshRetrieved, err := dm.GetSessionByTokenHelper(token); err != nil {
+		t.Error("dm.GetSessionByTokenHelper", err)
+	} else {
+		assert.Equal(t, sesh.ID, seshRetrieved.ID)
+		assert.NotEqual(t, token, seshRetrieved.TokenHash)
+	}
+
 }
 
 func TestSessionMiddlewareGood(t *testing.T) {
@@ -56,10 +70,9 @@ func TestSessionMiddlewareGood(t *testing.T) {
 	// Create a profile
 
 	prof := Profile{
-		UserName:    "test_user",
-		CompanyName: "test_company",
-		PwHash:      []byte("1234"),
-		Address:     "1234 lane",
+		UserName:  "test_user",
+		CompanyID: testCompany(t, "test_company").ID,
+		PwHash:    []byte("1234"),
 	}
 
 	if err := dm.Create(&prof).Error; err != nil {
@@ -93,20 +106,21 @@ func TestSessionMiddlewareGood(t *testing.T) {
 	respWithCookie := http.Response{Header: rr.Header()}
 	cookies := respWithCookie.Cookies()
 
-	if len(cookies) != 1 {
-		t.Errorf("Failed to get cookies from login")
+	// the session cookie followed by its CSRF cookie
+	if len(cookies) != 2 {
+		t.Fatalf("Failed to get cookies from login")
 	}
 
 	// Get session so we can defer a delete of it when
 	// test ends
 
-	seshID, err := dm.DecodeCookieHelper(*cookies[0])
+	token, err := dm.DecodeCookieHelper(*cookies[0])
 
 	if err != nil {
 		t.Error("dm.DecodeCookieHelper", err)
 	}
 
-	defer dm.DeleteSessionByIdHelper(seshID)
+	defer dm.DeleteSessionByTokenHelper(token)
 
 	// Set up a mock handler function that will be wrapped by
 	// our session MW and get a reference to the context
@@ -150,8 +164,7 @@ func TestSessionMiddlewareGood(t *testing.T) {
 	// Check profile in context is same as created one
 
 	assert.Equal(t, prof.UserName, ctxProfile.UserName)
-	assert.Equal(t, prof.CompanyName, ctxProfile.CompanyName)
-	assert.Equal(t, prof.Address, ctxProfile.Address)
+	assert.Equal(t, prof.CompanyID, ctxProfile.CompanyID)
 	assert.Equal(t, []byte(""), ctxProfile.PwHash)
 
 }
@@ -197,3 +210,252 @@ func TestSessionMiddlewareNoCookie(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 
 }
+
+func TestAuthenticatedNoSession(t *testing.T) {
+	called := false
+	handler := dm.Authenticated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	req, _ := http.NewRequest("GET", "/webhooks", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.False(t, called)
+}
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Now()
+	sesh := Session{ExpiresAt: now.Add(time.Hour), LastSeenAt: now.Add(-time.Minute)}
+	assert.False(t, sesh.Expired(now))
+	// Idle for too long
+	assert.True(t, sesh.Expired(now.Add(SESSION_IDLE_TIMEOUT)))
+	// Past the absolute expiry, however active
+	sesh.LastSeenAt = now
+	assert.True(t, sesh.Expired(now.Add(time.Hour)))
+	// Sessions from before expiry was recorded
+	assert.True(t, Session{UserID: 1}.Expired(now))
+}
+
+func TestCookieMaxAge(t *testing.T) {
+	cookie, err := dm.CreateCookieHelper("token")
+	assert.Nil(t, err)
+	assert.Equal(t, int(SESSION_LIFETIME/time.Second), cookie.MaxAge)
+}
+
+func TestResumeSession(t *testing.T) {
+	start := time.Now()
+	sesh := Session{UserID: 1, ExpiresAt: start.Add(SESSION_LIFETIME), LastSeenAt: start}
+	token, err := dm.CreateSessionHelper(&sesh)
+	if err != nil {
+		t.Fatal("dm.CreateSessionHelper: ", err)
+	}
+	defer dm.DeleteSessionByIdHelper(sesh.ID)
+
+	// Activity slides the idle timeout forward
+	later := start.Add(SESSION_IDLE_TIMEOUT - time.Minute)
+	_, err = dm.ResumeSessionHelper(token, later)
+	assert.Nil(t, err)
+	later = later.Add(SESSION_IDLE_TIMEOUT - time.Minute)
+	_, err = dm.ResumeSessionHelper(token, later)
+	assert.Nil(t, err)
+
+	// until the session goes idle, when it is deleted
+	_, err = dm.ResumeSessionHelper(token, later.Add(SESSION_IDLE_TIMEOUT))
+	assert.Equal(t, ErrSessionExpired, err)
+	_, err = dm.GetSessionByIdHelper(sesh.ID)
+	assert.NotNil(t, err)
+}
+
+func TestDeleteExpiredSessions(t *testing.T) {
+	now := time.Now()
+	sessions := []Session{
+		{UserID: 1, ExpiresAt: now.Add(time.Hour), LastSeenAt: now},
+		{UserID: 1, ExpiresAt: now.Add(-time.Minute), LastSeenAt: now},
+		{UserID: 1, ExpiresAt: now.Add(time.Hour), LastSeenAt: now.Add(-SESSION_IDLE_TIMEOUT)},
+	}
+	for i := range sessions {
+		if _, err := dm.CreateSessionHelper(&sessions[i]); err != nil {
+			t.Fatal("dm.CreateSessionHelper: ", err)
+		}
+		defer dm.DeleteSessionByIdHelper(sessions[i].ID)
+	}
+
+	assert.Nil(t, dm.DeleteExpiredSessionsHelper(now))
+	_, err := dm.GetSessionByIdHelper(sessions[0].ID)
+	assert.Nil(t, err)
+	for _, sesh := range sessions[1:] {
+		_, err = dm.GetSessionByIdHelper(sesh.ID)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestSessionMiddlewareExpired(t *testing.T) {
+	now := time.Now()
+	sesh := Session{UserID: 1, ExpiresAt: now.Add(-time.Minute), LastSeenAt: now}
+	token, err := dm.CreateSessionHelper(&sesh)
+	if err != nil {
+		t.Fatal("dm.CreateSessionHelper: ", err)
+	}
+	defer dm.DeleteSessionByIdHelper(sesh.ID)
+	cookie, _ := dm.CreateCookieHelper(token)
+
+	called := false
+	handler := dm.SessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&cookie)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.False(t, called)
+	// The client is told to drop the cookie
+	cleared := (&http.Response{Header: rr.Header()}).Cookies()
+	if assert.Equal(t, 2, len(cleared)) {
+		assert.True(t, cleared[0].MaxAge < 0)
+		assert.True(t, cleared[1].MaxAge < 0)
+	}
+}
+
+// withSession adds the cookies of a session to req, and echoes its CSRF
+// token in the header as the web app does
+func withSession(req *http.Request, cookies []*http.Cookie) *http.Request {
+	for _, c := range cookies {
+		req.AddCookie(c)
+		if c.Name == CSRF_COOKIE_NAME {
+			req.Header.Set(CSRF_HEADER, c.Value)
+		}
+	}
+	return req
+}
+
+// sessionRequest serves a request to the session routes with the cookies of
+// a session
+func sessionRequest(method, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/sessions", dm.ListSessions).Methods("GET")
+	router.HandleFunc("/sessions", dm.DeleteOtherSessions).Methods("DELETE")
+	router.HandleFunc("/sessions/{id}", dm.DeleteSession).Methods("DELETE")
+	req, _ := http.NewRequest(method, path, nil)
+	rr := httptest.NewRecorder()
+	dm.SessionMiddleware(router).ServeHTTP(rr, withSession(req, cookies))
+	return rr
+}
+
+// loginFrom starts a session for userID as if logging in from userAgent, and
+// returns the cookies set for it along with its ID
+func loginFrom(t *testing.T, userID uint, userAgent string) ([]*http.Cookie, uint) {
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.Header.Set("User-Agent", userAgent)
+	rr := httptest.NewRecorder()
+	if err := dm.StartSessionHelper(rr, userID, req); err != nil {
+		t.Fatal("dm.StartSessionHelper: ", err)
+	}
+	cookies := (&http.Response{Header: rr.Header()}).Cookies()
+	token, _ := dm.DecodeCookieHelper(*cookies[0])
+	sesh, err := dm.GetSessionByTokenHelper(token)
+	if err != nil {
+		t.Fatal("dm.GetSessionByTokenHelper: ", err)
+	}
+	return cookies, sesh.ID
+}
+
+func TestOtherSessionsRequireSession(t *testing.T) {
+	req, _ := http.NewRequest("DELETE", "/sessions", nil)
+	req = withProfile(req, &Profile{UserName: "api_user", CompanyID: 1})
+	rr := httptest.NewRecorder()
+	dm.DeleteOtherSessions(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestMultipleSessions(t *testing.T) {
+	prof := Profile{UserName: "device_hopper", CompanyID: testCompany(t, "Sift Technologies, Inc.").ID}
+	if err := dm.Create(&prof).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+	defer dm.Unscoped().Delete(&prof)
+	defer dm.DeleteSessionsByUserHelper(prof.ID)
+	laptop, laptopID := loginFrom(t, prof.ID, "Laptop Browser")
+	phone, phoneID := loginFrom(t, prof.ID, "Phone Browser")
+	_, tabletID := loginFrom(t, prof.ID, "Tablet Browser")
+
+	// Logging in on one device keeps the others signed in
+	rr := sessionRequest("GET", "/sessions", laptop)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"user_agent":"Laptop Browser"`)
+	assert.NotContains(t, rr.Body.String(), "UserID")
+	var listings []sessionListing
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &listings))
+	assert.Equal(t, 3, len(listings))
+	for _, l := range listings {
+		assert.Equal(t, l.ID == laptopID, l.Current)
+		assert.Equal(t, "192.0.2.1", l.IP)
+		if l.ID == phoneID {
+			assert.Equal(t, "Phone Browser", l.UserAgent)
+		}
+	}
+
+	// Sessions of other users cannot be revoked
+	_, otherID := loginFrom(t, prof.ID+1, "Someone Else")
+	defer dm.DeleteSessionByIdHelper(otherID)
+	rr = sessionRequest("DELETE", fmt.Sprintf("/sessions/%d", otherID), laptop)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	_, err := dm.GetSessionByIdHelper(otherID)
+	assert.Nil(t, err)
+
+	rr = sessionRequest("DELETE", fmt.Sprintf("/sessions/%d", tabletID), laptop)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	_, err = dm.GetSessionByIdHelper(tabletID)
+	assert.NotNil(t, err)
+
+	// Signing out everywhere else keeps only the current session
+	rr = sessionRequest("DELETE", "/sessions", phone)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	_, err = dm.GetSessionByIdHelper(laptopID)
+	assert.NotNil(t, err)
+	_, err = dm.GetSessionByIdHelper(phoneID)
+	assert.Nil(t, err)
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	oldKey := strings.Repeat("ab", 32)
+	newKey := strings.Repeat("cd", 32) + " " + strings.Repeat("ef", 32)
+	old, err := LoadCookieKeys(strings.NewReader(oldKey + "\n"))
+	if err != nil {
+		t.Fatal("LoadCookieKeys: ", err)
+	}
+	rotated, err := LoadCookieKeys(strings.NewReader("# newest first\n" + newKey + "\n\n" + oldKey + "\n"))
+	if err != nil {
+		t.Fatal("LoadCookieKeys: ", err)
+	}
+	before := &DataManager{db, old}
+	after := &DataManager{db, rotated}
+
+	// Cookies made before the rotation still decode
+	cookie, err := before.CreateCookieHelper("token")
+	assert.Nil(t, err)
+	token, err := after.DecodeCookieHelper(cookie)
+	assert.Nil(t, err)
+	assert.Equal(t, "token", token)
+
+	// while new cookies are made with the new key
+	cookie, err = after.CreateCookieHelper("token")
+	assert.Nil(t, err)
+	_, err = before.DecodeCookieHelper(cookie)
+	assert.NotNil(t, err)
+}
+
+func TestLoadCookieKeysInvalid(t *testing.T) {
+	for _, keys := range []string{
+		"",
+		"# only comments\n",
+		"not-hex",
+		strings.Repeat("ab", 16),
+		strings.Repeat("ab", 32) + " " + strings.Repeat("cd", 10),
+		strings.Repeat("ab", 32) + " " + strings.Repeat("cd", 32) + " extra",
+	} {
+		_, err := LoadCookieKeys(strings.NewReader(keys))
+		assert.NotNil(t, err, keys)
+	}
+}
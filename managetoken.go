@@ -0,0 +1,203 @@
+// Token authentication for clients that do not use cookies: access tokens
+// issued with rotating refresh tokens
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// How long a refresh token can be redeemed for after it is issued. Each
+// refresh issues a new one, so clients in regular use stay signed in.
+const REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+
+// ErrInvalidRefreshToken is returned when redeeming a refresh token that does
+// not exist, has expired, or was already redeemed
+var ErrInvalidRefreshToken = errors.New("refresh token is invalid or has expired")
+
+// Response to a token request, in the form OAuth 2.0 clients expect
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// CreateRefreshTokenHelper issues a refresh token to the user at now and
+// returns it. Only its hash is stored. The token starts a new family if
+// family is blank.
+func (dm *DataManager) CreateRefreshTokenHelper(userID uint, family string, now time.Time) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		if family, err = newToken(); err != nil {
+			return "", err
+		}
+	}
+	rt := RefreshToken{
+		UserID:    userID,
+		Family:    family,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(REFRESH_TOKEN_TTL),
+	}
+	return token, dm.Create(&rt).Error
+}
+
+// RotateRefreshTokenHelper redeems token at now, returning it along with the
+// refresh token that replaces it. Redeeming a token that was already
+// redeemed revokes its family, signing out both the client and whoever
+// copied the token.
+func (dm *DataManager) RotateRefreshTokenHelper(token string, now time.Time) (RefreshToken, string, error) {
+	var rt RefreshToken
+	err := dm.Where("token_hash = ?", hashToken(token)).First(&rt).Error
+	if err == gorm.ErrRecordNotFound || (err == nil && !now.Before(rt.ExpiresAt)) {
+		return rt, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return rt, "", err
+	}
+	res := dm.Model(&RefreshToken{}).Where("id = ? AND used_at IS NULL", rt.ID).Update("used_at", now)
+	if res.Error != nil {
+		return rt, "", res.Error
+	}
+	if res.RowsAffected != 1 {
+		if err := dm.RevokeRefreshFamilyHelper(rt.Family); err != nil {
+			return rt, "", err
+		}
+		return rt, "", ErrInvalidRefreshToken
+	}
+	next, err := dm.CreateRefreshTokenHelper(rt.UserID, rt.Family, now)
+	return rt, next, err
+}
+
+// RevokeRefreshFamilyHelper deletes every refresh token of a family
+func (dm *DataManager) RevokeRefreshFamilyHelper(family string) error {
+	return dm.Unscoped().Where("family = ?", family).Delete(RefreshToken{}).Error
+}
+
+// DeleteRefreshTokensByUserHelper deletes all refresh tokens of a user
+func (dm *DataManager) DeleteRefreshTokensByUserHelper(userID uint) error {
+	return dm.Unscoped().Where("user_id = ?", userID).Delete(RefreshToken{}).Error
+}
+
+// DeleteExpiredRefreshTokensHelper deletes refresh tokens that have expired
+// by now. Redeemed tokens are kept until then so that reuse is detected.
+func (dm *DataManager) DeleteExpiredRefreshTokensHelper(now time.Time) error {
+	return dm.Unscoped().Where("expires_at <= ?", now).Delete(RefreshToken{}).Error
+}
+
+/* -------------------------------------------------------------------------- */
+
+// IssueToken issues an access token and a refresh token. With the
+// `grant_type` form value "password" the user signs in with the same
+// credentials as Login; with "refresh_token" the `refresh_token` form value
+// is redeemed for a new pair. Users with two-factor authentication also give
+// an `otp` or `recovery_code` with their password. Access tokens are sent in
+// an `Authorization: Bearer` header and accepted wherever sessions are.
+func (dm *DataManager) IssueToken(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var profile Profile
+	var refresh string
+	var err error
+	switch r.FormValue("grant_type") {
+	case "password":
+		name := r.FormValue("user_name")
+		company := r.FormValue("company_name")
+		pass := passwordFromRequest(r)
+		if name == "" || company == "" || pass == "" {
+			http.Error(w, "One or more credentials were blank", http.StatusBadRequest)
+			return
+		}
+		if !dm.UserPwAuthSuccess(name, company, pass) {
+			http.Error(w, "Failed authentication", http.StatusUnauthorized)
+			return
+		}
+		if profile, err = dm.GetProfileHelper(name, company); err != nil {
+			fmt.Println("dm.GetProfileHelper: ", err)
+			http.Error(w, "Database error on profile retrieval", http.StatusInternalServerError)
+			return
+		}
+		if profile.TwoFactorEnabled && !dm.checkSecondFactor(w, profile,
+			r.FormValue("otp"), r.FormValue("recovery_code"), http.StatusUnauthorized) {
+			return
+		}
+		if refresh, err = dm.CreateRefreshTokenHelper(profile.ID, "", now); err != nil {
+			fmt.Println("dm.CreateRefreshTokenHelper: ", err)
+			http.Error(w, "Database error on token creation", http.StatusInternalServerError)
+			return
+		}
+	case "refresh_token":
+		var rt RefreshToken
+		rt, refresh, err = dm.RotateRefreshTokenHelper(r.FormValue("refresh_token"), now)
+		if err == ErrInvalidRefreshToken {
+			http.Error(w, "Refresh token is invalid or has expired", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			fmt.Println("dm.RotateRefreshTokenHelper: ", err)
+			http.Error(w, "Database error on token refresh", http.StatusInternalServerError)
+			return
+		}
+		if profile, err = dm.GetProfileByIdHelper(rt.UserID); err == gorm.ErrRecordNotFound {
+			http.Error(w, "Refresh token is invalid or has expired", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			fmt.Println("dm.GetProfileByIdHelper: ", err)
+			http.Error(w, "Database error on profile retrieval", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "grant_type must be password or refresh_token", http.StatusBadRequest)
+		return
+	}
+	access, err := NewAccessToken(profile, now)
+	if err != nil {
+		fmt.Println("NewAccessToken: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(ACCESS_TOKEN_TTL / time.Second),
+		RefreshToken: refresh,
+	})
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+// RevokeToken signs a token client out by revoking the family of the
+// `refresh_token` form value. Access tokens already issued expire on their
+// own within ACCESS_TOKEN_TTL. Unknown tokens are ignored.
+func (dm *DataManager) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("refresh_token")
+	if token == "" {
+		http.Error(w, "refresh_token must not be blank", http.StatusBadRequest)
+		return
+	}
+	var rt RefreshToken
+	err := dm.Where("token_hash = ?", hashToken(token)).First(&rt).Error
+	if err == nil {
+		err = dm.RevokeRefreshFamilyHelper(rt.Family)
+	}
+	if err != nil && err != gorm.ErrRecordNotFound {
+		fmt.Println("dm.RevokeRefreshFamilyHelper: ", err)
+		http.Error(w, "Database error on token revocation", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
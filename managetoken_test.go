@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tokenRequest serves a token request with form
+func tokenRequest(form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.IssueToken).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIssueTokenRejected(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, tokenRequest(url.Values{"grant_type": {"client_credentials"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, tokenRequest(url.Values{"grant_type": {"password"}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest(url.Values{
+		"grant_type": {"refresh_token"}, "refresh_token": {"unknown"}}).Code)
+}
+
+func TestIssueToken(t *testing.T) {
+	company := testCompany(t, "Token Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	hash, _ := HashPassword("correct horse battery staple")
+	prof := Profile{UserName: "token_user", CompanyID: company.ID, PwHash: hash, Role: ROLE_ANALYST}
+	if err := dm.Create(&prof).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+
+	rr := tokenRequest(url.Values{
+		"grant_type":   {"password"},
+		"user_name":    {"token_user"},
+		"company_name": {"Token Co"},
+		"pw_hash":      {"wrong"},
+	})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = tokenRequest(url.Values{
+		"grant_type":   {"password"},
+		"user_name":    {"token_user"},
+		"company_name": {"Token Co"},
+		"pw_hash":      {"correct horse battery staple"},
+	})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var first tokenResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &first))
+	assert.Equal(t, "Bearer", first.TokenType)
+	assert.Equal(t, int(ACCESS_TOKEN_TTL/time.Second), first.ExpiresIn)
+	assert.NotEmpty(t, first.RefreshToken)
+
+	// Access tokens authenticate as the user, without a session
+	req, _ := http.NewRequest("GET", "/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+first.AccessToken)
+	sesh, profile, err := dm.AuthenticateRequest(req, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), sesh.ID)
+	assert.Equal(t, prof.ID, profile.ID)
+	assert.Equal(t, ROLE_ANALYST, profile.Role)
+	assert.Equal(t, 0, len(profile.PwHash))
+	_, _, err = dm.AuthenticateRequest(req, time.Now().Add(ACCESS_TOKEN_TTL))
+	assert.Equal(t, ErrAccessTokenExpired, err)
+
+	rr = httptest.NewRecorder()
+	dm.Authenticated(http.HandlerFunc(dm.ListSessions)).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Refreshing replaces the refresh token
+	refresh := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}}
+	rr = tokenRequest(refresh)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var second tokenResponse
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &second))
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	// Redeeming the old one again revokes its replacement too
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest(refresh).Code)
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest(url.Values{
+		"grant_type": {"refresh_token"}, "refresh_token": {second.RefreshToken}}).Code)
+}
+
+func TestRevokeToken(t *testing.T) {
+	company := testCompany(t, "Token Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	prof := Profile{UserName: "token_user", CompanyID: company.ID}
+	if err := dm.Create(&prof).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+	now := time.Now()
+	token, err := dm.CreateRefreshTokenHelper(prof.ID, "", now)
+	if err != nil {
+		t.Fatal("dm.CreateRefreshTokenHelper: ", err)
+	}
+
+	req, _ := http.NewRequest("POST", "/auth/revoke", strings.NewReader(url.Values{"refresh_token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.RevokeToken).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	_, _, err = dm.RotateRefreshTokenHelper(token, now)
+	assert.Equal(t, ErrInvalidRefreshToken, err)
+
+	// Expired tokens are refused and swept
+	token, _ = dm.CreateRefreshTokenHelper(prof.ID, "", now.Add(-REFRESH_TOKEN_TTL))
+	_, _, err = dm.RotateRefreshTokenHelper(token, now)
+	assert.Equal(t, ErrInvalidRefreshToken, err)
+	assert.Nil(t, dm.DeleteExpiredRefreshTokensHelper(now))
+	var count int
+	dm.Model(&RefreshToken{}).Where("user_id = ?", prof.ID).Count(&count)
+	assert.Equal(t, 0, count)
+}
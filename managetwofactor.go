@@ -0,0 +1,375 @@
+// Two-factor authentication with TOTP codes and single-use recovery codes
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	// Recovery codes issued at once, replacing any earlier ones
+	RECOVERY_CODE_COUNT = 10
+	// How long users have to give their second factor after their password
+	TWO_FACTOR_LOGIN_TTL = 5 * time.Minute
+	// Second factor attempts allowed per user in TWO_FACTOR_ATTEMPT_WINDOW,
+	// so that codes cannot be guessed
+	TWO_FACTOR_ATTEMPTS       = 5
+	TWO_FACTOR_ATTEMPT_WINDOW = 15 * time.Minute
+)
+
+var twoFactorLimit = NewRateLimiter(TWO_FACTOR_ATTEMPTS, TWO_FACTOR_ATTEMPT_WINDOW)
+
+// Response to a login with a correct password by a user with two-factor
+// authentication, who finishes at /login/2fa with the token
+type twoFactorChallenge struct {
+	TwoFactorToken string `json:"two_factor_token"`
+}
+
+// Response to starting enrollment. URI is usually shown as a QR code.
+type twoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// Response listing new recovery codes, which are only ever shown here
+type recoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// newRecoveryCode returns a random code of the form xxxx-xxxx-xxxx
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	h := hex.EncodeToString(b)
+	return h[:4] + "-" + h[4:8] + "-" + h[8:], nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes without dashes or in
+// upper case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// TwoFactorRequiredHelper reports whether p's company requires p to use
+// two-factor authentication, as it may for admins and owners
+func (dm *DataManager) TwoFactorRequiredHelper(p Profile) (bool, error) {
+	if p.ViaAPIKey() || !roleOutranks(p.Role, ROLE_ANALYST) {
+		return false, nil
+	}
+	c, err := dm.GetCompanyHelper(p.CompanyID)
+	return c.RequireTwoFactor, err
+}
+
+// SetTwoFactorHelper updates the two-factor columns of a profile
+func (dm *DataManager) SetTwoFactorHelper(userID uint, enabled bool, secret string) error {
+	return dm.Model(&Profile{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"two_factor_enabled": enabled,
+		"totp_secret":        secret,
+		"totp_last_step":     0,
+	}).Error
+}
+
+// AcceptTOTPHelper checks a TOTP code of p at now, recording it so that it
+// cannot be used again
+func (dm *DataManager) AcceptTOTPHelper(p Profile, code string, now time.Time) (bool, error) {
+	step, ok := VerifyTOTP(p.TOTPSecret, code, now, p.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	res := dm.Model(&Profile{}).Where("id = ? AND totp_last_step < ?", p.ID, step).UpdateColumn("totp_last_step", step)
+	return res.RowsAffected == 1, res.Error
+}
+
+// ReplaceRecoveryCodesHelper issues new recovery codes to a user, revoking
+// any earlier ones, and returns them. Only their hashes are stored.
+func (dm *DataManager) ReplaceRecoveryCodesHelper(userID uint) ([]string, error) {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	tx := dm.Begin()
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(RecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err == nil {
+			err = tx.Create(&RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, tx.Commit().Error
+}
+
+// ConsumeRecoveryCodeHelper redeems one of a user's recovery codes. Returns
+// false if the user has no such unused code.
+func (dm *DataManager) ConsumeRecoveryCodeHelper(userID uint, code string) (bool, error) {
+	res := dm.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	return res.RowsAffected >= 1, res.Error
+}
+
+// DeleteRecoveryCodesHelper deletes all recovery codes of a user
+func (dm *DataManager) DeleteRecoveryCodesHelper(userID uint) error {
+	return dm.Unscoped().Where("user_id = ?", userID).Delete(RecoveryCode{}).Error
+}
+
+// VerifySecondFactorHelper checks otp, or if it is blank recovery, as the
+// second factor of p at now. Either is used up if correct.
+func (dm *DataManager) VerifySecondFactorHelper(p Profile, otp, recovery string, now time.Time) (bool, error) {
+	if otp != "" {
+		return dm.AcceptTOTPHelper(p, otp, now)
+	}
+	return dm.ConsumeRecoveryCodeHelper(p.ID, recovery)
+}
+
+// TwoFactorLoginTokenHelper returns the token a user who gave their password
+// at now presents with their second factor. It is signed like session
+// cookies, so it needs no storage, and expires after TWO_FACTOR_LOGIN_TTL.
+func (dm *DataManager) TwoFactorLoginTokenHelper(userID uint, now time.Time) (string, error) {
+	return securecookie.EncodeMulti("two_factor", map[string]string{
+		"user":    strconv.FormatUint(uint64(userID), 10),
+		"expires": strconv.FormatInt(now.Add(TWO_FACTOR_LOGIN_TTL).Unix(), 10),
+	}, dm.Cookies...)
+}
+
+// parseTwoFactorLoginToken returns the user a token from
+// TwoFactorLoginTokenHelper was issued to, if it has not expired by now
+func (dm *DataManager) parseTwoFactorLoginToken(token string, now time.Time) (uint, bool) {
+	var value map[string]string
+	if err := securecookie.DecodeMulti("two_factor", token, &value, dm.Cookies...); err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(value["expires"], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(value["user"], 10, 32)
+	return uint(id), err == nil && id != 0
+}
+
+// checkSecondFactor verifies otp, or if it is blank recovery, as p's second
+// factor, as given in the `otp` and `recovery_code` form values. Otherwise
+// it writes an error to w, with failStatus if the code is missing or wrong,
+// and returns false.
+func (dm *DataManager) checkSecondFactor(w http.ResponseWriter, p Profile, otp, recovery string, failStatus int) bool {
+	if otp == "" && recovery == "" {
+		http.Error(w, "Two-factor code required", failStatus)
+		return false
+	}
+	if !twoFactorLimit.Allow(strconv.FormatUint(uint64(p.ID), 10)) {
+		http.Error(w, "Too many two-factor attempts, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	ok, err := dm.VerifySecondFactorHelper(p, otp, recovery, time.Now())
+	if err != nil {
+		fmt.Println("dm.VerifySecondFactorHelper: ", err)
+		http.Error(w, "Database error on two-factor verification", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Invalid two-factor code", failStatus)
+		return false
+	}
+	return true
+}
+
+// twoFactorCaller returns the user making r, writing an error to w if there
+// is none or r was made with an API key, which have no second factor
+func twoFactorCaller(w http.ResponseWriter, r *http.Request) (*Profile, bool) {
+	caller, ok := ProfileFromContext(r)
+	if !ok {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return nil, false
+	}
+	if caller.ViaAPIKey() {
+		http.Error(w, "API keys cannot use two-factor authentication", http.StatusForbidden)
+		return nil, false
+	}
+	return caller, true
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	body, err := json.Marshal(recoveryCodes{codes})
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// LoginTwoFactor finishes a login by a user with two-factor authentication,
+// taking the `two_factor_token` Login gave them and their `otp` or
+// `recovery_code`. It then creates a session as Login does.
+func (dm *DataManager) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, ok := dm.parseTwoFactorLoginToken(r.FormValue("two_factor_token"), time.Now())
+	if !ok {
+		http.Error(w, "Login has expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	profile, err := dm.GetProfileByIdHelper(userID)
+	if err != nil || !profile.TwoFactorEnabled {
+		http.Error(w, "Login has expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	if !dm.checkSecondFactor(w, profile, r.FormValue("otp"), r.FormValue("recovery_code"), http.StatusUnauthorized) {
+		return
+	}
+	if err = dm.StartSessionHelper(w, profile.ID, r); err != nil {
+		fmt.Println("dm.StartSessionHelper", err)
+		http.Error(w, "Database error on creating new session for login", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
+
+// EnrollTwoFactor starts enrolling the caller in two-factor authentication
+// with a new secret, and writes it to w along with its otpauth URI.
+// Enrollment finishes once ConfirmTwoFactor is given a code from it.
+func (dm *DataManager) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller, ok := twoFactorCaller(w, r)
+	if !ok {
+		return
+	}
+	if caller.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	company, err := dm.GetCompanyHelper(caller.CompanyID)
+	if err != nil {
+		fmt.Println("dm.GetCompanyHelper: ", err)
+		http.Error(w, "Database error on company retrieval", http.StatusInternalServerError)
+		return
+	}
+	secret, err := NewTOTPSecret()
+	if err == nil {
+		err = dm.SetTwoFactorHelper(caller.ID, false, secret)
+	}
+	if err != nil {
+		fmt.Println("dm.SetTwoFactorHelper: ", err)
+		http.Error(w, "Database error on two-factor enrollment", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(twoFactorEnrollment{secret, TOTPURI(secret, caller.UserName+"@"+company.Name)})
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
+
+// ConfirmTwoFactor enables two-factor authentication for the caller once the
+// `otp` form value is a code from the secret EnrollTwoFactor gave them, and
+// writes their recovery codes to w
+func (dm *DataManager) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller, ok := twoFactorCaller(w, r)
+	if !ok {
+		return
+	}
+	if caller.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if caller.TOTPSecret == "" {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusBadRequest)
+		return
+	}
+	// Only a code proves the secret was enrolled
+	if !dm.checkSecondFactor(w, *caller, r.FormValue("otp"), "", http.StatusForbidden) {
+		return
+	}
+	if err := dm.Model(&Profile{}).Where("id = ?", caller.ID).UpdateColumn("two_factor_enabled", true).Error; err != nil {
+		fmt.Println("dm.UpdateColumn: ", err)
+		http.Error(w, "Database error on two-factor enrollment", http.StatusInternalServerError)
+		return
+	}
+	codes, err := dm.ReplaceRecoveryCodesHelper(caller.ID)
+	if err != nil {
+		fmt.Println("dm.ReplaceRecoveryCodesHelper: ", err)
+		http.Error(w, "Database error on recovery code creation", http.StatusInternalServerError)
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
+
+// DisableTwoFactor turns off two-factor authentication for the caller, who
+// must give an `otp` or `recovery_code`. Admins whose company requires
+// two-factor authentication cannot turn it off.
+func (dm *DataManager) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	caller, ok := twoFactorCaller(w, r)
+	if !ok {
+		return
+	}
+	if !caller.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	required, err := dm.TwoFactorRequiredHelper(*caller)
+	if err != nil {
+		fmt.Println("dm.TwoFactorRequiredHelper: ", err)
+		http.Error(w, "Database error on company retrieval", http.StatusInternalServerError)
+		return
+	}
+	if required {
+		http.Error(w, "Your company requires two-factor authentication", http.StatusForbidden)
+		return
+	}
+	if !dm.checkSecondFactor(w, *caller, r.FormValue("otp"), r.FormValue("recovery_code"), http.StatusForbidden) {
+		return
+	}
+	if err := dm.SetTwoFactorHelper(caller.ID, false, ""); err != nil {
+		fmt.Println("dm.SetTwoFactorHelper: ", err)
+		http.Error(w, "Database error on disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := dm.DeleteRecoveryCodesHelper(caller.ID); err != nil {
+		fmt.Println("dm.DeleteRecoveryCodesHelper: ", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes, once they give
+// an `otp` or `recovery_code`, and writes the new ones to w
+func (dm *DataManager) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	caller, ok := twoFactorCaller(w, r)
+	if !ok {
+		return
+	}
+	if !caller.TwoFactorEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	if !dm.checkSecondFactor(w, *caller, r.FormValue("otp"), r.FormValue("recovery_code"), http.StatusForbidden) {
+		return
+	}
+	codes, err := dm.ReplaceRecoveryCodesHelper(caller.ID)
+	if err != nil {
+		fmt.Println("dm.ReplaceRecoveryCodesHelper: ", err)
+		http.Error(w, "Database error on recovery code creation", http.StatusInternalServerError)
+		return
+	}
+	writeRecoveryCodes(w, codes)
+}
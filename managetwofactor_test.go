@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// twoFactorRequest serves a form request to handler as caller
+func twoFactorRequest(handler http.HandlerFunc, caller *Profile, method string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/profile/2fa", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if caller != nil {
+		req = withProfile(req, caller)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTwoFactorLoginToken(t *testing.T) {
+	now := time.Now()
+	token, err := dm.TwoFactorLoginTokenHelper(42, now)
+	assert.Nil(t, err)
+	id, ok := dm.parseTwoFactorLoginToken(token, now)
+	assert.True(t, ok)
+	assert.Equal(t, uint(42), id)
+	_, ok = dm.parseTwoFactorLoginToken(token, now.Add(TWO_FACTOR_LOGIN_TTL))
+	assert.False(t, ok)
+	_, ok = dm.parseTwoFactorLoginToken("forged", now)
+	assert.False(t, ok)
+	// Session cookies are no use as login tokens
+	cookie, _ := dm.CreateCookieHelper("token")
+	_, ok = dm.parseTwoFactorLoginToken(cookie.Value, now)
+	assert.False(t, ok)
+}
+
+func TestTwoFactorResponseFields(t *testing.T) {
+	body, _ := json.Marshal(twoFactorChallenge{"t"})
+	assert.Equal(t, `{"two_factor_token":"t"}`, string(body))
+	body, _ = json.Marshal(twoFactorEnrollment{"s", "u"})
+	assert.Equal(t, `{"secret":"s","uri":"u"}`, string(body))
+	body, _ = json.Marshal(recoveryCodes{[]string{"c"}})
+	assert.Equal(t, `{"recovery_codes":["c"]}`, string(body))
+}
+
+func TestMustEnrollTwoFactor(t *testing.T) {
+	admin := &Profile{UserName: "admin", Role: ROLE_ADMIN, MustEnrollTwoFactor: true}
+	assert.False(t, HasPermission(admin, PERM_VIEW_DATA))
+
+	req, _ := http.NewRequest("GET", "/schedules", nil)
+	rr := httptest.NewRecorder()
+	_, ok := RequirePermission(rr, withProfile(req, admin), PERM_VIEW_DATA)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "two-factor")
+
+	assert.Equal(t, "abcd1234ef56", normalizeRecoveryCode("ABCD-1234-ef56"))
+	assert.Equal(t, http.StatusForbidden, twoFactorRequest(dm.EnrollTwoFactor,
+		&Profile{Scopes: []Permission{PERM_VIEW_DATA}}, "POST", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, twoFactorRequest(dm.EnrollTwoFactor, nil, "POST", nil).Code)
+}
+
+func TestTwoFactor(t *testing.T) {
+	company := testCompany(t, "Two Factor Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	hash, _ := HashPassword("correct horse battery staple")
+	prof := Profile{UserName: "owner", CompanyID: company.ID, PwHash: hash, Role: ROLE_OWNER}
+	if err := dm.Create(&prof).Error; err != nil {
+		t.Fatal("Creation of profile failed with err: ", err)
+	}
+	current := func() *Profile {
+		p, _ := dm.GetProfileByIdHelper(prof.ID)
+		return &p
+	}
+
+	// Enrollment finishes with a code from the new secret
+	rr := twoFactorRequest(dm.EnrollTwoFactor, current(), "POST", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var enrollment twoFactorEnrollment
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &enrollment))
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	assert.Equal(t, http.StatusForbidden, twoFactorRequest(dm.ConfirmTwoFactor, current(), "POST",
+		url.Values{"otp": {"000000"}}).Code)
+	code, _ := TOTPCode(enrollment.Secret, time.Now())
+	rr = twoFactorRequest(dm.ConfirmTwoFactor, current(), "POST", url.Values{"otp": {code}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var codes recoveryCodes
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &codes))
+	assert.Equal(t, RECOVERY_CODE_COUNT, len(codes.RecoveryCodes))
+	assert.True(t, current().TwoFactorEnabled)
+
+	// Passwords alone no longer sign in
+	login := url.Values{
+		"user_name":    {"owner"},
+		"company_name": {"Two Factor Co"},
+		"pw_hash":      {"correct horse battery staple"},
+	}
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(login.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(dm.Login).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 0, len(rr.Header()["Set-Cookie"]))
+	var challenge twoFactorChallenge
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &challenge))
+
+	// A recovery code finishes signing in, but only once
+	second := url.Values{"two_factor_token": {challenge.TwoFactorToken}, "recovery_code": {codes.RecoveryCodes[0]}}
+	rr = twoFactorRequest(dm.LoginTwoFactor, nil, "POST", second)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, 2, len(rr.Header()["Set-Cookie"]))
+	rr = twoFactorRequest(dm.LoginTwoFactor, nil, "POST", second)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Token clients give their code with their password
+	login.Set("grant_type", "password")
+	assert.Equal(t, http.StatusUnauthorized, tokenRequest(login).Code)
+	login.Set("recovery_code", strings.ToUpper(codes.RecoveryCodes[1]))
+	assert.Equal(t, http.StatusOK, tokenRequest(login).Code)
+
+	// Once the company requires it, admins without it hold no permissions
+	dm.Model(&company).UpdateColumn("require_two_factor", true)
+	admin := Profile{UserName: "admin", CompanyID: company.ID, Role: ROLE_ADMIN}
+	analyst := Profile{UserName: "analyst", CompanyID: company.ID, Role: ROLE_ANALYST}
+	dm.Create(&admin)
+	dm.Create(&analyst)
+	p, err := dm.requestProfile(admin.ID)
+	assert.Nil(t, err)
+	assert.True(t, p.MustEnrollTwoFactor)
+	p, err = dm.requestProfile(analyst.ID)
+	assert.Nil(t, err)
+	assert.False(t, p.MustEnrollTwoFactor)
+	p, err = dm.requestProfile(prof.ID)
+	assert.Nil(t, err)
+	assert.False(t, p.MustEnrollTwoFactor)
+
+	// and those with it cannot turn it off
+	assert.Equal(t, http.StatusForbidden, twoFactorRequest(dm.DisableTwoFactor, current(), "DELETE",
+		url.Values{"recovery_code": {codes.RecoveryCodes[2]}}).Code)
+	dm.Model(&company).UpdateColumn("require_two_factor", false)
+	assert.Equal(t, http.StatusNoContent, twoFactorRequest(dm.DisableTwoFactor, current(), "DELETE",
+		url.Values{"recovery_code": {codes.RecoveryCodes[2]}}).Code)
+	assert.False(t, current().TwoFactorEnabled)
+	assert.Equal(t, "", current().TOTPSecret)
+}
@@ -4,23 +4,79 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"strings"
 
-	"github.com/gorilla/securecookie"
+	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
+// Reasons UpdateProfileHelper refuses an update. UpdateExistingProfile
+// answers ErrUserNameTaken with 409 and the others with 400.
+var (
+	ErrCompanyIDFixed    = errors.New("company_id cannot be changed.")
+	ErrUserNameTaken     = errors.New("user_name already exists in this company")
+	ErrInvalidEmail      = errors.New("email is not a valid address")
+	ErrInvalidProfileKey = errors.New("Provided field is invalid.")
+)
+
 /* ----------------------------- HELPER METHODS ----------------------------- */
 
-// Tests if user exists already. Returns true if the combination of user_name
-// and company_name is already taken, false otherwise. Assumes un and cn are not
-// empty strings.
-func (dm *DataManager) userExists(un, cn string) bool {
-	qstring := "user_name = ? AND company_name = ?"
-	return !dm.Where(qstring, un, cn).First(&Profile{}).RecordNotFound()
+// Tests if user exists already. Returns true if user_name is already taken
+// in the company, false otherwise. Assumes un is not an empty string.
+func (t *TenantDB) userExists(un string) bool {
+	return !t.Query(&Profile{}).Where("user_name = ?", un).First(&Profile{}).RecordNotFound()
+}
+
+// Checks that an email is a single bare address, ex. "sifter@sift.com"
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// canAccessProfile reports whether caller may read or modify the profile of
+// user un at the company with the given ID. Users may access their own
+// profile, and users who can manage profiles any profile in their company.
+func canAccessProfile(caller *Profile, un string, companyID uint) bool {
+	if caller.CompanyID != companyID {
+		return false
+	}
+	return caller.UserName == un || HasPermission(caller, PERM_MANAGE_PROFILES)
+}
+
+// Checks that the caller attached to r by SessionMiddleware may access the
+// profile of user un at company cn, and writes an error to w if not. This is
+// done before checking that the user exists so callers cannot probe for
+// other companies' users. Profiles of users who outrank the caller cannot be
+// accessed, and when modify is set neither can profiles of users of the
+// same rank, who could otherwise be taken over by changing their email and
+// resetting their password. Returns a TenantDB for the caller's company.
+func (dm *DataManager) authorizeProfileAccess(w http.ResponseWriter, r *http.Request, un, cn string, modify bool) (*TenantDB, bool) {
+	caller, ok := ProfileFromContext(r)
+	if !ok {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return nil, false
+	}
+	company, err := dm.GetCompanyByNameHelper(cn)
+	if err != nil || !canAccessProfile(caller, un, company.ID) {
+		http.Error(w, "Not allowed to access this profile", http.StatusForbidden)
+		return nil, false
+	}
+	tenant := dm.ForCompany(caller.CompanyID)
+	// Admins cannot manage the profiles of users who outrank them, nor change
+	// those of other admins
+	if caller.UserName != un {
+		if target, err := tenant.GetProfileHelper(un); err == nil &&
+			(roleOutranks(target.Role, caller.Role) || (modify && !roleOutranks(caller.Role, target.Role))) {
+			http.Error(w, "Not allowed to access this profile", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	return tenant, true
 }
 
 // Helper to extract company_name and user_name from requests to resources with
@@ -39,12 +95,22 @@ func parseProfileQuery(path string) []string {
 	return resources
 }
 
-// Queries db for user profile matching user_name and company_name.
-// Assumes un, cn, and pwh are not empty strings or nil.
+// Queries db for user profile matching user_name and the name of the user's
+// company, for use before the user is logged in. Assumes un and cn are not
+// empty strings.
 func (dm *DataManager) GetProfileHelper(un, cn string) (Profile, error) {
+	company, err := dm.GetCompanyByNameHelper(cn)
+	if err != nil {
+		return Profile{}, err
+	}
+	return dm.ForCompany(company.ID).GetProfileHelper(un)
+}
+
+// Queries db for the profile of the company's user with user_name un.
+// Assumes un is not an empty string.
+func (t *TenantDB) GetProfileHelper(un string) (Profile, error) {
 	var prof Profile
-	qstring := "user_name = ? AND company_name = ?"
-	if err := dm.Where(qstring, un, cn).First(&prof).Error; err != nil {
+	if err := t.Query(&Profile{}).Where("user_name = ?", un).First(&prof).Error; err != nil {
 		return Profile{}, err
 	}
 	return prof, nil
@@ -61,47 +127,123 @@ func (dm *DataManager) GetProfileByIdHelper(id uint) (Profile, error) {
 	return prof, nil
 }
 
-// Authenticates users by company_name, user_name, and pw_hash. Returns true if
-// record is found and fields match, false otherwise. If false, user did not enter
-// the correct credentials.
-func (dm *DataManager) UserPwAuthSuccess(un, cn string, pwh []byte) bool {
-	qstring := "user_name = ? AND company_name = ? AND pw_hash = ?"
-	return !dm.Where(qstring, un, cn, pwh).First(&Profile{}).RecordNotFound()
+// Authenticates users by company_name, user_name, and plaintext password.
+// Returns true if the user exists and the password matches their stored hash,
+// false otherwise. Legacy unhashed passwords are rehashed on success.
+func (dm *DataManager) UserPwAuthSuccess(un, cn, pw string) bool {
+	prof, err := dm.GetProfileHelper(un, cn)
+	if err != nil {
+		// Spend as long as a real comparison would to avoid revealing
+		// whether the user exists
+		VerifyPassword(dummyPasswordHash, pw)
+		return false
+	}
+	ok, rehash := VerifyPassword(prof.PwHash, pw)
+	if ok && rehash {
+		if err := dm.ForCompany(prof.CompanyID).UpdateProfileHelper(prof, "password", pw); err != nil {
+			// The login is still valid, so try again next time
+			fmt.Println("dm.UpdateProfileHelper: ", err)
+		}
+	}
+	return ok
 }
 
 // Updates given use field based on field name, which must be one of {user_name,
-// company_name, company_address, pw_hash}. Can be used for changing passwords.
-// Assumes user is already logged in.
-// NOTE: Validation of password strength when changing passwords should occur in frontend
-func (dm *DataManager) UpdateProfileHelper(un, cn, key string, val interface{}) error {
+// email, password}. Can be used for changing passwords, in which case val is
+// the plaintext password and is stored hashed. Company details are changed
+// through UpdateCompany. Assumes user is already logged in.
+// NOTE: Password strength is not checked here, see passwordPolicy
+func (t *TenantDB) UpdateProfileHelper(prof Profile, key string, val interface{}) error {
 	switch key {
-	case "company_name":
-		// company_name is final and cannot be updated
-		return errors.New("company_name cannot be changed.")
+	case "company_id":
+		// Users cannot move between companies
+		return ErrCompanyIDFixed
 	case "user_name":
-		// A user cannot change their user_name to conflict with an existing
-		// user_name/company_name combination
-		if dm.userExists(val.(string), cn) {
-			return errors.New("user_name and company_name combination already exists")
+		// A user cannot change their user_name to one already taken in their
+		// company
+		if val.(string) != prof.UserName && t.userExists(val.(string)) {
+			return ErrUserNameTaken
+		}
+	case "email":
+		if !validEmail(val.(string)) {
+			return ErrInvalidEmail
 		}
-	case "company_address":
-	case "pw_hash":
+	case "password":
+		hash, err := HashPassword(val.(string))
+		if err != nil {
+			return err
+		}
+		key, val = "pw_hash", hash
 	default:
-		return errors.New("Provided field is invalid.")
+		return ErrInvalidProfileKey
 	}
-	qstring := "user_name = ? AND company_name = ?"
-	if err := dm.Model(&Profile{}).Where(qstring, un, cn).Update(key, val).Error; err != nil {
+	if err := t.Query(&Profile{}).Where("id = ?", prof.ID).Update(key, val).Error; err != nil {
 		return err
 	}
 	return nil
 }
 
+// Reports whether pw matches the user's current password or one of their
+// recent previous passwords
+func (dm *DataManager) passwordReused(prof Profile, pw string) bool {
+	if ok, _ := VerifyPassword(prof.PwHash, pw); ok {
+		return true
+	}
+	var history []PasswordHistory
+	err := dm.Where("user_id = ?", prof.ID).Order("id desc").Limit(PASSWORD_HISTORY_SIZE - 1).Find(&history).Error
+	if err != nil {
+		fmt.Println("dm.Find: ", err)
+		return false
+	}
+	for _, h := range history {
+		if ok, _ := VerifyPassword(h.PwHash, pw); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPasswordHelper replaces a user's password with pw, moving their current
+// password into their password history and pruning history older than
+// PASSWORD_HISTORY_SIZE. Assumes pw has been checked against passwordPolicy.
+func (dm *DataManager) SetPasswordHelper(prof Profile, pw string) error {
+	hash, err := HashPassword(pw)
+	if err != nil {
+		return err
+	}
+	tx := dm.Begin()
+	if err := tx.Create(&PasswordHistory{UserID: prof.ID, PwHash: prof.PwHash}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(&Profile{}).Where("id = ?", prof.ID).Update("pw_hash", hash).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	var expired []PasswordHistory
+	err = tx.Where("user_id = ?", prof.ID).Order("id desc").Offset(PASSWORD_HISTORY_SIZE - 1).Find(&expired).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, h := range expired {
+		if err := tx.Unscoped().Delete(&h).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
 /* -------------------------------------------------------------------------- */
 
 // IndexNewProfile operates on a DataManager struct and takes a ResponseWriter
 // and a Request, whose body should contain a new Profile, and creates a db
 // record of this new profile. Writes the result of that query, ID or error,
-// to w.
+// to w. Users join an existing company by redeeming the `invite` token issued
+// by one of its admins, and are given the invite's role. Without an invite a
+// new company is created from `company_name` and `company_address`, and the
+// user becomes its owner.
 func (dm *DataManager) IndexNewProfile(w http.ResponseWriter, r *http.Request) {
 	// Handle error here as PostFormValue ignores errors
 	if err := r.ParseForm(); err != nil {
@@ -109,23 +251,75 @@ func (dm *DataManager) IndexNewProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	p := Profile{
-		UserName:    r.PostFormValue("user_name"),
-		CompanyName: r.PostFormValue("company_name"),
-		PwHash:      []byte(r.PostFormValue("pw_hash")),
-		Address:     r.PostFormValue("company_address"),
+		UserName: r.PostFormValue("user_name"),
+		Email:    r.PostFormValue("email"),
 	}
-	if p.UserName == "" || p.CompanyName == "" || p.PwHash == nil || p.Address == "" {
+	token := r.PostFormValue("invite")
+	cn, address := r.PostFormValue("company_name"), r.PostFormValue("company_address")
+	pw := passwordFromRequest(r)
+	if p.UserName == "" || pw == "" || (token == "" && (cn == "" || address == "")) {
 		http.Error(w, "One or more profile data fields were blank", http.StatusBadRequest)
 		return
 	}
-	// TODO: replace with 'unique' key check, such that user_name/company_name is
-	// unique by db schema
-	if dm.userExists(p.UserName, p.CompanyName) {
+	if p.Email != "" && !validEmail(p.Email) {
+		http.Error(w, "email is not a valid address", http.StatusBadRequest)
+		return
+	}
+	if err := passwordPolicy.Check(pw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := HashPassword(pw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.PwHash = hash
+	tx := dm.Begin()
+	txdm := &DataManager{tx, dm.Cookies}
+	var tenant *TenantDB
+	if token != "" {
+		inv, ok := txdm.GetInviteHelper(token)
+		if ok {
+			ok, err = txdm.ConsumeInviteHelper(inv)
+		}
+		if !ok {
+			tx.Rollback()
+			if err != nil {
+				fmt.Println("dm.ConsumeInviteHelper: ", err)
+			}
+			http.Error(w, "Invite is invalid or has expired", http.StatusBadRequest)
+			return
+		}
+		tenant, p.Role = txdm.ForCompany(inv.CompanyID), inv.Role
+	} else {
+		// The company is created along with its first user
+		if txdm.companyNameTaken(cn, 0) {
+			tx.Rollback()
+			http.Error(w, "A company with that name already exists, ask one of its admins for an invite", http.StatusConflict)
+			return
+		}
+		company := Company{Name: cn, Address: address, Settings: CompanySettings{}}
+		if err := tx.Create(&company).Error; err != nil {
+			tx.Rollback()
+			fmt.Println("dm.Create: ", err)
+			http.Error(w, "Database error on profile indexing.", http.StatusInternalServerError)
+			return
+		}
+		tenant, p.Role = txdm.ForCompany(company.ID), ROLE_OWNER
+	}
+	if tenant.userExists(p.UserName) {
+		tx.Rollback()
 		http.Error(w, "User already exists", http.StatusBadRequest)
 		return
 	}
 	// Create a new profile record
-	if err := dm.Create(&p).Error; err != nil {
+	if err := tenant.Create(&p); err != nil {
+		tx.Rollback()
+		http.Error(w, "Database error on profile indexing.", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
 		http.Error(w, "Database error on profile indexing.", http.StatusInternalServerError)
 		return
 	}
@@ -150,17 +344,15 @@ func (dm *DataManager) GetExistingProfile(w http.ResponseWriter, r *http.Request
 		http.Error(w, "One or more credentials were blank", http.StatusBadRequest)
 		return
 	}
-	if !dm.userExists(un, cn) {
-		http.Error(w, "User does not exist", http.StatusBadRequest)
+	tenant, ok := dm.authorizeProfileAccess(w, r, un, cn, false)
+	if !ok {
 		return
 	}
-	// TODO: ensure authentication via cookie
-	// if !IsUserAuthenticated(un, cn) {
-	//     http.Error(w, "User not authenticated", http.StatusUnauthorized)
-	//     return
-	// }
-	p, err := dm.GetProfileHelper(un, cn)
-	if err != nil {
+	p, err := tenant.GetProfileHelper(un)
+	if err == gorm.ErrRecordNotFound {
+		http.Error(w, "User does not exist", http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "Database error on profile retrieval", http.StatusInternalServerError)
 		return
 	}
@@ -178,49 +370,69 @@ func (dm *DataManager) GetExistingProfile(w http.ResponseWriter, r *http.Request
 // and updates the existing record for that user in the db. Either an error or
 // success message on record update will be written to w.
 func (dm *DataManager) UpdateExistingProfile(w http.ResponseWriter, r *http.Request) {
-	// TODO: replace un/cn matching with cookie lookup
 	rsrc := parseProfileQuery(r.URL.Path)
 	cn, un := rsrc[2], rsrc[3]
 	if un == "" || cn == "" {
 		http.Error(w, "One or more credentials were blank", http.StatusBadRequest)
 		return
 	}
+	tenant, ok := dm.authorizeProfileAccess(w, r, un, cn, true)
+	if !ok {
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Form could not be parsed correctly", http.StatusBadRequest)
 		return
 	}
-	if !dm.userExists(un, cn) {
+	p, err := tenant.GetProfileHelper(un)
+	if err == gorm.ErrRecordNotFound {
 		http.Error(w, "User does not exist", http.StatusBadRequest)
 		return
+	} else if err != nil {
+		http.Error(w, "Database error on profile update", http.StatusInternalServerError)
+		return
 	}
-	// TODO: ensure authentication via cookie
-	// if !IsUserAuthenticated(un, cn) {
-	//     http.Error(w, "User not authenticated", http.StatusUnauthorized)
-	//     return
-	// }
-	// user_name, company_address, and pw_hash are the only updatable profile fields
-	// NOTE: ignore company_name (attempt to change should be handled by frontend)
-	temp := map[string]interface{}{
-		"user_name":       r.PostFormValue("user_name"),
-		"company_address": r.PostFormValue("company_address"),
-		"pw_hash":         []byte(r.PostFormValue("pw_hash")),
+	// user_name and email are the only fields updatable here. Passwords are
+	// changed through ChangePassword and company details through
+	// UpdateCompany. Each is left unchanged unless a new value is given.
+	temp := map[string]interface{}{}
+	if userName := r.PostFormValue("user_name"); userName != "" {
+		temp["user_name"] = userName
 	}
-	tx := dm.Begin()
+	email := r.PostFormValue("email")
+	if email != "" {
+		if !validEmail(email) {
+			http.Error(w, "email is not a valid address", http.StatusBadRequest)
+			return
+		}
+		temp["email"] = email
+	}
+	tx := tenant.Begin()
 	for k, v := range temp {
-		if err := (&DataManager{tx, &securecookie.SecureCookie{}}).UpdateProfileHelper(un, cn, k, v); err != nil {
-			tx.Rollback()
-			http.Error(w, "Database error on profile update", http.StatusInternalServerError)
+		if err := tx.UpdateProfileHelper(p, k, v); err != nil {
+			tx.DB().Rollback()
+			switch err {
+			case ErrUserNameTaken:
+				http.Error(w, err.Error(), http.StatusConflict)
+			case ErrCompanyIDFixed, ErrInvalidEmail, ErrInvalidProfileKey:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				fmt.Println("tx.UpdateProfileHelper: ", err)
+				http.Error(w, "Database error on profile update", http.StatusInternalServerError)
+			}
 			return
 		}
 	}
-	tx.Commit()
-	w.Header().Set("Content-Type", "application/json")
-	p := Profile{
-		CompanyName: cn,
-		UserName:    temp["user_name"].(string),
-		Address:     temp["company_address"].(string),
-		PwHash:      temp["pw_hash"].([]byte),
+	if err := tx.DB().Commit().Error; err != nil {
+		fmt.Println("tx.Commit: ", err)
+		http.Error(w, "Database error on profile update", http.StatusInternalServerError)
+		return
+	}
+	if p, err = dm.GetProfileByIdHelper(p.ID); err != nil {
+		http.Error(w, "Database error on profile retrieval", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	body, err := json.Marshal(p)
 	if err != nil {
 		log.Fatal("json.Marshal: ", err)
@@ -232,6 +444,7 @@ func (dm *DataManager) UpdateExistingProfile(w http.ResponseWriter, r *http.Requ
 // DeleteExistingProfile operates on a DataManager struct and takes a user's
 // unique ID and deletes the corresponding db record. Either an error or
 // success message onm successful deletion of the record will be written to w.
+// The last owner of a company cannot be deleted.
 func (dm *DataManager) DeleteExistingProfile(w http.ResponseWriter, r *http.Request) {
 	rsrc := parseProfileQuery(r.URL.Path)
 	cn, un := rsrc[2], rsrc[3]
@@ -239,24 +452,108 @@ func (dm *DataManager) DeleteExistingProfile(w http.ResponseWriter, r *http.Requ
 		http.Error(w, "One or more credentials were blank", http.StatusBadRequest)
 		return
 	}
-	// TODO: replace with 'unique' key check, such that user_name/company_name is
-	// unique by db schema
-	if !dm.userExists(un, cn) {
+	tenant, ok := dm.authorizeProfileAccess(w, r, un, cn, true)
+	if !ok {
+		return
+	}
+	p, err := tenant.GetProfileHelper(un)
+	if err == gorm.ErrRecordNotFound {
 		http.Error(w, "User does not exist", http.StatusBadRequest)
 		return
+	} else if err != nil {
+		http.Error(w, "Database error on profile delete", http.StatusInternalServerError)
+		return
+	}
+	// As in SetProfileRole, the last owner of a company cannot leave it
+	if p.Role == ROLE_OWNER {
+		owners, err := tenant.countOwnersHelper()
+		if err != nil {
+			fmt.Println("tenant.countOwnersHelper: ", err)
+			http.Error(w, "Database error on profile delete", http.StatusInternalServerError)
+			return
+		}
+		if owners <= 1 {
+			http.Error(w, "A company must have at least one owner", http.StatusBadRequest)
+			return
+		}
 	}
-	// TODO: ensure authentication via cookie
-	// if !IsUserAuthenticated(un, cn) {
-	//     http.Error(w, "User not authenticated", http.StatusUnauthorized)
-	//     return
-	// }
-	// BUG: Delete() does not throw an error when un or cn are not in the db;
-	// seen by running with above userExists statement commented via
-	// TestDeleteExistingProfileNotExistFail()
-	qstring := "user_name = ? AND company_name = ?"
-	if err := dm.Unscoped().Where(qstring, un, cn).Delete(&Profile{}).Error; err != nil {
+	if err := tenant.Query(&Profile{}).Unscoped().Where("id = ?", p.ID).Delete(&Profile{}).Error; err != nil {
 		http.Error(w, "Database error on profile delete", http.StatusInternalServerError)
 		return
 	}
+	// Sign the deleted user out everywhere
+	if err := dm.DeleteSessionsByUserHelper(p.ID); err != nil {
+		fmt.Println("dm.DeleteSessionsByUserHelper: ", err)
+	}
+	if err := dm.DeleteRefreshTokensByUserHelper(p.ID); err != nil {
+		fmt.Println("dm.DeleteRefreshTokensByUserHelper: ", err)
+	}
+	if err := dm.DeleteRecoveryCodesHelper(p.ID); err != nil {
+		fmt.Println("dm.DeleteRecoveryCodesHelper: ", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword changes the caller's password to the `new_password` form
+// value after checking the `current_password` value. The new password must
+// satisfy passwordPolicy and not repeat a recent password. All of the user's
+// sessions are ended and the caller is given a fresh session cookie.
+func (dm *DataManager) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	caller, ok := ProfileFromContext(r)
+	if !ok {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if caller.ViaAPIKey() {
+		http.Error(w, "API keys cannot change passwords", http.StatusForbidden)
+		return
+	}
+	current, next := r.FormValue("current_password"), r.FormValue("new_password")
+	if current == "" || next == "" {
+		http.Error(w, "One or more passwords were blank", http.StatusBadRequest)
+		return
+	}
+	// The profile in the context has its password stripped
+	prof, err := dm.GetProfileByIdHelper(caller.ID)
+	if err != nil {
+		fmt.Println("dm.GetProfileByIdHelper: ", err)
+		http.Error(w, "Database error on profile retrieval", http.StatusInternalServerError)
+		return
+	}
+	if ok, _ := VerifyPassword(prof.PwHash, current); !ok {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+	if err := passwordPolicy.Check(next); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dm.passwordReused(prof, next) {
+		http.Error(w, fmt.Sprintf("password must differ from your last %d passwords", PASSWORD_HISTORY_SIZE),
+			http.StatusBadRequest)
+		return
+	}
+	if err := dm.SetPasswordHelper(prof, next); err != nil {
+		fmt.Println("dm.SetPasswordHelper: ", err)
+		http.Error(w, "Database error on password change", http.StatusInternalServerError)
+		return
+	}
+	// Sign out any other sessions and token clients, which may belong to
+	// whoever knew the old password, and replace the caller's own session
+	if err := dm.DeleteSessionsByUserHelper(prof.ID); err != nil {
+		fmt.Println("dm.DeleteSessionsByUserHelper: ", err)
+		http.Error(w, "Database error on clearing sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := dm.DeleteRefreshTokensByUserHelper(prof.ID); err != nil {
+		fmt.Println("dm.DeleteRefreshTokensByUserHelper: ", err)
+		http.Error(w, "Database error on clearing sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := dm.StartSessionHelper(w, prof.ID, r); err != nil {
+		fmt.Println("dm.StartSessionHelper: ", err)
+		http.Error(w, "Database error on creating new session", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,25 +12,32 @@ import (
 	"testing"
 )
 
+// Attaches caller to the request's context as SessionMiddleware would
+func withProfile(r *http.Request, caller *Profile) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "profile", caller))
+}
+
 /* -------------------------- HELPER METHOD TESTS --------------------------- */
 
 func TestUserExists(t *testing.T) {
 	prof := Profile{
-		UserName:    "test",
-		CompanyName: "test company",
-		PwHash:      []byte("1234"),
-		Address:     "1234 lane",
+		UserName:  "test",
+		CompanyID: testCompany(t, "test company").ID,
+		PwHash:    []byte("1234"),
 	}
 	if err := db.Create(&prof).Error; err != nil {
 		t.Errorf("Error creating profile not expected. err: %v", err)
 	}
 	defer db.Unscoped().Delete(&Profile{})
-	if !dm.userExists("test", "test company") {
+	if !dm.ForCompany(prof.CompanyID).userExists("test") {
 		t.Error("User should exist but does not.")
 	}
-	if dm.userExists("not test", "test company") {
+	if dm.ForCompany(prof.CompanyID).userExists("not test") {
 		t.Error("User should not exist but does.")
 	}
+	if dm.ForCompany(testCompany(t, "other company").ID).userExists("test") {
+		t.Error("User should not exist in another company but does.")
+	}
 }
 
 func TestParseProfileQuerySuccess(t *testing.T) {
@@ -63,13 +71,11 @@ func TestParseProfileQueryEmpty(t *testing.T) {
 func TestGetProfileHelperSuccess(t *testing.T) {
 	un := "super_sifter"
 	cn := "Sift Technologies, Inc."
-	adr := "4321 Pleasantown Rd, Pleasantville, PV, UPV, V1A 1X1"
 	pwh := []byte("cd026ec28d7976550a52da2520660bd8e26b5b40")
 	prof := Profile{
-		UserName:    un,
-		CompanyName: cn,
-		Address:     adr,
-		PwHash:      pwh,
+		UserName:  un,
+		CompanyID: testCompany(t, cn).ID,
+		PwHash:    pwh,
 	}
 	if err := db.Create(&prof).Error; err != nil {
 		t.Errorf("Error creating profile not expected. err: %v", err)
@@ -82,11 +88,8 @@ func TestGetProfileHelperSuccess(t *testing.T) {
 	if p.UserName != un {
 		t.Errorf("Incorrect user_name: received %s, expected %s", p.UserName, un)
 	}
-	if p.CompanyName != cn {
-		t.Errorf("Incorrect company_name: received %s, expected %s", p.CompanyName, cn)
-	}
-	if p.Address != adr {
-		t.Errorf("Incorrect company_address: received %s, expected %s", p.Address, adr)
+	if p.CompanyID != prof.CompanyID {
+		t.Errorf("Incorrect company_id: received %d, expected %d", p.CompanyID, prof.CompanyID)
 	}
 	if string(p.PwHash) != string(pwh) {
 		t.Errorf("Incorrect pw_hash: received %s, expected %s", p.PwHash, pwh)
@@ -95,8 +98,8 @@ func TestGetProfileHelperSuccess(t *testing.T) {
 
 func TestGetProfileHelperIncorrectInputs(t *testing.T) {
 	prof := Profile{
-		UserName:    "super_sifter",
-		CompanyName: "Sift Technologies, Inc.",
+		UserName:  "super_sifter",
+		CompanyID: testCompany(t, "Sift Technologies, Inc.").ID,
 	}
 	if err := db.Create(&prof).Error; err != nil {
 		t.Errorf("Error creating profile not expected. err: %v", err)
@@ -117,22 +120,36 @@ func TestUserPwAuthSuccess(t *testing.T) {
 	cn := "Sift Technologies, Inc."
 	pwh := []byte("abc123")
 	prof := Profile{
-		UserName:    un,
-		CompanyName: cn,
-		PwHash:      pwh,
+		UserName:  un,
+		CompanyID: testCompany(t, cn).ID,
+		PwHash:    pwh,
 	}
 	if err := db.Create(&prof).Error; err != nil {
 		t.Errorf("Error creating profile not expected. err: %v", err)
 	}
 	defer db.Unscoped().Delete(&Profile{})
-	if !dm.UserPwAuthSuccess(un, cn, []byte("abc123")) {
+	if !dm.UserPwAuthSuccess(un, cn, "abc123") {
 		t.Error("Expected user to log in successfully")
 	}
-	if dm.UserPwAuthSuccess(un, cn, []byte("")) {
-		t.Error("Expected user login to be rejected with empty password hash")
+	// The legacy plaintext row should have been upgraded to a hash
+	p, err := dm.GetProfileHelper(un, cn)
+	if err != nil {
+		t.Errorf("Error (%v) encountered when retrieving profile for %s", err, un)
+	}
+	if string(p.PwHash) == "abc123" {
+		t.Error("Expected legacy password to be rehashed on login")
 	}
-	if dm.UserPwAuthSuccess(un, cn, []byte("xyz123")) {
-		t.Error("Expected user login to be rejected with bad password hash")
+	if !dm.UserPwAuthSuccess(un, cn, "abc123") {
+		t.Error("Expected user to log in successfully after rehash")
+	}
+	if dm.UserPwAuthSuccess(un, cn, "") {
+		t.Error("Expected user login to be rejected with empty password")
+	}
+	if dm.UserPwAuthSuccess(un, cn, "xyz123") {
+		t.Error("Expected user login to be rejected with bad password")
+	}
+	if dm.UserPwAuthSuccess("soggy_sifter", cn, "abc123") {
+		t.Error("Expected login to be rejected for a user that does not exist")
 	}
 }
 
@@ -141,9 +158,9 @@ func TestUserPwAuthSuccess(t *testing.T) {
 func TestIndexNewProfileSuccess(t *testing.T) {
 	formdata := url.Values{
 		"user_name":       {"super_sifter"},
-		"company_name":    {"Sift Technologies, Inc."},
+		"company_name":    {"Sift Signups, Inc."},
 		"company_address": {"4321 Pleasantown Rd, Pleasantville, PV, UPV, V1A 1X1"},
-		"pw_hash":         {"cd026ec28d7976550a52da2520660bd8e26b5b40"},
+		"password":        {"correct horse battery staple"},
 	}
 	req, err := http.NewRequest("POST", "/profile", strings.NewReader(formdata.Encode()))
 	if err != nil {
@@ -164,14 +181,105 @@ func TestIndexNewProfileSuccess(t *testing.T) {
 	if p.UserName != formdata["user_name"][0] {
 		t.Errorf("Incorrect user_name: received %s, expected %s", p.UserName, formdata["user_name"][0])
 	}
-	if p.CompanyName != formdata["company_name"][0] {
-		t.Errorf("Incorrect company_name: received %s, expected %s", p.CompanyName, formdata["company_name"][0])
+	company, err := dm.GetCompanyByNameHelper(formdata["company_name"][0])
+	if err != nil {
+		t.Errorf("Error (%v) encountered when retrieving company", err)
+	}
+	defer dm.DeleteCompanyHelper(company.ID)
+	if p.CompanyID != company.ID {
+		t.Errorf("Incorrect company_id: received %d, expected %d", p.CompanyID, company.ID)
+	}
+	if len(p.PwHash) != 0 || strings.Contains(rr.Body.String(), "PwHash") {
+		t.Errorf("Password hash should not be returned, body: %s", rr.Body.String())
+	}
+	// The stored password must be hashed rather than kept as sent
+	stored, err := dm.GetProfileHelper(p.UserName, company.Name)
+	if err != nil {
+		t.Errorf("Error (%v) encountered when retrieving profile", err)
+	}
+	if string(stored.PwHash) == formdata["password"][0] {
+		t.Error("Password was stored in plaintext")
+	}
+	if ok, _ := VerifyPassword(stored.PwHash, formdata["password"][0]); !ok {
+		t.Error("Stored password hash does not match password")
+	}
+}
+
+// registerProfile serves a registration with formdata, filling in the
+// password
+func registerProfile(formdata url.Values) *httptest.ResponseRecorder {
+	formdata.Set("password", "correct horse battery staple")
+	req, _ := http.NewRequest("POST", "/profile", strings.NewReader(formdata.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	dm.IndexNewProfile(rr, req)
+	return rr
+}
+
+func TestIndexNewProfileCreatesCompany(t *testing.T) {
+	cn := "Brand New Co"
+	rr := registerProfile(url.Values{
+		"user_name":       {"founder"},
+		"company_name":    {cn},
+		"company_address": {"1 Startup Way"},
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusCreated)
+	}
+	var founder Profile
+	json.Unmarshal(rr.Body.Bytes(), &founder)
+	company, err := dm.GetCompanyHelper(founder.CompanyID)
+	if err != nil {
+		t.Fatalf("Error (%v) encountered when retrieving company", err)
+	}
+	defer dm.DeleteCompanyHelper(company.ID)
+	if company.Name != cn || company.Address != "1 Startup Way" {
+		t.Errorf("Incorrect company: %+v", company)
+	}
+	if founder.Role != ROLE_OWNER {
+		t.Errorf("Incorrect role: received %s, expected %s", founder.Role, ROLE_OWNER)
 	}
-	if p.Address != formdata["company_address"][0] {
-		t.Errorf("Incorrect company_address: received %s, expected %s", p.Address, formdata["company_address"][0])
+	// Nobody can join the company just by naming it
+	rr = registerProfile(url.Values{
+		"user_name":       {"stranger"},
+		"company_name":    {cn},
+		"company_address": {"1 Startup Way"},
+	})
+	if rr.Code != http.StatusConflict {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusConflict)
 	}
-	if string(p.PwHash) != formdata["pw_hash"][0] {
-		t.Errorf("Incorrect pw_hash: received %s, expected %s", p.PwHash, formdata["pw_hash"][0])
+	if dm.ForCompany(company.ID).userExists("stranger") {
+		t.Error("User joined an existing company without an invite")
+	}
+}
+
+func TestIndexNewProfileRedeemsInvite(t *testing.T) {
+	company := testCompany(t, "Inviting Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	_, token, err := dm.ForCompany(company.ID).CreateInviteHelper(ROLE_VIEWER, 0)
+	if err != nil {
+		t.Fatal("tenant.CreateInviteHelper: ", err)
+	}
+	rr := registerProfile(url.Values{"user_name": {"joiner"}, "invite": {token}})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusCreated)
+	}
+	var joiner Profile
+	json.Unmarshal(rr.Body.Bytes(), &joiner)
+	if joiner.CompanyID != company.ID {
+		t.Errorf("Incorrect company_id: received %d, expected %d", joiner.CompanyID, company.ID)
+	}
+	if joiner.Role != ROLE_VIEWER {
+		t.Errorf("Incorrect role: received %s, expected %s", joiner.Role, ROLE_VIEWER)
+	}
+	// Each invite admits one user
+	rr = registerProfile(url.Values{"user_name": {"second_joiner"}, "invite": {token}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+	rr = registerProfile(url.Values{"user_name": {"guesser"}, "invite": {"not-a-token"}})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusBadRequest)
 	}
 }
 
@@ -201,16 +309,16 @@ func TestUpdateExistingProfileSuccess(t *testing.T) {
 	cn := "Sift Technologies, Inc."
 	furl := url.QueryEscape(fmt.Sprintf("/profile/%s/%s", cn, un))
 	formdata := url.Values{
-		"user_name":       {"solid_sifter"},           // new user_name
-		"company_name":    {"Sift Technologies, LLC"}, // new company_name is ignored
-		"company_address": {"4321 Pleasantown Rd, Pleasantville, PV, UPV, V1A 1X1"},
-		"pw_hash":         {"cd026ec28d7976550a52da2520660bd8e26b5b40"},
+		"user_name":    {"solid_sifter"},           // new user_name
+		"company_name": {"Sift Technologies, LLC"}, // new company_name is ignored
 	}
 	req, err := http.NewRequest("PUT", furl, strings.NewReader(formdata.Encode()))
 	if err != nil {
 		t.Errorf("Request unsuccessfully created.\nerr: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	company := testCompany(t, cn)
+	req = withProfile(req, &Profile{UserName: un, CompanyID: company.ID})
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(dm.UpdateExistingProfile)
 	handler.ServeHTTP(rr, req)
@@ -226,14 +334,62 @@ func TestUpdateExistingProfileSuccess(t *testing.T) {
 		t.Errorf("Incorrect user_name: received %s, expected %s", p.UserName, formdata["user_name"][0])
 	}
 	// Should not have changed as UpdateExistingProfile ignores updates to company_name
-	if p.CompanyName != cn {
-		t.Errorf("Incorrect company_name: received %s, expected %s", p.CompanyName, cn)
+	if p.CompanyID != company.ID {
+		t.Errorf("Incorrect company_id: received %d, expected %d", p.CompanyID, company.ID)
+	}
+}
+
+func TestUpdateExistingProfileEmailOnly(t *testing.T) {
+	un := "solid_sifter"
+	cn := "Sift Technologies, Inc."
+	furl := url.QueryEscape(fmt.Sprintf("/profile/%s/%s", cn, un))
+	formdata := url.Values{"email": {"solid@sift.example.com"}}
+	req, err := http.NewRequest("PUT", furl, strings.NewReader(formdata.Encode()))
+	if err != nil {
+		t.Errorf("Request unsuccessfully created.\nerr: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	company := testCompany(t, cn)
+	req = withProfile(req, &Profile{UserName: un, CompanyID: company.ID})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.UpdateExistingProfile).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusOK)
+	}
+	var p Profile
+	if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+		t.Errorf("Error (%v) encountered when unmarshalling profile", err)
 	}
-	if p.Address != formdata["company_address"][0] {
-		t.Errorf("Incorrect company_address: received %s, expected %s", p.Address, formdata["company_address"][0])
+	// The user_name is left alone when only the email is given
+	if p.UserName != un {
+		t.Errorf("Incorrect user_name: received %s, expected %s", p.UserName, un)
 	}
-	if string(p.PwHash) != formdata["pw_hash"][0] {
-		t.Errorf("Incorrect pw_hash: received %s, expected %s", p.PwHash, formdata["pw_hash"][0])
+	if p.Email != formdata["email"][0] {
+		t.Errorf("Incorrect email: received %s, expected %s", p.Email, formdata["email"][0])
+	}
+}
+
+func TestUpdateExistingProfileNameTaken(t *testing.T) {
+	un := "solid_sifter"
+	cn := "Sift Technologies, Inc."
+	company := testCompany(t, cn)
+	taken := Profile{UserName: "taken_sifter", CompanyID: company.ID}
+	if err := db.Create(&taken).Error; err != nil {
+		t.Fatalf("Error creating profile not expected. err: %v", err)
+	}
+	defer db.Unscoped().Delete(&taken)
+	furl := url.QueryEscape(fmt.Sprintf("/profile/%s/%s", cn, un))
+	formdata := url.Values{"user_name": {"taken_sifter"}}
+	req, err := http.NewRequest("PUT", furl, strings.NewReader(formdata.Encode()))
+	if err != nil {
+		t.Errorf("Request unsuccessfully created.\nerr: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = withProfile(req, &Profile{UserName: un, CompanyID: company.ID})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.UpdateExistingProfile).ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusConflict)
 	}
 }
 
@@ -246,10 +402,12 @@ func TestDeleteExistingProfileSuccess(t *testing.T) {
 		t.Errorf("Request unsuccessfully created.\nerr: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	company := testCompany(t, cn)
+	req = withProfile(req, &Profile{UserName: un, CompanyID: company.ID})
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(dm.DeleteExistingProfile)
 	handler.ServeHTTP(rr, req)
-	if dm.userExists(un, cn) {
+	if dm.ForCompany(company.ID).userExists(un) {
 		t.Errorf("User still exists but should have been deleted")
 	}
 	if rr.Code != http.StatusNoContent {
@@ -266,15 +424,131 @@ func TestDeleteExistingProfileNotExistFail(t *testing.T) {
 		t.Errorf("Request unsuccessfully created.\nerr: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	company := testCompany(t, cn)
+	defer dm.DeleteCompanyHelper(company.ID)
+	req = withProfile(req, &Profile{UserName: "admin", CompanyID: company.ID, Role: ROLE_ADMIN})
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(dm.DeleteExistingProfile)
 	handler.ServeHTTP(rr, req)
 	un, _ = url.QueryUnescape(un)
-	cn, _ = url.QueryUnescape(cn)
-	if dm.userExists(un, cn) {
+	if dm.ForCompany(company.ID).userExists(un) {
 		t.Errorf("User should not exist")
 	}
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("HTTP status code recieved: %d expected %d\nerror: %v", rr.Code, http.StatusBadRequest, rr.Body)
 	}
 }
+
+func TestCanAccessProfile(t *testing.T) {
+	user := &Profile{UserName: "super_sifter", CompanyID: 1}
+	admin := &Profile{UserName: "admin", CompanyID: 1, Role: ROLE_ADMIN}
+	if !canAccessProfile(user, "super_sifter", 1) {
+		t.Error("Users should be able to access their own profile")
+	}
+	if canAccessProfile(user, "solid_sifter", 1) {
+		t.Error("Users should not be able to access other users' profiles")
+	}
+	if canAccessProfile(user, "super_sifter", 2) {
+		t.Error("Users should not be able to access a profile with their name at another company")
+	}
+	if !canAccessProfile(admin, "solid_sifter", 1) {
+		t.Error("Admins should be able to access profiles in their company")
+	}
+	if canAccessProfile(admin, "solid_sifter", 2) {
+		t.Error("Admins should not be able to access profiles in other companies")
+	}
+}
+
+func TestExistingProfileUnauthenticated(t *testing.T) {
+	furl := url.QueryEscape("/profile/Sift Technologies, Inc./super_sifter")
+	handlers := map[string]http.HandlerFunc{
+		"GET":    dm.GetExistingProfile,
+		"PUT":    dm.UpdateExistingProfile,
+		"DELETE": dm.DeleteExistingProfile,
+	}
+	for method, handler := range handlers {
+		req, _ := http.NewRequest(method, furl, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: HTTP status code recieved: %d, expected %d", method, rr.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestExistingProfileForbidden(t *testing.T) {
+	furl := url.QueryEscape("/profile/Sift Technologies, Inc./super_sifter")
+	handlers := map[string]http.HandlerFunc{
+		"GET":    dm.GetExistingProfile,
+		"PUT":    dm.UpdateExistingProfile,
+		"DELETE": dm.DeleteExistingProfile,
+	}
+	caller := &Profile{UserName: "solid_sifter", CompanyID: testCompany(t, "Sift Technologies, Inc.").ID}
+	for method, handler := range handlers {
+		req, _ := http.NewRequest(method, furl, nil)
+		req = withProfile(req, caller)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: HTTP status code recieved: %d, expected %d", method, rr.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	hash, _ := HashPassword("correct horse battery staple")
+	cn := "Sift Technologies, Inc."
+	prof := Profile{
+		UserName:  "password_changer",
+		CompanyID: testCompany(t, cn).ID,
+		PwHash:    hash,
+	}
+	if err := db.Create(&prof).Error; err != nil {
+		t.Errorf("Error creating profile not expected. err: %v", err)
+	}
+	defer db.Unscoped().Delete(&prof)
+	defer db.Unscoped().Where("user_id = ?", prof.ID).Delete(&PasswordHistory{})
+	defer dm.DeleteSessionsByUserHelper(prof.ID)
+
+	// A session that should be signed out by the change
+	session, otherID := loginFrom(t, prof.ID, "Other Browser")
+
+	change := func(current, next string) *httptest.ResponseRecorder {
+		formdata := url.Values{"current_password": {current}, "new_password": {next}}
+		req, _ := http.NewRequest("POST", "/profile/password", strings.NewReader(formdata.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		dm.SessionMiddleware(http.HandlerFunc(dm.ChangePassword)).ServeHTTP(rr, withSession(req, session))
+		if cookies := (&http.Response{Header: rr.Header()}).Cookies(); len(cookies) == 2 {
+			session = cookies
+		}
+		return rr
+	}
+
+	if rr := change("wrong password", "tr0ub4dor and three"); rr.Code != http.StatusForbidden {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+	if rr := change("correct horse battery staple", "short"); rr.Code != http.StatusBadRequest {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+	if rr := change("correct horse battery staple", "correct horse battery staple"); rr.Code != http.StatusBadRequest {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+	if rr := change("correct horse battery staple", "tr0ub4dor and three"); rr.Code != http.StatusNoContent {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusNoContent)
+	}
+	if !dm.UserPwAuthSuccess(prof.UserName, cn, "tr0ub4dor and three") {
+		t.Error("Expected user to log in with new password")
+	}
+	if dm.UserPwAuthSuccess(prof.UserName, cn, "correct horse battery staple") {
+		t.Error("Expected old password to be rejected")
+	}
+	if _, err := dm.GetSessionByIdHelper(otherID); err == nil {
+		t.Error("Expected existing session to be deleted on password change")
+	}
+
+	// The previous password is in the history and cannot be reused
+	if rr := change("tr0ub4dor and three", "correct horse battery staple"); rr.Code != http.StatusBadRequest {
+		t.Errorf("HTTP status code recieved: %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,421 @@
+// Webhook registration and delivery of signed job events to company endpoints
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Number of times delivery of an event to a webhook is attempted
+	WEBHOOK_MAX_ATTEMPTS = 5
+	// Delay before the first retry of a failed delivery, doubled per attempt
+	WEBHOOK_BACKOFF = time.Second
+	// Time allowed for a webhook endpoint to respond
+	WEBHOOK_TIMEOUT = 10 * time.Second
+	// Header carrying the hex HMAC-SHA256 of the request body, prefixed "sha256="
+	WEBHOOK_SIGNATURE_HEADER = "X-Sift-Signature"
+)
+
+// WebhookEvent is the JSON body POSTed to webhooks when a job finishes
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	JobID     string    `json:"job_id"`
+	Analysis  string    `json:"analysis"`
+	Status    string    `json:"status"`
+	ResultURL string    `json:"result_url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// SignWebhookPayload returns the value of the WEBHOOK_SIGNATURE_HEADER for
+// body. Receivers verify events by computing the same value with their secret.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// CreateWebhookHelper registers url for the company with a newly generated
+// secret
+func (t *TenantDB) CreateWebhookHelper(u string) (Webhook, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{URL: u, Secret: hex.EncodeToString(secret)}
+	err := t.Create(&hook)
+	return hook, err
+}
+
+// GetWebhooksHelper retrieves all webhooks registered by the company
+func (t *TenantDB) GetWebhooksHelper() (hooks []Webhook, err error) {
+	err = t.Query(&Webhook{}).Find(&hooks).Error
+	return
+}
+
+// GetWebhookHelper retrieves one of the company's webhooks by id
+func (t *TenantDB) GetWebhookHelper(id uint) (hook Webhook, err error) {
+	err = t.Query(&Webhook{}).Where("id = ?", id).First(&hook).Error
+	return
+}
+
+// DeleteWebhookHelper deletes one of the company's webhooks by id
+func (t *TenantDB) DeleteWebhookHelper(id uint) error {
+	return t.Query(&Webhook{}).Unscoped().Where("id = ?", id).Delete(Webhook{}).Error
+}
+
+// GetWebhookDeliveriesHelper retrieves the delivery log of one of the
+// company's webhooks, newest first
+func (t *TenantDB) GetWebhookDeliveriesHelper(id uint) (deliveries []WebhookDelivery, err error) {
+	hook := t.Query(&Webhook{}).Where("id = ?", id).Select("id").QueryExpr()
+	err = t.dm.Where("webhook_id IN (?)", hook).Order("id desc").Find(&deliveries).Error
+	return
+}
+
+// Parses the {id} path variable of webhook routes
+func webhookIDFromRequest(r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	return uint(id), err == nil
+}
+
+// Resolves webhook hosts to IP addresses, replaced in tests
+var lookupWebhookHost = net.LookupIP
+
+// Returned when a webhook would be sent to an internal address
+var errWebhookAddress = errors.New("webhook address is not publicly routable")
+
+// Private (RFC 1918), carrier-grade NAT and unique local IPv6 ranges, which
+// are checked by hand as net.IP has no IsPrivate in the Go we build with
+var internalNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// Reports whether webhooks may be delivered to ip. Loopback, link-local,
+// private and other internal addresses are refused so that webhooks cannot
+// be used to reach the API's own network.
+func publicWebhookIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the host of u without its port or IPv6 brackets, as url.URL has
+// no Hostname in the Go we build with
+func webhookHostname(u *url.URL) string {
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Checks that a webhook URL is an absolute http(s) URL whose host resolves
+// only to public addresses
+func checkWebhookURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || webhookHostname(parsed) == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	ips, err := lookupWebhookHost(webhookHostname(parsed))
+	if err != nil || len(ips) == 0 {
+		return errors.New("url host could not be resolved")
+	}
+	for _, ip := range ips {
+		if !publicWebhookIP(ip) {
+			return errors.New("url must not point to a private or internal address")
+		}
+	}
+	return nil
+}
+
+// Connects to webhook endpoints, refusing internal addresses. The host is
+// resolved again for each connection and the checked address is the one
+// dialed, so a host that passed checkWebhookURL but later resolves to an
+// internal address is still refused.
+func dialWebhook(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupWebhookHost(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errWebhookAddress
+	}
+	for _, ip := range ips {
+		if !publicWebhookIP(ip) {
+			return nil, errWebhookAddress
+		}
+	}
+	dialer := &net.Dialer{Timeout: WEBHOOK_TIMEOUT}
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// Returns the client webhooks are delivered with, which only connects to
+// public addresses and does not follow redirects
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout:   WEBHOOK_TIMEOUT,
+		Transport: &http.Transport{DialContext: dialWebhook},
+		// A redirect could point anywhere, so the 3xx is recorded as a
+		// failed delivery instead
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+/* -------------------------------------------------------------------------- */
+
+// RegisterWebhook creates a webhook for the caller's company from the `url`
+// form value. The response includes the webhook's signing secret, which is
+// not returned again.
+func (dm *DataManager) RegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	u := r.FormValue("url")
+	if err := checkWebhookURL(u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hook, err := tenant.CreateWebhookHelper(u)
+	if err != nil {
+		fmt.Println("tenant.CreateWebhookHelper: ", err)
+		http.Error(w, "Database error on webhook creation", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(hook)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// ListWebhooks writes the caller's company's webhooks, without secrets, to w
+func (dm *DataManager) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	hooks, err := tenant.GetWebhooksHelper()
+	if err != nil {
+		fmt.Println("tenant.GetWebhooksHelper: ", err)
+		http.Error(w, "Database error on webhook retrieval", http.StatusInternalServerError)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	body, err := json.Marshal(hooks)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// DeleteWebhook deletes the webhook in the URL if it belongs to the caller's
+// company
+func (dm *DataManager) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	id, ok := webhookIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := tenant.GetWebhookHelper(id); err != nil {
+		http.Error(w, "Webhook does not exist", http.StatusNotFound)
+		return
+	}
+	if err := tenant.DeleteWebhookHelper(id); err != nil {
+		fmt.Println("tenant.DeleteWebhookHelper: ", err)
+		http.Error(w, "Database error on webhook delete", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries writes the delivery log of the webhook in the URL to w
+func (dm *DataManager) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	tenant, _, ok := dm.TenantForRequest(w, r, PERM_MANAGE_INTEGRATIONS)
+	if !ok {
+		return
+	}
+	id, ok := webhookIDFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	if _, err := tenant.GetWebhookHelper(id); err != nil {
+		http.Error(w, "Webhook does not exist", http.StatusNotFound)
+		return
+	}
+	deliveries, err := tenant.GetWebhookDeliveriesHelper(id)
+	if err != nil {
+		fmt.Println("tenant.GetWebhookDeliveriesHelper: ", err)
+		http.Error(w, "Database error on delivery retrieval", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(deliveries)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// WebhookNotifier delivers job events to the webhooks of the job's company
+// and records every delivery attempt
+type WebhookNotifier struct {
+	dm          *DataManager
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+// NewWebhookNotifier constructs a WebhookNotifier with the default retry policy
+func NewWebhookNotifier(dm *DataManager) *WebhookNotifier {
+	return &WebhookNotifier{
+		dm:          dm,
+		Client:      newWebhookClient(),
+		MaxAttempts: WEBHOOK_MAX_ATTEMPTS,
+		Backoff:     WEBHOOK_BACKOFF,
+	}
+}
+
+// JobFinished notifies every webhook of the job's company that the job has
+// completed or failed. Intended for use with JobRunner.OnFinish. Deliveries
+// are made in the background.
+func (wn *WebhookNotifier) JobFinished(job *Job) {
+	if job.CompanyID == 0 {
+		return
+	}
+	hooks, err := wn.dm.ForCompany(job.CompanyID).GetWebhooksHelper()
+	if err != nil {
+		fmt.Println("tenant.GetWebhooksHelper: ", err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	status := job.Status()
+	ev := WebhookEvent{
+		Event:     "job." + status.Status,
+		JobID:     status.ID,
+		Analysis:  status.Analysis,
+		Status:    status.Status,
+		ResultURL: status.ResultURL,
+		Error:     status.Error,
+		Time:      time.Now(),
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Println("json.Marshal: ", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		go wn.deliver(hook, ev, body)
+	}
+}
+
+// record stores a delivery attempt in the webhook's delivery log
+func (wn *WebhookNotifier) record(d WebhookDelivery) {
+	if wn.dm == nil {
+		return
+	}
+	if err := wn.dm.Create(&d).Error; err != nil {
+		fmt.Println("dm.Create: ", err)
+	}
+}
+
+// deliver POSTs a signed event to hook, retrying failures with exponential
+// backoff. Each attempt is recorded as soon as it is made, and the attempts
+// are also returned.
+func (wn *WebhookNotifier) deliver(hook Webhook, ev WebhookEvent, body []byte) []WebhookDelivery {
+	var attempts []WebhookDelivery
+	backoff := wn.Backoff
+	for attempt := 1; attempt <= wn.MaxAttempts; attempt++ {
+		d := WebhookDelivery{WebhookID: hook.ID, JobID: ev.JobID, Event: ev.Event, Attempt: attempt}
+		req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+		if err != nil {
+			// A malformed URL will never succeed, so don't retry
+			d.Error = err.Error()
+			wn.record(d)
+			return append(attempts, d)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sift-Event", ev.Event)
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhookPayload(hook.Secret, body))
+
+		resp, err := wn.Client.Do(req)
+		if err != nil {
+			d.Error = err.Error()
+		} else {
+			resp.Body.Close()
+			d.StatusCode = resp.StatusCode
+			d.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+			if !d.Success {
+				d.Error = resp.Status
+			}
+		}
+		wn.record(d)
+		attempts = append(attempts, d)
+		if d.Success {
+			break
+		}
+		if attempt < wn.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return attempts
+}
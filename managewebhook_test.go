@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignWebhookPayload(t *testing.T) {
+	// echo -n '{"event":"job.completed"}' | openssl dgst -sha256 -hmac secret
+	sig := SignWebhookPayload("secret", []byte(`{"event":"job.completed"}`))
+	assert.Equal(t, "sha256=d9cb51b5281e6b3fcd7dc418042f6dbc4fec7a47932f83c16a467ad565a1167d", sig)
+	assert.NotEqual(t, sig, SignWebhookPayload("other", []byte(`{"event":"job.completed"}`)))
+}
+
+func TestWebhookDeliverRetries(t *testing.T) {
+	calls := 0
+	var gotSig, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+		gotSig = r.Header.Get(WEBHOOK_SIGNATURE_HEADER)
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	wn := &WebhookNotifier{Client: server.Client(), MaxAttempts: 5, Backoff: time.Millisecond}
+	hook := Webhook{URL: server.URL, Secret: "shh"}
+	hook.ID = 4
+	ev := WebhookEvent{Event: "job.completed", JobID: "abc", Status: JOB_COMPLETED}
+	body, _ := json.Marshal(ev)
+
+	attempts := wn.deliver(hook, ev, body)
+	assert.Equal(t, 3, len(attempts))
+	assert.False(t, attempts[0].Success)
+	assert.Equal(t, http.StatusServiceUnavailable, attempts[0].StatusCode)
+	assert.True(t, attempts[2].Success)
+	assert.Equal(t, 3, attempts[2].Attempt)
+	assert.Equal(t, uint(4), attempts[2].WebhookID)
+	assert.Equal(t, string(body), gotBody)
+	assert.Equal(t, SignWebhookPayload("shh", body), gotSig)
+}
+
+func TestWebhookDeliverGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	wn := &WebhookNotifier{Client: server.Client(), MaxAttempts: 3, Backoff: time.Millisecond}
+	ev := WebhookEvent{Event: "job.failed", JobID: "abc", Status: JOB_FAILED}
+	attempts := wn.deliver(Webhook{URL: server.URL}, ev, []byte("{}"))
+	assert.Equal(t, 3, len(attempts))
+	for _, d := range attempts {
+		assert.False(t, d.Success)
+		assert.NotEqual(t, "", d.Error)
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { lookupWebhookHost = lookup }(lookupWebhookHost)
+	lookupWebhookHost = func(host string) ([]net.IP, error) {
+		switch host {
+		case "hooks.example.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		case "redis":
+			return []net.IP{net.ParseIP("172.18.0.3")}, nil
+		}
+		return net.LookupIP(host)
+	}
+
+	assert.Nil(t, checkWebhookURL("https://hooks.example.com/sift"))
+	assert.Nil(t, checkWebhookURL("https://hooks.example.com:8443/sift"))
+	assert.Nil(t, checkWebhookURL("http://172.32.0.1/"))
+	bad := []string{
+		"ftp://hooks.example.com/sift",
+		"/relative",
+		"http://localhost:9090/feedback",
+		"http://127.0.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.8/",
+		"http://192.168.1.1/",
+		"http://100.64.0.1/",
+		"http://[::1]/",
+		"http://[fe80::1]/",
+		"http://[fd00::1]:8080/",
+		"http://172.31.255.255/",
+		"http://redis:6379/",
+	}
+	for _, u := range bad {
+		assert.NotNil(t, checkWebhookURL(u), u)
+	}
+}
+
+func TestWebhookClientRefusesInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Webhook was delivered to a loopback address")
+	}))
+	defer server.Close()
+
+	wn := &WebhookNotifier{Client: newWebhookClient(), MaxAttempts: 1, Backoff: time.Millisecond}
+	attempts := wn.deliver(Webhook{URL: server.URL}, WebhookEvent{Event: "job.completed"}, []byte("{}"))
+	assert.Equal(t, 1, len(attempts))
+	assert.False(t, attempts[0].Success)
+	assert.Contains(t, attempts[0].Error, errWebhookAddress.Error())
+}
+
+func TestWebhookDeliverNoRedirects(t *testing.T) {
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer server.Close()
+
+	client := newWebhookClient()
+	client.Transport = server.Client().Transport
+	wn := &WebhookNotifier{Client: client, MaxAttempts: 1, Backoff: time.Millisecond}
+	attempts := wn.deliver(Webhook{URL: server.URL}, WebhookEvent{Event: "job.completed"}, []byte("{}"))
+	assert.False(t, redirected)
+	assert.Equal(t, http.StatusFound, attempts[0].StatusCode)
+	assert.False(t, attempts[0].Success)
+}
+
+func TestRegisterWebhookUnauthenticated(t *testing.T) {
+	formData := url.Values{"url": {"https://example.com/hook"}}
+	req, err := http.NewRequest("POST", "/webhooks", strings.NewReader(formData.Encode()))
+	if err != nil {
+		t.Fatal("http.NewRequest", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.RegisterWebhook).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestRegisterWebhookForbidden(t *testing.T) {
+	prof := &Profile{UserName: "hook_user", CompanyID: 1, Role: ROLE_ANALYST}
+	formData := url.Values{"url": {"https://example.com/hook"}}
+	req, err := http.NewRequest("POST", "/webhooks", strings.NewReader(formData.Encode()))
+	if err != nil {
+		t.Fatal("http.NewRequest", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), "profile", prof))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.RegisterWebhook).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestRegisterWebhookGood(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { lookupWebhookHost = lookup }(lookupWebhookHost)
+	lookupWebhookHost = func(string) ([]net.IP, error) { return []net.IP{net.ParseIP("93.184.216.34")}, nil }
+	company := testCompany(t, "Hook Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	prof := &Profile{UserName: "hook_user", CompanyID: company.ID, Role: ROLE_ADMIN}
+	formData := url.Values{"url": {"https://example.com/hook"}}
+	req, err := http.NewRequest("POST", "/webhooks", strings.NewReader(formData.Encode()))
+	if err != nil {
+		t.Fatal("http.NewRequest", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = req.WithContext(context.WithValue(req.Context(), "profile", prof))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.RegisterWebhook).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var hook Webhook
+	if err := json.Unmarshal(rr.Body.Bytes(), &hook); err != nil {
+		t.Fatal("json.Unmarshal", err)
+	}
+	defer dm.Unscoped().Delete(&hook)
+	assert.Equal(t, company.ID, hook.CompanyID)
+	assert.Equal(t, 64, len(hook.Secret))
+
+	hooks, err := dm.ForCompany(company.ID).GetWebhooksHelper()
+	if err != nil {
+		t.Error("tenant.GetWebhooksHelper", err)
+	}
+	assert.Equal(t, 1, len(hooks))
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/gorilla/securecookie"
 	"github.com/jinzhu/gorm"
 )
@@ -9,30 +11,230 @@ import (
 // for managing and handling request to the database
 type DataManager struct {
 	*gorm.DB
-	*securecookie.SecureCookie
+	// Codecs session cookies are signed and encrypted with. The first encodes
+	// new cookies and all of them are tried when decoding, so keys can be
+	// rotated without signing everyone out (see LoadCookieKeys).
+	Cookies []securecookie.Codec
 }
 
-// NewDataManager constructs the DataManager
-// struct and initializes the secure cookie keys
-func NewDataManager(db *gorm.DB) DataManager {
-	key := securecookie.New(
-		securecookie.GenerateRandomKey(64),
-		securecookie.GenerateRandomKey(32))
+// NewDataManager constructs the DataManager struct with the given cookie
+// codecs. If none are given random keys are generated, and sessions will
+// not survive a restart.
+func NewDataManager(db *gorm.DB, cookies ...securecookie.Codec) DataManager {
+	if len(cookies) == 0 {
+		cookies = securecookie.CodecsFromPairs(
+			securecookie.GenerateRandomKey(64),
+			securecookie.GenerateRandomKey(32))
+	}
+	return DataManager{db, cookies}
+}
 
-	dm := DataManager{db, key}
-	return dm
+// Company is a tenant of the API. Every profile belongs to exactly one
+// company, and jobs, webhooks and schedules are scoped to it.
+type Company struct {
+	gorm.Model
+	Name     string          `gorm:"unique_index" json:"name"`
+	Address  string          `json:"address"`
+	Settings CompanySettings `gorm:"type:text" json:"settings"`
+	// Whether admins and owners must use two-factor authentication
+	RequireTwoFactor bool `json:"require_two_factor"`
 }
 
-// UserName and CompanyName must be unique in combination
+// UserName must be unique within a company. PwHash is a bcrypt hash (see
+// HashPassword) and is never serialized.
 type Profile struct {
 	gorm.Model
-	UserName    string `gorm:"primary_key"`
-	CompanyName string `gorm:"primary_key"`
-	PwHash      []byte
-	Address     string
+	UserName  string `gorm:"unique_index:idx_profile_user_company"`
+	CompanyID uint   `gorm:"unique_index:idx_profile_user_company"`
+	PwHash    []byte `json:"-"`
+	// Where password reset links are sent. Optional.
+	Email string
+	// One of ROLE_OWNER, ROLE_ADMIN, ROLE_ANALYST or ROLE_VIEWER
+	Role string
+	// Set on the stand-in profile of requests made with an API key, which
+	// hold only these permissions whatever the role. Never stored.
+	Scopes []Permission `gorm:"-" json:"-"`
+	// Whether logins need a TOTP code or recovery code as a second step.
+	// TOTPSecret is set when enrollment starts, and TOTPLastStep is the last
+	// time step a code was accepted for, so no code is accepted twice.
+	TwoFactorEnabled bool
+	TOTPSecret       string `json:"-"`
+	TOTPLastStep     int64  `json:"-"`
+	// Set on admins whose company requires two-factor authentication but who
+	// have not enabled it. They hold no permissions until they do. Never
+	// stored.
+	MustEnrollTwoFactor bool `gorm:"-"`
+}
+
+// PasswordHistory keeps the hashes of a user's previous passwords so they
+// cannot be reused (see PASSWORD_HISTORY_SIZE)
+type PasswordHistory struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	PwHash []byte
+}
+
+// PasswordResetToken is a single-use token emailed to a user so they can
+// reset a forgotten password. Only the SHA-256 of the token is stored.
+type PasswordResetToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"unique_index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// RecoveryCode lets a user with two-factor authentication sign in once
+// without their authenticator app. Only the SHA-256 of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint `gorm:"index"`
+	CodeHash string
+	UsedAt   *time.Time
 }
 
+// APIKey lets scripts call the API for a company without logging in. Only the
+// SHA-256 of the key is stored; Prefix is kept so users can tell keys apart.
+type APIKey struct {
+	gorm.Model
+	CompanyID uint `gorm:"index"`
+	Name      string
+	Prefix    string
+	KeyHash   string `gorm:"unique_index" json:"-"`
+	// Permissions the key grants, from apiKeyScopes
+	Scopes PermissionList `gorm:"type:text"`
+	// Profile that created the key
+	CreatedBy  uint
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// Invite lets a new user join a company by registering with its single-use
+// token. Only the SHA-256 of the token is stored.
+type Invite struct {
+	gorm.Model
+	CompanyID uint   `gorm:"index"`
+	TokenHash string `gorm:"unique_index" json:"-"`
+	// Role the invited user is given
+	Role string
+	// Profile that issued the invite
+	CreatedBy uint
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// Session is a login of a user on one device. A user may have any number of
+// sessions at once.
 type Session struct {
 	gorm.Model
 	UserID uint
+	// SHA-256 of the random token carried by the session's cookie
+	TokenHash string `gorm:"unique_index" json:"-"`
+	// A session ends at ExpiresAt, or once SESSION_IDLE_TIMEOUT passes
+	// without activity since LastSeenAt, whichever comes first
+	ExpiresAt  time.Time `gorm:"index"`
+	LastSeenAt time.Time
+	// Device the session was started from, for users reviewing their sessions
+	UserAgent string
+	IP        string
+}
+
+// RefreshToken lets a client that does not use cookies obtain new access
+// tokens (see IssueToken). Each is redeemed once for another of the same
+// Family; redeeming one twice means it was copied, so the family is revoked.
+// Only the SHA-256 of the token is stored.
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	Family    string `gorm:"index"`
+	TokenHash string `gorm:"unique_index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// Webhook is a URL that is notified when one of a company's analysis jobs
+// finishes. Events are signed with Secret (see SignWebhookPayload).
+type Webhook struct {
+	gorm.Model
+	CompanyID uint   `gorm:"index" json:"company_id"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// WebhookDelivery records a single attempt to deliver an event to a Webhook
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID  uint   `json:"webhook_id"`
+	JobID      string `json:"job_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Success    bool   `json:"success"`
+}
+
+// QueuedJob is a job held in the scheduler's queue. Envelope is the JSON
+// JobEnvelope so waiting jobs can be recovered after a restart. Owner is the
+// API instance holding the job, which refreshes HeartbeatAt while it runs.
+type QueuedJob struct {
+	gorm.Model
+	JobID       string `gorm:"unique_index"`
+	CompanyID   uint   `gorm:"index"`
+	Analysis    string
+	Envelope    string `gorm:"type:text"`
+	Status      string `gorm:"index"`
+	Owner       string `gorm:"index"`
+	HeartbeatAt time.Time
+}
+
+// CompanyQuota overrides the default job limits for a company
+type CompanyQuota struct {
+	gorm.Model
+	CompanyID     uint `gorm:"unique_index"`
+	MaxConcurrent int
+	MaxDaily      int
+}
+
+// CachedResult is the stored result of an analysis, keyed by the content hash
+// of the job that produced it (see ContentHash). Results are only shared
+// within the company that submitted the job.
+type CachedResult struct {
+	gorm.Model
+	CompanyID uint   `gorm:"index"`
+	Hash      string `gorm:"unique_index"`
+	Analysis  string
+	Result    string `gorm:"type:text"`
+}
+
+// FeedbackRecord is a piece of feedback uploaded by a company, kept so that
+// scheduled analyses can be run over recent feedback
+type FeedbackRecord struct {
+	gorm.Model
+	CompanyID uint   `gorm:"index"`
+	Body      string `gorm:"type:text"`
+}
+
+// Schedule runs an analysis over a company's recent feedback whenever its
+// cron expression matches. Params holds the analysis parameters as encoded
+// form values.
+type Schedule struct {
+	gorm.Model
+	CompanyID    uint       `gorm:"index" json:"company_id"`
+	Cron         string     `json:"cron"`
+	Analysis     string     `json:"analysis"`
+	Params       string     `json:"params"`
+	LookbackDays int        `json:"lookback_days"`
+	Paused       bool       `json:"paused"`
+	NextRunAt    time.Time  `json:"next_run_at"`
+	LastRunAt    *time.Time `json:"last_run_at"`
+}
+
+// ScheduleRun records one execution of a Schedule
+type ScheduleRun struct {
+	gorm.Model
+	ScheduleID    uint   `gorm:"index" json:"schedule_id"`
+	JobID         string `json:"job_id,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	FeedbackCount int    `json:"feedback_count"`
 }
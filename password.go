@@ -0,0 +1,130 @@
+// Server-side hashing and verification of user passwords
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Work factor passwords are hashed with. Raising it upgrades existing
+	// hashes on their owner's next login.
+	BCRYPT_COST = 12
+	// bcrypt ignores input past this length, so longer passwords are rejected
+	// rather than silently truncated
+	MAX_PASSWORD_LENGTH = 72
+	// Shortest password accepted when registering or changing passwords
+	MIN_PASSWORD_LENGTH = 8
+	// Number of a user's most recent passwords, including the current one,
+	// that a new password may not repeat
+	PASSWORD_HISTORY_SIZE = 5
+)
+
+// Compared against when a login names a user that does not exist, so that
+// failed logins take the same time whether or not the user exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("sift"), BCRYPT_COST)
+
+// HashPassword returns a salted bcrypt hash of password suitable for storing
+// in Profile.PwHash
+func HashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, errors.New("password must not be empty")
+	}
+	if len(password) > MAX_PASSWORD_LENGTH {
+		return nil, errors.New(fmt.Sprintf("password must be at most %d bytes", MAX_PASSWORD_LENGTH))
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+}
+
+// VerifyPassword reports whether password matches the stored hash. Profiles
+// created before passwords were hashed server-side hold whatever the client
+// sent verbatim; these are compared in constant time and reported as needing
+// a rehash, as are hashes made with an outdated cost.
+func VerifyPassword(stored []byte, password string) (ok bool, rehash bool) {
+	if len(stored) == 0 || password == "" {
+		return false, false
+	}
+	cost, err := bcrypt.Cost(stored)
+	if err != nil {
+		// Legacy plaintext row
+		ok = subtle.ConstantTimeCompare(stored, []byte(password)) == 1
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword(stored, []byte(password)) != nil {
+		return false, false
+	}
+	return true, cost != BCRYPT_COST
+}
+
+// passwordFromRequest reads the plaintext password from the `password` form
+// value, falling back to the `pw_hash` value sent by older clients
+func passwordFromRequest(r *http.Request) string {
+	if pw := r.FormValue("password"); pw != "" {
+		return pw
+	}
+	return r.FormValue("pw_hash")
+}
+
+// PasswordPolicy decides whether a new password is acceptable
+type PasswordPolicy struct {
+	MinLength int
+	// Lowercased passwords known from breaches, which are always rejected
+	breached map[string]bool
+}
+
+// Policy applied to passwords chosen by users. main loads the bundled
+// breached-password list into it on startup.
+var passwordPolicy = NewPasswordPolicy()
+
+// NewPasswordPolicy constructs a PasswordPolicy with the default minimum
+// length and an empty breached-password list
+func NewPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: MIN_PASSWORD_LENGTH, breached: make(map[string]bool)}
+}
+
+// LoadBreachedList adds the passwords in r, one per line, to the breached
+// list. Blank lines and lines starting with '#' are skipped.
+func (pp *PasswordPolicy) LoadBreachedList(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pp.breached[strings.ToLower(line)] = true
+	}
+	return scanner.Err()
+}
+
+// LoadBreachedFile adds the passwords in the file at path to the breached list
+func (pp *PasswordPolicy) LoadBreachedFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pp.LoadBreachedList(f)
+}
+
+// Check returns an error describing why password is not acceptable, or nil
+func (pp *PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < pp.MinLength {
+		return errors.New(fmt.Sprintf("password must be at least %d characters", pp.MinLength))
+	}
+	if len(password) > MAX_PASSWORD_LENGTH {
+		return errors.New(fmt.Sprintf("password must be at most %d bytes", MAX_PASSWORD_LENGTH))
+	}
+	if pp.breached[strings.ToLower(password)] {
+		return errors.New("password is too common, please choose another")
+	}
+	return nil
+}
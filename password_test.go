@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct horse battery staple")
+	assert.Nil(t, err)
+	assert.NotEqual(t, "correct horse battery staple", string(hash))
+
+	// Hashes are salted, so the same password hashes differently each time
+	again, err := HashPassword("correct horse battery staple")
+	assert.Nil(t, err)
+	assert.NotEqual(t, string(hash), string(again))
+
+	ok, rehash := VerifyPassword(hash, "correct horse battery staple")
+	assert.True(t, ok)
+	assert.False(t, rehash)
+	ok, _ = VerifyPassword(hash, "correct horse battery stapler")
+	assert.False(t, ok)
+}
+
+func TestHashPasswordInvalid(t *testing.T) {
+	_, err := HashPassword("")
+	assert.NotNil(t, err)
+	_, err = HashPassword(strings.Repeat("a", MAX_PASSWORD_LENGTH+1))
+	assert.NotNil(t, err)
+}
+
+func TestVerifyPasswordLegacy(t *testing.T) {
+	ok, rehash := VerifyPassword([]byte("cd026ec28d7976550a52da2520660bd8e26b5b40"),
+		"cd026ec28d7976550a52da2520660bd8e26b5b40")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, rehash = VerifyPassword([]byte("cd026ec28d7976550a52da2520660bd8e26b5b40"), "cd026ec2")
+	assert.False(t, ok)
+	assert.False(t, rehash)
+
+	ok, _ = VerifyPassword([]byte(""), "")
+	assert.False(t, ok)
+	ok, _ = VerifyPassword(nil, "abc123")
+	assert.False(t, ok)
+}
+
+func TestVerifyPasswordOutdatedCost(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("abc123"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	ok, rehash := VerifyPassword(hash, "abc123")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+}
+
+func TestPasswordFromRequest(t *testing.T) {
+	form := url.Values{"password": {"new"}, "pw_hash": {"old"}}
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, "new", passwordFromRequest(req))
+
+	form = url.Values{"pw_hash": {"old"}}
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, "old", passwordFromRequest(req))
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	pp := NewPasswordPolicy()
+	assert.Nil(t, pp.LoadBreachedList(strings.NewReader("# comment\n\nletmein123\nPassword1\n")))
+
+	assert.Nil(t, pp.Check("correct horse battery staple"))
+	assert.NotNil(t, pp.Check("short"))
+	assert.NotNil(t, pp.Check(strings.Repeat("a", MAX_PASSWORD_LENGTH+1)))
+	// Breached passwords are matched regardless of case
+	assert.NotNil(t, pp.Check("letmein123"))
+	assert.NotNil(t, pp.Check("LetMeIn123"))
+	assert.NotNil(t, pp.Check("password1"))
+	// Comments are not entries
+	assert.Nil(t, pp.Check("# comment"))
+}
+
+func TestPasswordPolicyBundledList(t *testing.T) {
+	pp := NewPasswordPolicy()
+	assert.Nil(t, pp.LoadBreachedFile("data/breached_passwords.txt"))
+	assert.NotNil(t, pp.Check("password123"))
+	assert.NotNil(t, pp.Check("qwertyuiop"))
+	assert.Nil(t, pp.Check("correct horse battery staple"))
+
+	assert.NotNil(t, pp.LoadBreachedFile("data/does_not_exist.txt"))
+}
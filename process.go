@@ -139,17 +139,35 @@ func WriteToCSV(fblist []Feedback) error {
 }
 
 // Handles uploads of multipart forms. Files should have form name `feedback`.
-// Uploaded files are stored in `./uploads`
-func FeedbackFormHandler(w http.ResponseWriter, r *http.Request) {
+// The optional form value `analysis` selects a registered analysis type, and
+// defaults to DEFAULT_ANALYSIS. Any other form values are parsed as that
+// analysis type's parameters (see jobparams.go).
+// The analysis is run in the background; the response is a 202 with the
+// job's status, whose progress can be followed at /jobs/{id}/events. If an
+// identical upload has already been analysed the response is a 200 with a
+// completed job marked `cached`, unless the form value `force` is "true".
+func (jr *JobRunner) FeedbackFormHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("/feedback")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
+	// Anonymous uploads are allowed, but logged in users need a role that
+	// can run analyses
+	if profile, ok := ProfileFromContext(r); ok && !HasPermission(profile, PERM_SUBMIT_JOBS) {
+		http.Error(w, "Your role does not allow running analyses", http.StatusForbidden)
+		return
+	}
+
 	if err := r.ParseMultipartForm(MAX_FILE_SIZE); err != nil {
 		fmt.Println("Error parsing form: " + err.Error())
 		http.Error(w, "Could not parse file upload", http.StatusInternalServerError)
 		return
 	}
+	analysis, err := GetAnalysisType(r.FormValue("analysis"))
+	if err != nil {
+		fmt.Println("GetAnalysisType: " + err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	file, _, err := r.FormFile("feedback")
 	if err != nil {
 		fmt.Println("Error creating form file: " + err.Error())
@@ -157,58 +175,67 @@ func FeedbackFormHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	var payload interface{}
-	// Perform malformed JSON check first so file position can be reset
-	malformed := IsMalformedJSON(file)
-	// Reset file position
-	file.Seek(0, 0)
-	if malformed {
-		payload, err = ProcessJSON(file)
-		if err != nil {
-			fmt.Println("Error processing invalid JSON payload: " + err.Error())
-			http.Error(w, "Could not process file upload", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		if err = json.NewDecoder(file).Decode(payload); err != nil {
-			fmt.Println("Error decoding valid JSON payload: " + err.Error())
-			http.Error(w, "Could not process file upload", http.StatusInternalServerError)
-			return
-		}
-	}
-	// payload, err := ProcessJSON(file)
+	// ProcessJSON accepts both strict and 'loose' JSON, so both are
+	// normalized to the same []Feedback before being sent to workers
+	feedback, err := ProcessJSON(file)
 	if err != nil {
-		fmt.Println("Error processing invalid JSON payload: " + err.Error())
+		fmt.Println("Error processing JSON payload: " + err.Error())
 		http.Error(w, "Could not process file upload", http.StatusInternalServerError)
 		return
 	}
 
+	params, err := analysis.ParseParams(r.Form)
 	if err != nil {
-		fmt.Println("Error parsing JSON payload: " + err.Error())
+		fmt.Println("Invalid analysis parameters: " + err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	payload := NewJobEnvelope(analysis.Name, params, feedback)
 
-	api, err := NewCeleryAPI(AMQP_URL, REDIS_URL)
-	if err != nil {
-		fmt.Println("Error creating celery API: ", err.Error())
+	// Jobs from logged in users are attributed to their company so that
+	// the company's webhooks are notified when they finish, and their
+	// feedback is kept for scheduled analyses
+	var company uint
+	if profile, ok := ProfileFromContext(r); ok {
+		company = profile.CompanyID
+	}
+	// Anonymous uploads share no company quota, so each client is limited
+	if company == 0 && !jr.anonymous.Allow(clientIP(r)) {
+		http.Error(w, ErrDailyQuotaExceeded.Error(), http.StatusTooManyRequests)
 		return
 	}
-
-	resultChannel := make(chan *CeleryResult)
-	go api.RunJob("sift.jobrunner.jobs.lda_nlp.run", payload, resultChannel)
-	result := <-resultChannel
-	close(resultChannel)
-
-	if result.Error != nil {
-		fmt.Println("Error running job: " + result.Error.Error())
+	// Identical uploads are answered from the result cache unless the client
+	// forces a re-run
+	force := r.FormValue("force") == "true"
+	job, err := jr.Submit(company, analysis, payload, force)
+	if err == ErrDailyQuotaExceeded {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		fmt.Println("Error submitting job: " + err.Error())
+		http.Error(w, "Could not start analysis", http.StatusInternalServerError)
 		return
 	}
+	// Only feedback that was accepted for a new analysis is kept, so that
+	// rejected and repeated uploads are not counted twice by schedules
+	status := job.Status()
+	if company != 0 && jr.archive != nil && !status.Cached {
+		if err := jr.archive(company, feedback); err != nil {
+			// The analysis is already running, so the upload still succeeds
+			fmt.Println("Error storing feedback: " + err.Error())
+		}
+	}
 
-	fmt.Println("Job result: ", result.Body)
-	body, err := json.Marshal(result.Body)
+	body, err := json.Marshal(status)
 	if err != nil {
 		fmt.Println("Error mashalling job response: " + err.Error())
 		return
 	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	if status.Cached {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusAccepted)
+	}
 	w.Write(body)
 }
@@ -3,8 +3,15 @@ package main
 import (
 	"testing"
 
+	"bytes"
 	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIsMalformedJSONTrue(t *testing.T) {
@@ -73,6 +80,81 @@ func TestProcessJSONFormatted(t *testing.T) {
 	}
 }
 
+// feedbackUpload builds a /feedback request uploading a single piece of
+// feedback for analysis
+func feedbackUpload(t *testing.T, analysis, text string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("analysis", analysis)
+	part, err := writer.CreateFormFile("feedback", "feedback.json")
+	if err != nil {
+		t.Fatal("writer.CreateFormFile: ", err)
+	}
+	json.NewEncoder(part).Encode([]map[string]string{{"reviewText": text}})
+	if err := writer.Close(); err != nil {
+		t.Fatal("writer.Close: ", err)
+	}
+	req, err := http.NewRequest("POST", "/feedback", body)
+	if err != nil {
+		t.Fatal("http.NewRequest: ", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestFeedbackFormHandlerAnonymousLimit(t *testing.T) {
+	jr := newFakeRunner(&fakeQueue{states: []*TaskState{{Status: "PENDING"}}})
+	jr.anonymous = NewRateLimiter(2, time.Hour)
+	upload := func(addr string) int {
+		req := feedbackUpload(t, "sentiment", "Bleh")
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(jr.FeedbackFormHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, upload("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusAccepted, upload("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, upload("192.0.2.1:1234"))
+	// Other clients are unaffected
+	assert.Equal(t, http.StatusAccepted, upload("192.0.2.2:1234"))
+}
+
+func TestFeedbackFormHandlerArchivesAcceptedUploads(t *testing.T) {
+	jr := newFakeRunner(&fakeQueue{states: []*TaskState{{Status: "SUCCESS", Result: []interface{}{0.5}}}})
+	jr.UseCache(&memResultCache{results: make(map[string]json.RawMessage)})
+	store := &memJobQueue{quotas: map[uint]JobQuota{1: {MaxConcurrent: 1, MaxDaily: 2}}}
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+	var archived []string
+	jr.UseArchive(func(companyID uint, fb []Feedback) error {
+		archived = append(archived, fb[0].FBody)
+		return nil
+	})
+	upload := func(text string) *httptest.ResponseRecorder {
+		req := withProfile(feedbackUpload(t, "sentiment", text), &Profile{CompanyID: 1, Role: ROLE_ANALYST})
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(jr.FeedbackFormHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := upload("Bleh")
+	assert.Equal(t, http.StatusAccepted, first.Code)
+	var status JobStatus
+	json.Unmarshal(first.Body.Bytes(), &status)
+	job, _ := jr.GetJob(status.ID)
+	waitForJob(t, job)
+
+	// Repeated uploads answered from the cache are not archived again
+	assert.Equal(t, http.StatusOK, upload("Bleh").Code)
+	// Nor are uploads rejected by the daily quota
+	assert.Equal(t, http.StatusAccepted, upload("Blah").Code)
+	assert.Equal(t, http.StatusTooManyRequests, upload("Bluh").Code)
+	assert.Equal(t, []string{"Bleh", "Blah"}, archived)
+}
+
 func BenchmarkJSONFull(b *testing.B) {
 	// NOTE: hk_feedback.json is a local file containing all Home and Kitchen review
 	// data from Amazon (see README), which I did not commit because of file size.
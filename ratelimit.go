@@ -0,0 +1,144 @@
+// In-memory rate limiting of sensitive endpoints
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter allows at most Limit events per key in any sliding Window
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+	// Replaced in tests
+	now func() time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Limit:  limit,
+		Window: window,
+		hits:   make(map[string][]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+// Events over the limit are not recorded, so a blocked key is allowed again
+// once its earlier events leave the window.
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	cutoff := now.Add(-rl.Window)
+	// Periodically forget keys with no recent events so the map stays small
+	if now.Sub(rl.lastSweep) > rl.Window {
+		for k, times := range rl.hits {
+			if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+				delete(rl.hits, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	times := rl.hits[key]
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	times = times[i:]
+	if len(times) >= rl.Limit {
+		rl.hits[key] = times
+		return false
+	}
+	rl.hits[key] = append(times, now)
+	return true
+}
+
+// Addresses of the load balancers and reverse proxies in front of the API,
+// whose X-Forwarded-For headers are believed. Set from the -trustedproxies
+// flag.
+var trustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges, such as "10.0.0.0/8,192.0.2.7"
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("invalid trusted proxy address " + entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy range " + entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Reports whether addr is one of the trustedProxies
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address a request was sent from. When the request
+// came through a trusted proxy, this is the address the nearest trusted
+// proxy in X-Forwarded-For received it from. Otherwise forwarding headers
+// are ignored, since they are set by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	// Each proxy appends the address it received the request from, so the
+	// entries left of the last trusted proxy may be forged by the client
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		host = hops[i]
+		if !trustedProxy(host) {
+			break
+		}
+	}
+	return host
+}
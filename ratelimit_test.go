@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(2, time.Minute)
+	rl.now = func() time.Time { return now }
+
+	assert.True(t, rl.Allow("a"))
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+	// Keys are limited independently
+	assert.True(t, rl.Allow("b"))
+
+	// Blocked attempts are not counted, so the key frees up a window after
+	// its allowed events
+	now = now.Add(30 * time.Second)
+	assert.False(t, rl.Allow("a"))
+	now = now.Add(31 * time.Second)
+	assert.True(t, rl.Allow("a"))
+	assert.True(t, rl.Allow("a"))
+	assert.False(t, rl.Allow("a"))
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(1, time.Minute)
+	rl.now = func() time.Time { return now }
+	rl.Allow("a")
+	rl.Allow("b")
+	now = now.Add(2 * time.Minute)
+	rl.Allow("c")
+	assert.Equal(t, 1, len(rl.hits))
+}
+
+func TestClientIP(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/password/forgot", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+	req.RemoteAddr = "[::1]:51234"
+	assert.Equal(t, "::1", clientIP(req))
+}
+
+func TestClientIPTrustedProxy(t *testing.T) {
+	defer func(nets []*net.IPNet) { trustedProxies = nets }(trustedProxies)
+	var err error
+	if trustedProxies, err = ParseTrustedProxies("10.0.0.0/8, 192.0.2.7"); err != nil {
+		t.Fatal("ParseTrustedProxies: ", err)
+	}
+	req, _ := http.NewRequest("POST", "/password/forgot", nil)
+	req.RemoteAddr = "10.0.0.1:51234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+
+	// Addresses the client added before reaching a trusted proxy are ignored
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 192.0.2.7")
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+	req.Header.Set("X-Forwarded-For", "garbage, 1.2.3.4")
+	assert.Equal(t, "1.2.3.4", clientIP(req))
+
+	// Without a forwarding header the proxy's own address is used
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+
+	// Untrusted peers cannot pick their address
+	req.RemoteAddr = "203.0.113.9:51234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "203.0.113.9", clientIP(req))
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.NotNil(t, err)
+	_, err = ParseTrustedProxies("proxy.local")
+	assert.NotNil(t, err)
+}
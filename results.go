@@ -0,0 +1,257 @@
+// Typed decoding and validation of results returned by Celery workers.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Tolerance allowed when checking that a document's topic weights sum to 1
+const WEIGHT_SUM_TOLERANCE = 0.01
+
+// TopicModelResult is the stable schema returned to clients for LDA analyses:
+//
+//	{
+//	  "analysis": "lda_topics",
+//	  "num_topics": 2,
+//	  "topics": [{"topic_id": 0, "terms": [{"term": "blender", "weight": 0.12}]}],
+//	  "documents": [{"fb_id": 0, "topics": [{"topic_id": 0, "weight": 0.9}]}]
+//	}
+//
+// Fields are only ever added to this schema, never renamed or removed.
+type TopicModelResult struct {
+	Analysis  string           `json:"analysis"`
+	NumTopics int              `json:"num_topics"`
+	Topics    []Topic          `json:"topics"`
+	Documents []DocumentTopics `json:"documents"`
+}
+
+// Topic is a single LDA topic and its highest-weighted terms, in descending
+// order of weight
+type Topic struct {
+	ID    int         `json:"topic_id"`
+	Terms []TopicTerm `json:"terms"`
+}
+
+type TopicTerm struct {
+	Term   string  `json:"term"`
+	Weight float64 `json:"weight"`
+}
+
+// DocumentTopics is the topic distribution of one piece of feedback
+type DocumentTopics struct {
+	FeedbackID uint64        `json:"fb_id"`
+	Topics     []TopicWeight `json:"topics"`
+}
+
+type TopicWeight struct {
+	TopicID int     `json:"topic_id"`
+	Weight  float64 `json:"weight"`
+}
+
+// FeedbackResults is the schema returned to clients for map-style analyses
+// such as sentiment and keyword extraction, which produce one result per
+// feedback. Results are keyed by Feedback.ID:
+//
+//	{"analysis": "sentiment", "results": {"0": {"polarity": 0.8}, "1": ...}}
+type FeedbackResults struct {
+	Analysis string                 `json:"analysis"`
+	Results  map[uint64]interface{} `json:"results"`
+}
+
+// ldaWorkerResult is the shape of the result returned by the LDA worker.
+// Topics are indexed by topic ID and DocTopics by the position of the
+// feedback in the JobEnvelope sent to the worker.
+type ldaWorkerResult struct {
+	Topics    [][]workerPair `json:"topics"`
+	DocTopics [][]workerPair `json:"doc_topics"`
+}
+
+// workerPair decodes either a gensim-style `[key, weight]` pair or an object
+// of the form `{"term"|"topic_id": key, "weight": weight}`, so that either
+// serialization from the worker is accepted.
+type workerPair struct {
+	Key    interface{}
+	Weight float64
+}
+
+func (wp *workerPair) UnmarshalJSON(data []byte) error {
+	var pair []interface{}
+	if err := json.Unmarshal(data, &pair); err == nil {
+		if len(pair) != 2 {
+			return errors.New(fmt.Sprintf("expected [key, weight] pair, got %d elements", len(pair)))
+		}
+		weight, ok := pair[1].(float64)
+		if !ok {
+			return errors.New(fmt.Sprintf("weight must be a number, was %v", pair[1]))
+		}
+		wp.Key, wp.Weight = pair[0], weight
+		return nil
+	}
+	var obj struct {
+		Term    *string  `json:"term"`
+		TopicID *float64 `json:"topic_id"`
+		Weight  *float64 `json:"weight"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	if obj.Weight == nil {
+		return errors.New("pair is missing weight")
+	}
+	switch {
+	case obj.Term != nil:
+		wp.Key = *obj.Term
+	case obj.TopicID != nil:
+		wp.Key = *obj.TopicID
+	default:
+		return errors.New("pair is missing term or topic_id")
+	}
+	wp.Weight = *obj.Weight
+	return nil
+}
+
+func validWeight(w float64) bool {
+	return !math.IsNaN(w) && w >= 0 && w <= 1
+}
+
+// DecodeTopicModelResult converts the raw body of an LDA job into a
+// validated TopicModelResult. fb must be the feedback sent to the worker, in
+// the same order, so that document distributions can be mapped back to
+// Feedback.ID.
+func DecodeTopicModelResult(body interface{}, fb []Feedback) (*TopicModelResult, error) {
+	// Celery results arrive as generic JSON values, so round-trip through
+	// encoding/json to decode them into typed structs
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var wr ldaWorkerResult
+	if err := json.Unmarshal(raw, &wr); err != nil {
+		return nil, errors.New("Malformed LDA result: " + err.Error())
+	}
+
+	if len(wr.Topics) == 0 {
+		return nil, errors.New("LDA result contains no topics")
+	}
+	if len(wr.DocTopics) != len(fb) {
+		return nil, errors.New(fmt.Sprintf("LDA result has %d document distributions for %d feedback",
+			len(wr.DocTopics), len(fb)))
+	}
+
+	res := &TopicModelResult{
+		Analysis:  "lda_topics",
+		NumTopics: len(wr.Topics),
+		Topics:    make([]Topic, len(wr.Topics)),
+		Documents: make([]DocumentTopics, len(fb)),
+	}
+
+	for id, terms := range wr.Topics {
+		topic := Topic{ID: id, Terms: make([]TopicTerm, 0, len(terms))}
+		for _, p := range terms {
+			term, ok := p.Key.(string)
+			if !ok || term == "" {
+				return nil, errors.New(fmt.Sprintf("Topic %d has an invalid term %v", id, p.Key))
+			}
+			if !validWeight(p.Weight) {
+				return nil, errors.New(fmt.Sprintf("Topic %d term %q has invalid weight %v", id, term, p.Weight))
+			}
+			topic.Terms = append(topic.Terms, TopicTerm{term, p.Weight})
+		}
+		res.Topics[id] = topic
+	}
+
+	for i, dist := range wr.DocTopics {
+		doc := DocumentTopics{FeedbackID: fb[i].ID, Topics: make([]TopicWeight, 0, len(dist))}
+		sum := 0.0
+		for _, p := range dist {
+			fid, ok := p.Key.(float64)
+			tid := int(fid)
+			if !ok || float64(tid) != fid || tid < 0 || tid >= res.NumTopics {
+				return nil, errors.New(fmt.Sprintf("Feedback %d references invalid topic %v", fb[i].ID, p.Key))
+			}
+			if !validWeight(p.Weight) {
+				return nil, errors.New(fmt.Sprintf("Feedback %d has invalid weight %v for topic %d",
+					fb[i].ID, p.Weight, tid))
+			}
+			sum += p.Weight
+			doc.Topics = append(doc.Topics, TopicWeight{tid, p.Weight})
+		}
+		if sum > 1+WEIGHT_SUM_TOLERANCE {
+			return nil, errors.New(fmt.Sprintf("Feedback %d topic weights sum to %v", fb[i].ID, sum))
+		}
+		res.Documents[i] = doc
+	}
+
+	return res, nil
+}
+
+// DecodeFeedbackResults converts the raw body of a map-style job into
+// FeedbackResults. Workers may return a list of results in the same order as
+// fb, a list of objects each carrying an "fb_id", or an object keyed by
+// fb_id. Every feedback in fb must have exactly one result.
+func DecodeFeedbackResults(analysis string, body interface{}, fb []Feedback) (*FeedbackResults, error) {
+	expected := make(map[uint64]bool, len(fb))
+	for _, f := range fb {
+		expected[f.ID] = true
+	}
+	res := &FeedbackResults{Analysis: analysis, Results: make(map[uint64]interface{}, len(fb))}
+	add := func(id uint64, r interface{}) error {
+		if !expected[id] {
+			return errors.New(fmt.Sprintf("result for unknown feedback %d", id))
+		}
+		if _, dup := res.Results[id]; dup {
+			return errors.New(fmt.Sprintf("duplicate result for feedback %d", id))
+		}
+		res.Results[id] = r
+		return nil
+	}
+
+	switch raw := body.(type) {
+	case []interface{}:
+		for i, r := range raw {
+			if obj, ok := r.(map[string]interface{}); ok {
+				if fid, ok := obj["fb_id"].(float64); ok {
+					if err := add(uint64(fid), r); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+			if i >= len(fb) {
+				return nil, errors.New(fmt.Sprintf("%d results for %d feedback", len(raw), len(fb)))
+			}
+			if err := add(fb[i].ID, r); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k, r := range raw {
+			id, err := strconv.ParseUint(k, 10, 64)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("result key %q is not a feedback ID", k))
+			}
+			if err := add(id, r); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Malformed %s result of type %T", analysis, body))
+	}
+
+	if len(res.Results) != len(expected) {
+		return nil, errors.New(fmt.Sprintf("%s result covers %d of %d feedback",
+			analysis, len(res.Results), len(expected)))
+	}
+	return res, nil
+}
+
+// decodeLDAResult adapts DecodeTopicModelResult to the registry's result
+// decoder signature
+func decodeLDAResult(body interface{}, fb []Feedback) (interface{}, error) {
+	return DecodeTopicModelResult(body, fb)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var resultFeedback = []Feedback{
+	{ID: 7, FBody: "Blender is loud"},
+	{ID: 9, FBody: "Toaster burns bread"},
+}
+
+func decodeBody(t *testing.T, raw string) interface{} {
+	var body interface{}
+	if err := json.Unmarshal([]byte(raw), &body); err != nil {
+		t.Fatal("json.Unmarshal: ", err)
+	}
+	return body
+}
+
+func TestDecodeTopicModelResultPairs(t *testing.T) {
+	body := decodeBody(t, `{
+		"topics": [[["blender", 0.4], ["loud", 0.3]], [["toaster", 0.5]]],
+		"doc_topics": [[[0, 0.9], [1, 0.1]], [[1, 1.0]]]
+	}`)
+	res, err := DecodeTopicModelResult(body, resultFeedback)
+	if err != nil {
+		t.Fatal("DecodeTopicModelResult: ", err)
+	}
+	assert.Equal(t, 2, res.NumTopics)
+	assert.Equal(t, TopicTerm{"blender", 0.4}, res.Topics[0].Terms[0])
+	assert.Equal(t, 1, res.Topics[1].ID)
+	assert.Equal(t, uint64(7), res.Documents[0].FeedbackID)
+	assert.Equal(t, uint64(9), res.Documents[1].FeedbackID)
+	assert.Equal(t, TopicWeight{1, 1.0}, res.Documents[1].Topics[0])
+}
+
+func TestDecodeTopicModelResultObjects(t *testing.T) {
+	body := decodeBody(t, `{
+		"topics": [[{"term": "blender", "weight": 0.4}]],
+		"doc_topics": [[{"topic_id": 0, "weight": 1}], []]
+	}`)
+	res, err := DecodeTopicModelResult(body, resultFeedback)
+	if err != nil {
+		t.Fatal("DecodeTopicModelResult: ", err)
+	}
+	assert.Equal(t, "blender", res.Topics[0].Terms[0].Term)
+	assert.Equal(t, 0, len(res.Documents[1].Topics))
+}
+
+func TestDecodeTopicModelResultInvalid(t *testing.T) {
+	bad := []string{
+		`"not an object"`,
+		`{"topics": [], "doc_topics": [[], []]}`,
+		`{"topics": [[["a", 0.5]]], "doc_topics": [[]]}`,
+		`{"topics": [[["a", 1.5]]], "doc_topics": [[], []]}`,
+		`{"topics": [[[3, 0.5]]], "doc_topics": [[], []]}`,
+		`{"topics": [[["a", 0.5]]], "doc_topics": [[[1, 0.5]], []]}`,
+		`{"topics": [[["a", 0.5]]], "doc_topics": [[[0.5, 0.5]], []]}`,
+		`{"topics": [[["a", 0.5]]], "doc_topics": [[[0, 0.8], [0, 0.8]], []]}`,
+	}
+	for _, raw := range bad {
+		if _, err := DecodeTopicModelResult(decodeBody(t, raw), resultFeedback); err == nil {
+			t.Errorf("Expected error decoding %s", raw)
+		}
+	}
+}
+
+func TestDecodeFeedbackResults(t *testing.T) {
+	shapes := []string{
+		`[{"polarity": 0.1}, {"polarity": -0.4}]`,
+		`[{"fb_id": 9, "polarity": -0.4}, {"fb_id": 7, "polarity": 0.1}]`,
+		`{"7": {"polarity": 0.1}, "9": {"polarity": -0.4}}`,
+	}
+	for _, raw := range shapes {
+		res, err := DecodeFeedbackResults("sentiment", decodeBody(t, raw), resultFeedback)
+		if err != nil {
+			t.Fatalf("DecodeFeedbackResults(%s): %v", raw, err)
+		}
+		assert.Equal(t, 2, len(res.Results))
+		assert.Equal(t, 0.1, res.Results[7].(map[string]interface{})["polarity"])
+		assert.Equal(t, -0.4, res.Results[9].(map[string]interface{})["polarity"])
+	}
+}
+
+func TestDecodeFeedbackResultsInvalid(t *testing.T) {
+	bad := []string{
+		`"positive"`,
+		`[{"polarity": 0.1}]`,
+		`[1, 2, 3]`,
+		`{"7": 1, "8": 2}`,
+		`{"seven": 1, "9": 2}`,
+		`[{"fb_id": 7}, {"fb_id": 7}]`,
+	}
+	for _, raw := range bad {
+		if _, err := DecodeFeedbackResults("sentiment", decodeBody(t, raw), resultFeedback); err == nil {
+			t.Errorf("Expected error decoding %s", raw)
+		}
+	}
+}
+
+func TestDecodeResultPassthrough(t *testing.T) {
+	at, err := GetAnalysisType("summarization")
+	if err != nil {
+		t.Fatal("GetAnalysisType: ", err)
+	}
+	body := map[string]interface{}{"score": 0.5}
+	decoded, err := at.DecodeResult(body, resultFeedback)
+	assert.Nil(t, err)
+	assert.Equal(t, body, decoded)
+}
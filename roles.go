@@ -0,0 +1,188 @@
+// Roles of users within their company and the permissions they grant
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Roles, from most to least privileged. Each role has every permission of
+// the roles below it.
+const (
+	// Manages the company itself and the roles of everyone in it
+	ROLE_OWNER = "owner"
+	// Manages profiles and integrations such as webhooks
+	ROLE_ADMIN = "admin"
+	// Runs analyses
+	ROLE_ANALYST = "analyst"
+	// Views analyses and their results
+	ROLE_VIEWER = "viewer"
+)
+
+var roleRanks = map[string]int{
+	ROLE_OWNER:   4,
+	ROLE_ADMIN:   3,
+	ROLE_ANALYST: 2,
+	ROLE_VIEWER:  1,
+}
+
+// Permission is an action a role may be allowed to take
+type Permission string
+
+const (
+	PERM_VIEW_DATA           Permission = "view_data"
+	PERM_SUBMIT_JOBS         Permission = "submit_jobs"
+	PERM_MANAGE_INTEGRATIONS Permission = "manage_integrations"
+	PERM_MANAGE_PROFILES     Permission = "manage_profiles"
+	PERM_MANAGE_ROLES        Permission = "manage_roles"
+	PERM_MANAGE_COMPANY      Permission = "manage_company"
+)
+
+// Least privileged role holding each permission
+var permissionRoles = map[Permission]string{
+	PERM_VIEW_DATA:           ROLE_VIEWER,
+	PERM_SUBMIT_JOBS:         ROLE_ANALYST,
+	PERM_MANAGE_INTEGRATIONS: ROLE_ADMIN,
+	PERM_MANAGE_PROFILES:     ROLE_ADMIN,
+	PERM_MANAGE_ROLES:        ROLE_OWNER,
+	PERM_MANAGE_COMPANY:      ROLE_OWNER,
+}
+
+// ValidRole reports whether role is one of the defined roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// roleOutranks reports whether role a is more privileged than role b
+func roleOutranks(a, b string) bool {
+	return roleRanks[a] > roleRanks[b]
+}
+
+// HasPermission reports whether p's role grants perm. Profiles without a
+// valid role have no permissions, nor do admins who must enroll in two-factor
+// authentication. Profiles standing in for an API key hold exactly the key's
+// scopes.
+func HasPermission(p *Profile, perm Permission) bool {
+	min, ok := permissionRoles[perm]
+	if !ok || p.MustEnrollTwoFactor {
+		return false
+	}
+	if p.Scopes != nil {
+		return PermissionList(p.Scopes).Has(perm)
+	}
+	rank, ok := roleRanks[p.Role]
+	return ok && rank >= roleRanks[min]
+}
+
+// ViaAPIKey reports whether p stands in for an API key rather than a user
+func (p *Profile) ViaAPIKey() bool {
+	return p.Scopes != nil
+}
+
+// RequirePermission returns the caller attached to r by SessionMiddleware if
+// they hold perm. Otherwise it writes a 401 or 403 to w and returns false.
+func RequirePermission(w http.ResponseWriter, r *http.Request, perm Permission) (*Profile, bool) {
+	caller, ok := ProfileFromContext(r)
+	if !ok {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return nil, false
+	}
+	if caller.MustEnrollTwoFactor {
+		http.Error(w, "Your company requires two-factor authentication, enable it to continue", http.StatusForbidden)
+		return nil, false
+	}
+	if !HasPermission(caller, perm) {
+		http.Error(w, fmt.Sprintf("Your role does not allow %s", perm), http.StatusForbidden)
+		return nil, false
+	}
+	return caller, true
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// countOwnersHelper counts the owners of the company
+func (t *TenantDB) countOwnersHelper() (n int, err error) {
+	err = t.Query(&Profile{}).Where("role = ?", ROLE_OWNER).Count(&n).Error
+	return
+}
+
+// MigrateRolesHelper assigns roles to profiles created before roles existed.
+// The earliest profile of each company without an owner becomes its owner,
+// and every other profile without a role becomes an analyst.
+func (dm *DataManager) MigrateRolesHelper() error {
+	var unassigned []Profile
+	if err := dm.Where("role = ? OR role IS NULL", "").Order("id").Find(&unassigned).Error; err != nil {
+		return err
+	}
+	tx := dm.Begin()
+	txdm := &DataManager{tx, dm.Cookies}
+	for _, p := range unassigned {
+		owners, err := txdm.ForCompany(p.CompanyID).countOwnersHelper()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		role := ROLE_ANALYST
+		if owners == 0 {
+			role = ROLE_OWNER
+		}
+		if err := tx.Model(&Profile{}).Where("id = ?", p.ID).Update("role", role).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+/* -------------------------------------------------------------------------- */
+
+// SetProfileRole sets the role of the user in the URL to the `role` form
+// value. Only owners may change roles, and only within their company. The
+// last owner of a company cannot give up ownership.
+func (dm *DataManager) SetProfileRole(w http.ResponseWriter, r *http.Request) {
+	caller, ok := RequirePermission(w, r, PERM_MANAGE_ROLES)
+	if !ok {
+		return
+	}
+	rsrc := parseProfileQuery(r.URL.Path)
+	cn, un := rsrc[2], rsrc[3]
+	if un == "" || cn == "" {
+		http.Error(w, "One or more credentials were blank", http.StatusBadRequest)
+		return
+	}
+	role := r.FormValue("role")
+	if !ValidRole(role) {
+		http.Error(w, fmt.Sprintf("role must be one of %s, %s, %s or %s",
+			ROLE_OWNER, ROLE_ADMIN, ROLE_ANALYST, ROLE_VIEWER), http.StatusBadRequest)
+		return
+	}
+	if company, err := dm.GetCompanyByNameHelper(cn); err != nil || company.ID != caller.CompanyID {
+		http.Error(w, "Not allowed to access this profile", http.StatusForbidden)
+		return
+	}
+	tenant := dm.ForCompany(caller.CompanyID)
+	target, err := tenant.GetProfileHelper(un)
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusBadRequest)
+		return
+	}
+	if target.Role == ROLE_OWNER && role != ROLE_OWNER {
+		owners, err := tenant.countOwnersHelper()
+		if err != nil {
+			fmt.Println("tenant.countOwnersHelper: ", err)
+			http.Error(w, "Database error on role update", http.StatusInternalServerError)
+			return
+		}
+		if owners <= 1 {
+			http.Error(w, "A company must have at least one owner", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := tenant.Query(&Profile{}).Where("id = ?", target.ID).Update("role", role).Error; err != nil {
+		fmt.Println("dm.Update: ", err)
+		http.Error(w, "Database error on role update", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasPermission(t *testing.T) {
+	cases := []struct {
+		role    string
+		allowed []Permission
+		denied  []Permission
+	}{
+		{ROLE_OWNER, []Permission{PERM_VIEW_DATA, PERM_SUBMIT_JOBS, PERM_MANAGE_INTEGRATIONS,
+			PERM_MANAGE_PROFILES, PERM_MANAGE_ROLES}, nil},
+		{ROLE_ADMIN, []Permission{PERM_VIEW_DATA, PERM_SUBMIT_JOBS, PERM_MANAGE_INTEGRATIONS,
+			PERM_MANAGE_PROFILES}, []Permission{PERM_MANAGE_ROLES}},
+		{ROLE_ANALYST, []Permission{PERM_VIEW_DATA, PERM_SUBMIT_JOBS},
+			[]Permission{PERM_MANAGE_INTEGRATIONS, PERM_MANAGE_PROFILES, PERM_MANAGE_ROLES}},
+		{ROLE_VIEWER, []Permission{PERM_VIEW_DATA},
+			[]Permission{PERM_SUBMIT_JOBS, PERM_MANAGE_INTEGRATIONS, PERM_MANAGE_PROFILES, PERM_MANAGE_ROLES}},
+		{"", nil, []Permission{PERM_VIEW_DATA, PERM_SUBMIT_JOBS}},
+		{"superuser", nil, []Permission{PERM_VIEW_DATA, PERM_MANAGE_ROLES}},
+	}
+	for _, c := range cases {
+		p := &Profile{Role: c.role}
+		for _, perm := range c.allowed {
+			assert.True(t, HasPermission(p, perm), "%q should have %s", c.role, perm)
+		}
+		for _, perm := range c.denied {
+			assert.False(t, HasPermission(p, perm), "%q should not have %s", c.role, perm)
+		}
+	}
+	assert.False(t, HasPermission(&Profile{Role: ROLE_OWNER}, Permission("fly")))
+}
+
+func TestRequirePermission(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/schedules", nil)
+	rr := httptest.NewRecorder()
+	_, ok := RequirePermission(rr, req, PERM_VIEW_DATA)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	_, ok = RequirePermission(rr, withProfile(req, &Profile{Role: ROLE_VIEWER}), PERM_SUBMIT_JOBS)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	caller := &Profile{UserName: "analyst", Role: ROLE_ANALYST}
+	rr = httptest.NewRecorder()
+	got, ok := RequirePermission(rr, withProfile(req, caller), PERM_SUBMIT_JOBS)
+	assert.True(t, ok)
+	assert.Equal(t, caller, got)
+}
+
+func setRole(caller *Profile, cn, un, role string) *httptest.ResponseRecorder {
+	furl := url.QueryEscape("/profile/" + cn + "/" + un + "/role")
+	req, _ := http.NewRequest("POST", furl, strings.NewReader(url.Values{"role": {role}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(dm.SetProfileRole).ServeHTTP(rr, withProfile(req, caller))
+	return rr
+}
+
+func TestSetProfileRoleRejected(t *testing.T) {
+	cn := "Sift Technologies, Inc."
+	admin := &Profile{UserName: "admin", CompanyID: 1, Role: ROLE_ADMIN}
+	owner := &Profile{UserName: "owner", CompanyID: 1, Role: ROLE_OWNER}
+	// Only owners manage roles
+	assert.Equal(t, http.StatusForbidden, setRole(admin, cn, "analyst", ROLE_ADMIN).Code)
+	// and only in their own company
+	assert.Equal(t, http.StatusForbidden, setRole(owner, "Sift Technologies, LLC", "analyst", ROLE_ADMIN).Code)
+	assert.Equal(t, http.StatusBadRequest, setRole(owner, cn, "analyst", "superuser").Code)
+}
+
+func TestSetProfileRole(t *testing.T) {
+	cn := "Role Co"
+	company := testCompany(t, cn)
+	defer dm.DeleteCompanyHelper(company.ID)
+	owner := Profile{UserName: "owner", CompanyID: company.ID, Role: ROLE_OWNER}
+	analyst := Profile{UserName: "analyst", CompanyID: company.ID, Role: ROLE_ANALYST}
+	for _, p := range []*Profile{&owner, &analyst} {
+		if err := db.Create(p).Error; err != nil {
+			t.Errorf("Error creating profile not expected. err: %v", err)
+		}
+		defer db.Unscoped().Delete(p)
+	}
+
+	assert.Equal(t, http.StatusNoContent, setRole(&owner, cn, "analyst", ROLE_ADMIN).Code)
+	p, _ := dm.GetProfileHelper("analyst", cn)
+	assert.Equal(t, ROLE_ADMIN, p.Role)
+
+	// The only owner cannot step down
+	assert.Equal(t, http.StatusBadRequest, setRole(&owner, cn, "owner", ROLE_ADMIN).Code)
+	// but can once there is another owner
+	assert.Equal(t, http.StatusNoContent, setRole(&owner, cn, "analyst", ROLE_OWNER).Code)
+	assert.Equal(t, http.StatusNoContent, setRole(&owner, cn, "owner", ROLE_VIEWER).Code)
+	p, _ = dm.GetProfileHelper("owner", cn)
+	assert.Equal(t, ROLE_VIEWER, p.Role)
+}
+
+func TestDeleteLastOwner(t *testing.T) {
+	cn := "Owner Co"
+	company := testCompany(t, cn)
+	defer dm.DeleteCompanyHelper(company.ID)
+	owner := Profile{UserName: "owner", CompanyID: company.ID, Role: ROLE_OWNER}
+	other := Profile{UserName: "other", CompanyID: company.ID, Role: ROLE_ADMIN}
+	for _, p := range []*Profile{&owner, &other} {
+		if err := db.Create(p).Error; err != nil {
+			t.Errorf("Error creating profile not expected. err: %v", err)
+		}
+		defer db.Unscoped().Delete(p)
+	}
+	deleteProfile := func(un string) int {
+		req, _ := http.NewRequest("DELETE", url.QueryEscape("/profile/"+cn+"/"+un), nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(dm.DeleteExistingProfile).ServeHTTP(rr, withProfile(req, &owner))
+		return rr.Code
+	}
+
+	// The only owner cannot delete their profile
+	assert.Equal(t, http.StatusBadRequest, deleteProfile("owner"))
+	// but can once there is another owner
+	assert.Equal(t, http.StatusNoContent, setRole(&owner, cn, "other", ROLE_OWNER).Code)
+	assert.Equal(t, http.StatusNoContent, deleteProfile("owner"))
+}
+
+func TestEqualRankProfileAccess(t *testing.T) {
+	cn := "Peer Co"
+	company := testCompany(t, cn)
+	defer dm.DeleteCompanyHelper(company.ID)
+	admin := Profile{UserName: "admin", CompanyID: company.ID, Role: ROLE_ADMIN}
+	peer := Profile{UserName: "peer", CompanyID: company.ID, Role: ROLE_ADMIN}
+	analyst := Profile{UserName: "analyst", CompanyID: company.ID, Role: ROLE_ANALYST}
+	for _, p := range []*Profile{&admin, &peer, &analyst} {
+		if err := db.Create(p).Error; err != nil {
+			t.Errorf("Error creating profile not expected. err: %v", err)
+		}
+		defer db.Unscoped().Delete(p)
+	}
+	profileRequest := func(handler http.HandlerFunc, method, un string) int {
+		form := url.Values{"email": {un + "@attacker.example.com"}}
+		req, _ := http.NewRequest(method, url.QueryEscape("/profile/"+cn+"/"+un), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, withProfile(req, &admin))
+		return rr.Code
+	}
+
+	// Admins can see other admins' profiles but not change them
+	assert.Equal(t, http.StatusOK, profileRequest(dm.GetExistingProfile, "GET", "peer"))
+	assert.Equal(t, http.StatusForbidden, profileRequest(dm.UpdateExistingProfile, "PUT", "peer"))
+	assert.Equal(t, http.StatusForbidden, profileRequest(dm.DeleteExistingProfile, "DELETE", "peer"))
+	p, _ := dm.GetProfileHelper("peer", cn)
+	assert.Equal(t, "", p.Email)
+	// Lower ranked profiles can still be managed
+	assert.Equal(t, http.StatusOK, profileRequest(dm.UpdateExistingProfile, "PUT", "analyst"))
+}
+
+func TestMigrateRolesHelper(t *testing.T) {
+	company := testCompany(t, "Legacy Co")
+	defer dm.DeleteCompanyHelper(company.ID)
+	first := Profile{UserName: "first", CompanyID: company.ID}
+	second := Profile{UserName: "second", CompanyID: company.ID}
+	for _, p := range []*Profile{&first, &second} {
+		if err := db.Create(p).Error; err != nil {
+			t.Errorf("Error creating profile not expected. err: %v", err)
+		}
+		defer db.Unscoped().Delete(p)
+	}
+	assert.Nil(t, dm.MigrateRolesHelper())
+	p, _ := dm.GetProfileHelper("first", "Legacy Co")
+	assert.Equal(t, ROLE_OWNER, p.Role)
+	p, _ = dm.GetProfileHelper("second", "Legacy Co")
+	assert.Equal(t, ROLE_ANALYST, p.Role)
+}
@@ -0,0 +1,413 @@
+// Per-company job quotas and round-robin scheduling of queued jobs.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Statuses of a QueuedJob
+const (
+	QUEUED_JOB_WAITING  = "waiting"
+	QUEUED_JOB_RUNNING  = "running"
+	QUEUED_JOB_FINISHED = "finished"
+	// Jobs that were running on an API instance that has since stopped, whose
+	// results were lost
+	QUEUED_JOB_LOST = "lost"
+)
+
+const (
+	// Jobs a company may have running at once, unless overridden by a CompanyQuota
+	DEFAULT_MAX_CONCURRENT_JOBS = 2
+	// Jobs a company may submit per 24 hours, unless overridden by a CompanyQuota
+	DEFAULT_MAX_DAILY_JOBS = 100
+	// Jobs that may be running at once across all companies
+	DEFAULT_MAX_RUNNING_JOBS = 8
+	// How often the scheduler checks for dispatchable jobs when not woken
+	SCHEDULE_PERIOD = time.Second
+	// How often an API instance marks the queued jobs it holds as alive
+	QUEUE_HEARTBEAT_PERIOD = 10 * time.Second
+	// How long after its last heartbeat an instance's jobs are taken over by
+	// other instances
+	QUEUE_OWNER_TIMEOUT = time.Minute
+	// Jobs each client may submit anonymously per 24 hours
+	ANONYMOUS_JOBS_PER_CLIENT = 20
+	// Namespace of the advisory locks taken while checking daily quotas
+	QUEUE_LOCK_NAMESPACE = 32
+)
+
+// ErrDailyQuotaExceeded is returned by Submit when a company has used up its
+// daily job quota
+var ErrDailyQuotaExceeded = errors.New("Daily job quota exceeded")
+
+// JobQuota limits the number of jobs a company may run
+type JobQuota struct {
+	MaxConcurrent int
+	MaxDaily      int
+}
+
+// JobQueueStore persists the scheduler's queue, which may be shared by several
+// API instances. Each queued job is owned by the instance holding it in
+// memory, identified by its Owner. PGJobQueue is the production
+// implementation.
+type JobQueueStore interface {
+	// Enqueue adds qj to the queue, or returns ErrDailyQuotaExceeded if its
+	// company has already submitted maxDaily jobs in the past 24 hours. The
+	// check and insert are atomic. maxDaily <= 0 disables the check.
+	Enqueue(qj *QueuedJob, maxDaily int) error
+	// ByStatus returns jobs with the given status, oldest first
+	ByStatus(status string) ([]QueuedJob, error)
+	SetStatus(jobID, status string) error
+	// Claim moves a waiting job of owner to running, and reports whether it
+	// did so
+	Claim(jobID, owner string) (bool, error)
+	// Heartbeat marks the waiting and running jobs of owner as held by a live
+	// instance
+	Heartbeat(owner string) error
+	// Reclaim takes over the jobs of instances with no heartbeat since
+	// before. Their running jobs are marked lost, and their waiting jobs are
+	// given to owner and returned.
+	Reclaim(owner string, before time.Time) ([]QueuedJob, error)
+	Quota(companyID uint) (JobQuota, error)
+}
+
+// rawParams carries params recovered from a stored envelope, which were
+// validated when the job was first submitted
+type rawParams json.RawMessage
+
+func (p rawParams) Validate() error { return nil }
+
+func (p rawParams) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+/* ----------------------------- HELPER METHODS ----------------------------- */
+
+// PGJobQueue stores the scheduler's queue in Postgres
+type PGJobQueue struct {
+	dm *DataManager
+}
+
+func NewPGJobQueue(dm *DataManager) *PGJobQueue {
+	return &PGJobQueue{dm}
+}
+
+func (q *PGJobQueue) Enqueue(qj *QueuedJob, maxDaily int) error {
+	tx := q.dm.ForCompany(qj.CompanyID).Begin()
+	if maxDaily > 0 {
+		// Concurrent submissions by the company wait here until this
+		// transaction ends, so they count this job
+		if err := tx.DB().Exec("SELECT pg_advisory_xact_lock(?, ?)", QUEUE_LOCK_NAMESPACE, qj.CompanyID).Error; err != nil {
+			tx.DB().Rollback()
+			return err
+		}
+		var n int
+		if err := tx.Query(&QueuedJob{}).Where("created_at > ?", time.Now().Add(-24*time.Hour)).Count(&n).Error; err != nil {
+			tx.DB().Rollback()
+			return err
+		}
+		if n >= maxDaily {
+			tx.DB().Rollback()
+			return ErrDailyQuotaExceeded
+		}
+	}
+	if err := tx.Create(qj); err != nil {
+		tx.DB().Rollback()
+		return err
+	}
+	return tx.DB().Commit().Error
+}
+
+func (q *PGJobQueue) ByStatus(status string) (jobs []QueuedJob, err error) {
+	err = q.dm.Where("status = ?", status).Order("id asc").Find(&jobs).Error
+	return
+}
+
+func (q *PGJobQueue) SetStatus(jobID, status string) error {
+	return q.dm.Model(&QueuedJob{}).Where("job_id = ?", jobID).Update("status", status).Error
+}
+
+func (q *PGJobQueue) Claim(jobID, owner string) (bool, error) {
+	res := q.dm.Model(&QueuedJob{}).Where("job_id = ? AND owner = ? AND status = ?", jobID, owner, QUEUED_JOB_WAITING).
+		Update("status", QUEUED_JOB_RUNNING)
+	return res.RowsAffected == 1, res.Error
+}
+
+func (q *PGJobQueue) Heartbeat(owner string) error {
+	return q.dm.Model(&QueuedJob{}).Where("owner = ? AND status IN (?)", owner, []string{QUEUED_JOB_WAITING, QUEUED_JOB_RUNNING}).
+		Update("heartbeat_at", time.Now()).Error
+}
+
+func (q *PGJobQueue) Reclaim(owner string, before time.Time) ([]QueuedJob, error) {
+	// Rows queued before owners were recorded have no heartbeat
+	stale := "status = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?)"
+	err := q.dm.Model(&QueuedJob{}).Where(stale, QUEUED_JOB_RUNNING, before).Update("status", QUEUED_JOB_LOST).Error
+	if err != nil {
+		return nil, err
+	}
+	var candidates, claimed []QueuedJob
+	if err := q.dm.Where(stale, QUEUED_JOB_WAITING, before).Order("id asc").Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for _, qj := range candidates {
+		// Only one of several instances reclaiming at once updates the row
+		res := q.dm.Model(&QueuedJob{}).Where("id = ? AND "+stale, qj.ID, QUEUED_JOB_WAITING, before).
+			Updates(map[string]interface{}{"owner": owner, "heartbeat_at": time.Now()})
+		if res.Error != nil {
+			return claimed, res.Error
+		}
+		if res.RowsAffected == 1 {
+			qj.Owner = owner
+			claimed = append(claimed, qj)
+		}
+	}
+	return claimed, nil
+}
+
+func (q *PGJobQueue) Quota(companyID uint) (JobQuota, error) {
+	quota := JobQuota{DEFAULT_MAX_CONCURRENT_JOBS, DEFAULT_MAX_DAILY_JOBS}
+	var cq CompanyQuota
+	res := q.dm.ForCompany(companyID).Query(&CompanyQuota{}).First(&cq)
+	if res.RecordNotFound() {
+		return quota, nil
+	} else if res.Error != nil {
+		return quota, res.Error
+	}
+	if cq.MaxConcurrent > 0 {
+		quota.MaxConcurrent = cq.MaxConcurrent
+	}
+	if cq.MaxDaily > 0 {
+		quota.MaxDaily = cq.MaxDaily
+	}
+	return quota, nil
+}
+
+/* -------------------------------------------------------------------------- */
+
+// StartScheduler makes jr hold submitted jobs in store and dispatch them
+// round-robin across companies, within each company's quota and at most
+// jr.MaxRunning at a time.
+//
+// Several API instances may share a store. Each dispatches only the jobs
+// submitted to it, while concurrency limits count the jobs running on every
+// instance. Jobs of an instance that stops sending heartbeats for
+// QUEUE_OWNER_TIMEOUT, such as one replaced by a deploy, are taken over by
+// the others: waiting jobs are recovered and running jobs are marked lost.
+func (jr *JobRunner) StartScheduler(store JobQueueStore) error {
+	instance, err := newJobID()
+	if err != nil {
+		return err
+	}
+	jr.instance = instance
+	jr.store = store
+	jr.wakeup = make(chan bool, 1)
+	jr.stop = make(chan bool)
+	if err := jr.reclaim(); err != nil {
+		return err
+	}
+	go jr.schedule()
+	return nil
+}
+
+// StopScheduler stops dispatching queued jobs. Jobs already running are
+// unaffected.
+func (jr *JobRunner) StopScheduler() {
+	close(jr.stop)
+}
+
+// wake prompts the scheduler to check for dispatchable jobs
+func (jr *JobRunner) wake() {
+	select {
+	case jr.wakeup <- true:
+	default:
+	}
+}
+
+// enqueue adds job to the store, within the company's daily quota. Anonymous
+// jobs are limited per client by FeedbackFormHandler instead, so that one
+// client cannot use up the quota of all the others.
+func (jr *JobRunner) enqueue(job *Job) error {
+	maxDaily := 0
+	if job.CompanyID != 0 {
+		quota, err := jr.store.Quota(job.CompanyID)
+		if err != nil {
+			return err
+		}
+		maxDaily = quota.MaxDaily
+	}
+	env, err := json.Marshal(job.Envelope)
+	if err != nil {
+		return err
+	}
+	return jr.store.Enqueue(&QueuedJob{
+		JobID:       job.ID,
+		CompanyID:   job.CompanyID,
+		Analysis:    job.Analysis.Name,
+		Envelope:    string(env),
+		Status:      QUEUED_JOB_WAITING,
+		Owner:       jr.instance,
+		HeartbeatAt: time.Now(),
+	}, maxDaily)
+}
+
+// reclaim takes over the jobs of stopped instances, including this one's
+// previous run, and rebuilds in-memory jobs for the waiting ones
+func (jr *JobRunner) reclaim() error {
+	waiting, err := jr.store.Reclaim(jr.instance, time.Now().Add(-QUEUE_OWNER_TIMEOUT))
+	if err != nil {
+		return err
+	}
+	for _, qj := range waiting {
+		at, err := GetAnalysisType(qj.Analysis)
+		if err != nil {
+			jr.store.SetStatus(qj.JobID, QUEUED_JOB_LOST)
+			continue
+		}
+		var stored struct {
+			JobEnvelope
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal([]byte(qj.Envelope), &stored); err != nil {
+			jr.store.SetStatus(qj.JobID, QUEUED_JOB_LOST)
+			continue
+		}
+		env := stored.JobEnvelope
+		env.Params = rawParams(stored.Params)
+		jr.mu.Lock()
+		jr.jobs[qj.JobID] = newJob(qj.JobID, qj.CompanyID, at, env)
+		jr.mu.Unlock()
+	}
+	return nil
+}
+
+// schedule dispatches waiting jobs whenever woken or every SCHEDULE_PERIOD,
+// and keeps this instance's jobs alive every QUEUE_HEARTBEAT_PERIOD
+func (jr *JobRunner) schedule() {
+	ticker := time.NewTicker(SCHEDULE_PERIOD)
+	defer ticker.Stop()
+	heartbeat := time.NewTicker(QUEUE_HEARTBEAT_PERIOD)
+	defer heartbeat.Stop()
+	for {
+		if err := jr.dispatchWaiting(); err != nil {
+			fmt.Println("jr.dispatchWaiting: ", err)
+		}
+		select {
+		case <-jr.wakeup:
+		case <-ticker.C:
+		case <-heartbeat.C:
+			if err := jr.store.Heartbeat(jr.instance); err != nil {
+				fmt.Println("store.Heartbeat: ", err)
+			}
+			if err := jr.reclaim(); err != nil {
+				fmt.Println("jr.reclaim: ", err)
+			}
+		case <-jr.stop:
+			return
+		}
+	}
+}
+
+// companyIDs sorts company IDs in increasing order
+type companyIDs []uint
+
+func (c companyIDs) Len() int           { return len(c) }
+func (c companyIDs) Less(i, j int) bool { return c[i] < c[j] }
+func (c companyIDs) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// rotate orders sorted companies to start after last, so that each
+// scheduling pass begins with the company following the one served most
+// recently
+func rotate(companies []uint, last uint) []uint {
+	start := sort.Search(len(companies), func(i int) bool { return companies[i] >= last })
+	if start < len(companies) && companies[start] == last {
+		start++
+	}
+	return append(append([]uint{}, companies[start:]...), companies[:start]...)
+}
+
+// dispatchWaiting starts as many of this instance's waiting jobs as quotas
+// allow, taking one job per company in turn so that a company with many
+// waiting jobs cannot starve the others
+func (jr *JobRunner) dispatchWaiting() error {
+	all, err := jr.store.ByStatus(QUEUED_JOB_WAITING)
+	if err != nil {
+		return err
+	}
+	// Jobs held by other instances are dispatched by them
+	var waiting []QueuedJob
+	for _, qj := range all {
+		if qj.Owner == jr.instance {
+			waiting = append(waiting, qj)
+		}
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+	runningJobs, err := jr.store.ByStatus(QUEUED_JOB_RUNNING)
+	if err != nil {
+		return err
+	}
+	running := make(map[uint]int)
+	for _, qj := range runningJobs {
+		running[qj.CompanyID]++
+	}
+	total := len(runningJobs)
+
+	byCompany := make(map[uint][]QueuedJob)
+	for _, qj := range waiting {
+		byCompany[qj.CompanyID] = append(byCompany[qj.CompanyID], qj)
+	}
+	companies := make([]uint, 0, len(byCompany))
+	for c := range byCompany {
+		companies = append(companies, c)
+	}
+	sort.Sort(companyIDs(companies))
+	quotas := make(map[uint]JobQuota)
+	for _, c := range companies {
+		if quotas[c], err = jr.store.Quota(c); err != nil {
+			return err
+		}
+	}
+
+	jr.mu.Lock()
+	order := rotate(companies, jr.lastCompany)
+	jr.mu.Unlock()
+	for dispatched := true; dispatched; {
+		dispatched = false
+		for _, c := range order {
+			if total >= jr.MaxRunning {
+				return nil
+			}
+			if len(byCompany[c]) == 0 || running[c] >= quotas[c].MaxConcurrent {
+				continue
+			}
+			qj := byCompany[c][0]
+			byCompany[c] = byCompany[c][1:]
+			job, ok := jr.GetJob(qj.JobID)
+			if !ok {
+				jr.store.SetStatus(qj.JobID, QUEUED_JOB_LOST)
+				continue
+			}
+			if claimed, err := jr.store.Claim(qj.JobID, jr.instance); err != nil {
+				return err
+			} else if !claimed {
+				continue
+			}
+			running[c]++
+			total++
+			dispatched = true
+			jr.mu.Lock()
+			jr.lastCompany = c
+			jr.mu.Unlock()
+			go jr.run(job)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memJobQueue is an in-memory JobQueueStore
+type memJobQueue struct {
+	mu     sync.Mutex
+	jobs   []QueuedJob
+	quotas map[uint]JobQuota
+	// IDs passed to SetStatus that were never enqueued
+	unknown []string
+}
+
+func (q *memJobQueue) Enqueue(qj *QueuedJob, maxDaily int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if maxDaily > 0 {
+		n := 0
+		for _, other := range q.jobs {
+			if other.CompanyID == qj.CompanyID && other.CreatedAt.After(time.Now().Add(-24*time.Hour)) {
+				n++
+			}
+		}
+		if n >= maxDaily {
+			return ErrDailyQuotaExceeded
+		}
+	}
+	qj.CreatedAt = time.Now()
+	q.jobs = append(q.jobs, *qj)
+	return nil
+}
+
+func (q *memJobQueue) ByStatus(status string) ([]QueuedJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var jobs []QueuedJob
+	for _, qj := range q.jobs {
+		if qj.Status == status {
+			jobs = append(jobs, qj)
+		}
+	}
+	return jobs, nil
+}
+
+func (q *memJobQueue) SetStatus(jobID, status string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.jobs {
+		if q.jobs[i].JobID == jobID {
+			q.jobs[i].Status = status
+			return nil
+		}
+	}
+	q.unknown = append(q.unknown, jobID)
+	return nil
+}
+
+func (q *memJobQueue) Claim(jobID, owner string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.jobs {
+		qj := &q.jobs[i]
+		if qj.JobID == jobID && qj.Owner == owner && qj.Status == QUEUED_JOB_WAITING {
+			qj.Status = QUEUED_JOB_RUNNING
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *memJobQueue) Heartbeat(owner string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.jobs {
+		if q.jobs[i].Owner == owner {
+			q.jobs[i].HeartbeatAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (q *memJobQueue) Reclaim(owner string, before time.Time) ([]QueuedJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var claimed []QueuedJob
+	for i := range q.jobs {
+		qj := &q.jobs[i]
+		if !qj.HeartbeatAt.Before(before) {
+			continue
+		}
+		switch qj.Status {
+		case QUEUED_JOB_RUNNING:
+			qj.Status = QUEUED_JOB_LOST
+		case QUEUED_JOB_WAITING:
+			qj.Owner, qj.HeartbeatAt = owner, time.Now()
+			claimed = append(claimed, *qj)
+		}
+	}
+	return claimed, nil
+}
+
+func (q *memJobQueue) Quota(company uint) (JobQuota, error) {
+	if quota, ok := q.quotas[company]; ok {
+		return quota, nil
+	}
+	return JobQuota{DEFAULT_MAX_CONCURRENT_JOBS, DEFAULT_MAX_DAILY_JOBS}, nil
+}
+
+// gatedQueue records the order payloads are dispatched in, and holds each
+// task PENDING until it is released
+type gatedQueue struct {
+	mu         sync.Mutex
+	dispatched []string
+	released   map[string]bool
+}
+
+func (q *gatedQueue) Dispatch(name string, payload interface{}) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	taskID := payload.(JobEnvelope).Feedback[0].FBody
+	q.dispatched = append(q.dispatched, taskID)
+	return taskID, nil
+}
+
+func (q *gatedQueue) State(taskID string) (*TaskState, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.released[taskID] {
+		return &TaskState{Status: "SUCCESS", Result: "done"}, nil
+	}
+	return &TaskState{Status: "PENDING"}, nil
+}
+
+func (q *gatedQueue) release(taskID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.released[taskID] = true
+}
+
+func (q *gatedQueue) order() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string{}, q.dispatched...)
+}
+
+// waitForDispatches waits until q has dispatched n tasks
+func waitForDispatches(t *testing.T, q *gatedQueue, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if order := q.order(); len(order) >= n {
+			return order
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d dispatches, got %v", n, q.order())
+	return nil
+}
+
+func submitNamed(t *testing.T, jr *JobRunner, company uint, name string) *Job {
+	at, _ := GetAnalysisType("summarization")
+	job, err := jr.Submit(company, at, NewJobEnvelope(at.Name, nil, []Feedback{{0, name}}), false)
+	if err != nil {
+		t.Fatal("jr.Submit: ", err)
+	}
+	return job
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	jr.MaxRunning = 1
+	store := &memJobQueue{quotas: map[uint]JobQuota{}}
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+
+	submitNamed(t, jr, 1, "heavy-1")
+	waitForDispatches(t, q, 1)
+	submitNamed(t, jr, 1, "heavy-2")
+	submitNamed(t, jr, 1, "heavy-3")
+	submitNamed(t, jr, 2, "light-1")
+
+	q.release("heavy-1")
+	waitForDispatches(t, q, 2)
+	q.release("light-1")
+	waitForDispatches(t, q, 3)
+	q.release("heavy-2")
+	order := waitForDispatches(t, q, 4)
+
+	assert.Equal(t, []string{"heavy-1", "light-1", "heavy-2", "heavy-3"}, order)
+}
+
+func TestSchedulerConcurrentQuota(t *testing.T) {
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	store := &memJobQueue{quotas: map[uint]JobQuota{1: {MaxConcurrent: 1, MaxDaily: 10}}}
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+
+	submitNamed(t, jr, 1, "acme-1")
+	second := submitNamed(t, jr, 1, "acme-2")
+	waitForDispatches(t, q, 1)
+	time.Sleep(3 * QUERY_PERIOD)
+
+	// The second job is held until the first finishes
+	assert.Equal(t, []string{"acme-1"}, q.order())
+	assert.Equal(t, JOB_QUEUED, second.Status().Status)
+	waiting, _ := store.ByStatus(QUEUED_JOB_WAITING)
+	assert.Equal(t, 1, len(waiting))
+
+	q.release("acme-1")
+	waitForDispatches(t, q, 2)
+}
+
+func TestSchedulerDailyQuota(t *testing.T) {
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	store := &memJobQueue{quotas: map[uint]JobQuota{1: {MaxConcurrent: 5, MaxDaily: 2}}}
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+
+	submitNamed(t, jr, 1, "acme-1")
+	submitNamed(t, jr, 1, "acme-2")
+	at, _ := GetAnalysisType("summarization")
+	_, err := jr.Submit(1, at, NewJobEnvelope(at.Name, nil, []Feedback{{0, "acme-3"}}), false)
+	assert.Equal(t, ErrDailyQuotaExceeded, err)
+
+	// Rejected jobs are not retained
+	jr.mu.Lock()
+	assert.Equal(t, 2, len(jr.jobs))
+	jr.mu.Unlock()
+
+	// Other companies are unaffected
+	submitNamed(t, jr, 2, "other-1")
+}
+
+// visibleQueue checks that jobs can be found on their runner as soon as
+// their rows are written, when a scheduler tick may look for them
+type visibleQueue struct {
+	*memJobQueue
+	t  *testing.T
+	jr *JobRunner
+}
+
+func (q *visibleQueue) Enqueue(qj *QueuedJob, maxDaily int) error {
+	if _, ok := q.jr.GetJob(qj.JobID); !ok {
+		q.t.Errorf("Job %s was enqueued before it was retained", qj.JobID)
+	}
+	return q.memJobQueue.Enqueue(qj, maxDaily)
+}
+
+func TestSchedulerJobRetainedBeforeEnqueue(t *testing.T) {
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	if err := jr.StartScheduler(&visibleQueue{&memJobQueue{}, t, jr}); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+	submitNamed(t, jr, 1, "acme-1")
+}
+
+func TestSchedulerRecoversWaitingJobs(t *testing.T) {
+	store := &memJobQueue{quotas: map[uint]JobQuota{}}
+	store.Enqueue(&QueuedJob{
+		JobID:     "recovered",
+		CompanyID: 1,
+		Analysis:  "lda_topics",
+		Envelope:  `{"version":1,"analysis":"lda_topics","params":{"num_topics":3},"feedback":[{"fb_id":0,"fb_body":"acme-1"}]}`,
+		Status:    QUEUED_JOB_WAITING,
+		Owner:     "stopped",
+	}, 0)
+	store.Enqueue(&QueuedJob{JobID: "interrupted", CompanyID: 1, Status: QUEUED_JOB_RUNNING, Owner: "stopped"}, 0)
+
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+
+	waitForDispatches(t, q, 1)
+	job, ok := jr.GetJob("recovered")
+	assert.True(t, ok)
+	assert.Equal(t, uint(1), job.CompanyID)
+	lost, _ := store.ByStatus(QUEUED_JOB_LOST)
+	assert.Equal(t, 1, len(lost))
+	assert.Equal(t, "interrupted", lost[0].JobID)
+}
+
+func TestSchedulerLeavesOtherInstancesJobs(t *testing.T) {
+	store := &memJobQueue{quotas: map[uint]JobQuota{}}
+	now := time.Now()
+	store.Enqueue(&QueuedJob{
+		JobID:       "theirs-waiting",
+		CompanyID:   1,
+		Analysis:    "summarization",
+		Envelope:    `{"version":1,"analysis":"summarization","feedback":[{"fb_id":0,"fb_body":"theirs-waiting"}]}`,
+		Status:      QUEUED_JOB_WAITING,
+		Owner:       "other",
+		HeartbeatAt: now,
+	}, 0)
+	store.Enqueue(&QueuedJob{JobID: "theirs-running", CompanyID: 1, Status: QUEUED_JOB_RUNNING, Owner: "other", HeartbeatAt: now}, 0)
+
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+
+	// This instance's jobs are dispatched, and the live instance's are not
+	submitNamed(t, jr, 2, "mine")
+	waitForDispatches(t, q, 1)
+	time.Sleep(3 * QUERY_PERIOD)
+	assert.Equal(t, []string{"mine"}, q.order())
+	lost, _ := store.ByStatus(QUEUED_JOB_LOST)
+	assert.Equal(t, 0, len(lost))
+	waiting, _ := store.ByStatus(QUEUED_JOB_WAITING)
+	assert.Equal(t, 1, len(waiting))
+	assert.Equal(t, "other", waiting[0].Owner)
+}
+
+func TestSchedulerAnonymousUnlimited(t *testing.T) {
+	q := &gatedQueue{released: make(map[string]bool)}
+	jr := NewJobRunner(func() (TaskQueue, error) { return q, nil })
+	store := &memJobQueue{quotas: map[uint]JobQuota{0: {MaxConcurrent: 1, MaxDaily: 1}}}
+	if err := jr.StartScheduler(store); err != nil {
+		t.Fatal("jr.StartScheduler: ", err)
+	}
+	defer jr.StopScheduler()
+
+	// Anonymous uploads are limited per client by FeedbackFormHandler
+	submitNamed(t, jr, 0, "anon-1")
+	submitNamed(t, jr, 0, "anon-2")
+}
+
+func TestRotate(t *testing.T) {
+	companies := []uint{1, 3, 5}
+	assert.Equal(t, []uint{1, 3, 5}, rotate(companies, 0))
+	assert.Equal(t, []uint{5, 1, 3}, rotate(companies, 3))
+	assert.Equal(t, []uint{1, 3, 5}, rotate(companies, 5))
+	assert.Equal(t, []uint{5, 1, 3}, rotate(companies, 4))
+}
@@ -22,7 +22,22 @@ var dm = NewDataManager(db)
 func TestMain(m *testing.M) {
 	// Add new models here
 	dm.AutoMigrate(&Session{})
+	dm.AutoMigrate(&Company{})
 	dm.AutoMigrate(&Profile{})
+	dm.AutoMigrate(&Webhook{})
+	dm.AutoMigrate(&WebhookDelivery{})
+	dm.AutoMigrate(&QueuedJob{})
+	dm.AutoMigrate(&CompanyQuota{})
+	dm.AutoMigrate(&CachedResult{})
+	dm.AutoMigrate(&FeedbackRecord{})
+	dm.AutoMigrate(&Schedule{})
+	dm.AutoMigrate(&ScheduleRun{})
+	dm.AutoMigrate(&PasswordHistory{})
+	dm.AutoMigrate(&PasswordResetToken{})
+	dm.AutoMigrate(&Invite{})
+	dm.AutoMigrate(&APIKey{})
+	dm.AutoMigrate(&RefreshToken{})
+	dm.AutoMigrate(&RecoveryCode{})
 
 	defer dm.Close()
 	m.Run()
@@ -0,0 +1,126 @@
+// Company-scoped access to the database, so that handlers acting for a user
+// can only reach the data of the user's company
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrNotTenantScoped is returned when a TenantDB is used with a model that
+// does not belong to a company
+var ErrNotTenantScoped = errors.New("model is not scoped to a company")
+
+// ErrCrossTenant is returned when a TenantDB is asked to write a record that
+// belongs to another company
+var ErrCrossTenant = errors.New("record belongs to another company")
+
+// TenantDB is a view of the database restricted to a single company. Queries
+// made through it only match rows with the company's company_id, and records
+// created or saved through it are assigned to the company. Models without a
+// CompanyID are rejected with ErrNotTenantScoped.
+type TenantDB struct {
+	dm        *DataManager
+	CompanyID uint
+}
+
+// ForCompany returns a TenantDB restricted to the company with the given ID
+func (dm *DataManager) ForCompany(id uint) *TenantDB {
+	return &TenantDB{dm, id}
+}
+
+// TenantForRequest checks that the caller attached to r by SessionMiddleware
+// holds perm, as RequirePermission does, and returns a TenantDB restricted to
+// the caller's company
+func (dm *DataManager) TenantForRequest(w http.ResponseWriter, r *http.Request, perm Permission) (*TenantDB, *Profile, bool) {
+	caller, ok := RequirePermission(w, r, perm)
+	if !ok {
+		return nil, nil, false
+	}
+	return dm.ForCompany(caller.CompanyID), caller, true
+}
+
+// Reports whether the model of scope, which may be a slice of models,
+// belongs to a company
+func tenantOwned(scope *gorm.Scope) bool {
+	for _, f := range scope.GetModelStruct().StructFields {
+		if f.Name == "CompanyID" {
+			return true
+		}
+	}
+	return false
+}
+
+// Query starts a query on model's table that only matches the company's
+// rows. It is used for reads, updates and deletes, e.g.
+//
+//	t.Query(&Webhook{}).Where("id = ?", id).First(&hook)
+//
+// If model does not belong to a company the query fails with
+// ErrNotTenantScoped without touching the database.
+func (t *TenantDB) Query(model interface{}) *gorm.DB {
+	scope := t.dm.NewScope(model)
+	db := t.dm.Model(model)
+	if !tenantOwned(scope) {
+		db.AddError(ErrNotTenantScoped)
+		return db
+	}
+	return db.Where(fmt.Sprintf("%s.company_id = ?", scope.QuotedTableName()), t.CompanyID)
+}
+
+// claim assigns value, a pointer to a model, to the company. Fails if value
+// already belongs to another company.
+func (t *TenantDB) claim(value interface{}) error {
+	scope := t.dm.NewScope(value)
+	field, ok := scope.FieldByName("CompanyID")
+	if !ok || scope.IndirectValue().Kind() != reflect.Struct {
+		return ErrNotTenantScoped
+	}
+	if !field.IsBlank && field.Field.Uint() != uint64(t.CompanyID) {
+		return ErrCrossTenant
+	}
+	return field.Set(t.CompanyID)
+}
+
+// Create inserts value, a pointer to a model, as a record of the company
+func (t *TenantDB) Create(value interface{}) error {
+	if err := t.claim(value); err != nil {
+		return err
+	}
+	return t.dm.Create(value).Error
+}
+
+// Save updates value, a pointer to a record of the company, or creates it if
+// it has no primary key. Records of other companies are never overwritten.
+func (t *TenantDB) Save(value interface{}) error {
+	if err := t.claim(value); err != nil {
+		return err
+	}
+	scope := t.dm.NewScope(value)
+	if !scope.PrimaryKeyZero() {
+		var n int
+		pk := fmt.Sprintf("%s.%s = ?", scope.QuotedTableName(), scope.Quote(scope.PrimaryKey()))
+		if err := t.Query(value).Where(pk, scope.PrimaryKeyValue()).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrCrossTenant
+		}
+	}
+	return t.dm.Save(value).Error
+}
+
+// Begin starts a transaction restricted to the same company. Finish it with
+// Commit or Rollback on the returned TenantDB's DB.
+func (t *TenantDB) Begin() *TenantDB {
+	return (&DataManager{t.dm.Begin(), t.dm.Cookies}).ForCompany(t.CompanyID)
+}
+
+// DB returns the underlying connection, for finishing transactions
+func (t *TenantDB) DB() *gorm.DB {
+	return t.dm.DB
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantRejectsUnscopedModels(t *testing.T) {
+	tenant := dm.ForCompany(1)
+	var sessions []Session
+	assert.Equal(t, ErrNotTenantScoped, tenant.Query(&Session{}).Find(&sessions).Error)
+	assert.Equal(t, ErrNotTenantScoped, tenant.Create(&Session{UserID: 1}))
+	assert.Equal(t, ErrNotTenantScoped, tenant.Save(&Company{Name: "Acme"}))
+}
+
+func TestTenantRejectsOtherCompanysRecords(t *testing.T) {
+	tenant := dm.ForCompany(1)
+	assert.Equal(t, ErrCrossTenant, tenant.Create(&Webhook{CompanyID: 2, URL: "https://example.com/hook"}))
+	assert.Equal(t, ErrCrossTenant, tenant.Save(&Schedule{CompanyID: 2}))
+}
+
+func TestTenantIsolation(t *testing.T) {
+	acme := testCompany(t, "Acme Tenant")
+	defer dm.DeleteCompanyHelper(acme.ID)
+	globex := testCompany(t, "Globex Tenant")
+	defer dm.DeleteCompanyHelper(globex.ID)
+	mine, theirs := dm.ForCompany(acme.ID), dm.ForCompany(globex.ID)
+
+	hook, err := mine.CreateWebhookHelper("https://acme.com/hook")
+	if err != nil {
+		t.Fatal("tenant.CreateWebhookHelper: ", err)
+	}
+	assert.Equal(t, acme.ID, hook.CompanyID)
+	s := Schedule{Cron: "0 9 * * 1", Analysis: "summarization", NextRunAt: time.Now().Add(time.Hour)}
+	assert.Nil(t, mine.Create(&s))
+	assert.Nil(t, mine.StoreFeedbackHelper([]Feedback{{0, "Blender is loud"}}))
+	user := Profile{UserName: "acme_user", Role: ROLE_ANALYST}
+	assert.Nil(t, mine.Create(&user))
+
+	// Reads through another company's view find nothing
+	_, err = theirs.GetWebhookHelper(hook.ID)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+	hooks, _ := theirs.GetWebhooksHelper()
+	assert.Equal(t, 0, len(hooks))
+	_, err = theirs.GetScheduleHelper(s.ID)
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+	fb, _ := theirs.GetFeedbackSinceHelper(time.Now().Add(-time.Hour))
+	assert.Equal(t, 0, len(fb))
+	_, err = theirs.GetProfileHelper("acme_user")
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+
+	// and writes leave the records untouched
+	assert.Nil(t, theirs.DeleteWebhookHelper(hook.ID))
+	res := theirs.Query(&Profile{}).Where("id = ?", user.ID).Update("role", ROLE_OWNER)
+	assert.Nil(t, res.Error)
+	assert.Equal(t, int64(0), res.RowsAffected)
+	hook.URL = "https://globex.com/stolen"
+	assert.Equal(t, ErrCrossTenant, theirs.Save(&hook))
+	hook.CompanyID = 0
+	assert.Equal(t, ErrCrossTenant, theirs.Save(&hook))
+
+	stored, err := mine.GetWebhookHelper(hook.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://acme.com/hook", stored.URL)
+	assert.Equal(t, acme.ID, stored.CompanyID)
+	p, err := mine.GetProfileHelper("acme_user")
+	assert.Nil(t, err)
+	assert.Equal(t, ROLE_ANALYST, p.Role)
+}
+
+func TestDeleteWebhookOtherCompany(t *testing.T) {
+	acme := testCompany(t, "Acme Tenant")
+	defer dm.DeleteCompanyHelper(acme.ID)
+	globex := testCompany(t, "Globex Tenant")
+	defer dm.DeleteCompanyHelper(globex.ID)
+	hook, err := dm.ForCompany(acme.ID).CreateWebhookHelper("https://acme.com/hook")
+	if err != nil {
+		t.Fatal("tenant.CreateWebhookHelper: ", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/webhooks/{id}", dm.DeleteWebhook).Methods("DELETE")
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/webhooks/%d", hook.ID), nil)
+	req = withProfile(req, &Profile{UserName: "globex_admin", CompanyID: globex.ID, Role: ROLE_ADMIN})
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	_, err = dm.ForCompany(acme.ID).GetWebhookHelper(hook.ID)
+	assert.Nil(t, err)
+}
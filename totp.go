@@ -0,0 +1,115 @@
+// Time-based one-time passwords (RFC 6238) for two-factor authentication,
+// compatible with common authenticator apps
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Each code is valid for one step of this length
+	TOTP_PERIOD = 30 * time.Second
+	TOTP_DIGITS = 6
+	// Codes from this many steps either side of the current one are also
+	// accepted, to allow for clock drift and slow typing
+	TOTP_SKEW = 1
+	// Length in bytes of generated secrets, as recommended by RFC 4226
+	TOTP_SECRET_LENGTH = 20
+	// Name shown for codes in authenticator apps
+	TOTP_ISSUER = "Sift"
+)
+
+// NewTOTPSecret returns a random secret, base32 encoded without padding as
+// authenticator apps expect
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, TOTP_SECRET_LENGTH)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(b), "="), nil
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimSpace(secret))
+	if n := len(secret) % 8; n != 0 {
+		secret += strings.Repeat("=", 8-n)
+	}
+	return base32.StdEncoding.DecodeString(secret)
+}
+
+// totpStep returns the time step t falls in
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD/time.Second)
+}
+
+// hotp computes the code for counter with key, as in RFC 4226
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, code%mod)
+}
+
+// TOTPCode returns the code for secret at t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(totpStep(t))), nil
+}
+
+// VerifyTOTP checks code against secret at now, allowing TOTP_SKEW steps of
+// drift. Codes from steps up to and including after are refused, so that
+// each code is only accepted once. Returns the step the code matched.
+func VerifyTOTP(secret, code string, now time.Time, after int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(key) == 0 || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= after {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI returns the otpauth URI that authenticator apps enroll secret from,
+// usually shown as a QR code. account identifies the user within the app.
+func TOTPURI(secret, account string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", TOTP_ISSUER)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	q.Set("period", fmt.Sprint(int(TOTP_PERIOD/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + TOTP_ISSUER + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
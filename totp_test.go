@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Base32 of the SHA-1 secret of the RFC 6238 test vectors
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC's eight digit codes, truncated to six
+	for unix, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTPCode(rfcTOTPSecret, time.Unix(unix, 0))
+		assert.Nil(t, err)
+		assert.Equal(t, code, got, unix)
+	}
+	_, err := TOTPCode("not base32!", time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal("NewTOTPSecret: ", err)
+	}
+	assert.False(t, strings.Contains(secret, "="))
+	now := time.Now()
+	code, _ := TOTPCode(secret, now)
+	step, ok := VerifyTOTP(secret, code, now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	// Codes from the neighbouring steps are accepted, but not older ones
+	prev, _ := TOTPCode(secret, now.Add(-TOTP_PERIOD))
+	_, ok = VerifyTOTP(secret, prev, now, 0)
+	assert.True(t, ok)
+	old, _ := TOTPCode(secret, now.Add(-3*TOTP_PERIOD))
+	_, ok = VerifyTOTP(secret, old, now, 0)
+	assert.False(t, ok)
+
+	// nor codes from steps already used
+	_, ok = VerifyTOTP(secret, code, now, step)
+	assert.False(t, ok)
+	_, ok = VerifyTOTP(secret, "12345", now, 0)
+	assert.False(t, ok)
+	_, ok = VerifyTOTP("", code, now, 0)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI(rfcTOTPSecret, "jane doe@Sift Co"))
+	if err != nil {
+		t.Fatal("url.Parse: ", err)
+	}
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/Sift:jane doe@Sift Co", u.Path)
+	assert.Equal(t, rfcTOTPSecret, u.Query().Get("secret"))
+	assert.Equal(t, TOTP_ISSUER, u.Query().Get("issuer"))
+}